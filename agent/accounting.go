@@ -0,0 +1,29 @@
+package agent
+
+import (
+	"github.com/yeasy/cmonit/data"
+)
+
+// accountant counts the usage of the clusters by user, nil when disabled
+var accountant *data.Accountant
+
+// SetAccountant enables the usage accounting of the cluster stats
+func SetAccountant(a *data.Accountant) {
+	accountant = a
+}
+
+// accountCluster adds the cluster stat into the usage of its user
+func accountCluster(s *data.ClusterStat) {
+	if accountant == nil || s == nil {
+		return
+	}
+	accountant.Observe(s)
+}
+
+// FlushUsage saves the usage counted so far
+func FlushUsage() error {
+	if accountant == nil {
+		return nil
+	}
+	return accountant.Flush()
+}
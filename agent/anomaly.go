@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"github.com/yeasy/cmonit/data"
+)
+
+// detector finds the anomalies of the collected stats, nil when disabled
+var detector *data.Detector
+
+// SetDetector enables the anomaly detection of the container and cluster stats
+func SetDetector(d *data.Detector) {
+	detector = d
+}
+
+// detectContainer checks the container stat against its baselines
+func detectContainer(s *data.ContainerStat) {
+	if detector == nil || s == nil {
+		return
+	}
+	detector.Observe("container", s.ContainerID, s.ContainerName, "cpu_percentage", s.CPUPercentage, s.TimeStamp)
+	detector.Observe("container", s.ContainerID, s.ContainerName, "memory_usage", s.Memory, s.TimeStamp)
+	detector.Observe("container", s.ContainerID, s.ContainerName, "pid_current", float64(s.PidsCurrent), s.TimeStamp)
+}
+
+// detectCluster checks the cluster stat against its baselines
+func detectCluster(s *data.ClusterStat) {
+	if detector == nil || s == nil {
+		return
+	}
+	detector.Observe("cluster", s.ClusterID, s.ClusterName, "cpu_percentage", s.CPUPercentage, s.TimeStamp)
+	detector.Observe("cluster", s.ClusterID, s.ClusterName, "memory_percentage", s.MemoryPercentage, s.TimeStamp)
+	if len(s.Latencies) > 0 {
+		detector.Observe("cluster", s.ClusterID, s.ClusterName, "avg_latency", s.AvgLatency, s.TimeStamp)
+	}
+}
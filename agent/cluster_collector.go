@@ -26,15 +26,22 @@ type ClusterMonitor struct {
 	cluster      *data.Cluster //cluster collection
 	output       *data.DB      //save out
 	DockerClient *client.Client
+	NodeClients  map[string]*client.Client // clients of other daemons in cluster.Nodes
+	LogServer    string                    // syslog server to forward the matched log lines, empty to not forward
+	Log          *util.Log                 // with the host context, nil to use the agent log
+	Span         *util.Span                // of the host, the parent of the cluster span
+	log          *util.Log
+	span         *util.Span
 }
 
 // Monit will write pointer of result to the channel
 // Even fail, must write nil
 func (clm *ClusterMonitor) Monit(cluster data.Cluster, outputDB *data.DB, outputCol string, dockerClient *client.Client, c chan *data.ClusterStat) {
-	logger.Debugf("Cluster %s (%s): Starting monit task\n", cluster.Name, cluster.ID)
+	clm.log = contextLog(clm.Log, util.LogFields{"cluster_id": cluster.ID})
+	clm.log.Debugf("Cluster %s (%s): Starting monit task\n", cluster.Name, cluster.ID)
 
 	if err := clm.Init(&cluster, outputDB, dockerClient); err != nil {
-		logger.Error(err)
+		clm.log.Error(err)
 		c <- nil
 		return
 	}
@@ -42,51 +49,77 @@ func (clm *ClusterMonitor) Monit(cluster data.Cluster, outputDB *data.DB, output
 	monitTime := time.Now().Sub(monitStart)
 	s, err := clm.CollectData()
 	//monitTime = time.Now().Sub(monitStart)
-	//logger.Infof("Cluster %s: collect used %s\n", cluster.Name, monitTime)
+	//clm.log.Infof("Cluster %s: collect used %s\n", cluster.Name, monitTime)
 
 	if err != nil {
-		logger.Error(err)
+		clm.log.Error(err)
 		c <- nil
 		return
 	}
 
-	//now get the stat for the cluster, may save to db and return to chan
-	logger.Debugf("Cluster %s: report collected data\n%+v", cluster.Name, *s)
+	//now get the stat for the cluster, saved before it is reported, as the round is flushed once all are reported
+	//the collection span is finished, so the writes are traced in a span of their own under the host
+	saveSpan := util.StartSpan(clm.Span, "cluster.save", "cluster_id", cluster.ID)
+	saveClusterStat(s, outputDB, outputCol, clm.log, saveSpan)
+	saveSpan.Finish()
+	monitTime = time.Now().Sub(monitStart)
+	clm.log.With(util.LogFields{"duration": monitTime.Seconds()}).Debugf("Cluster %s: monit used %s\n", cluster.Name, monitTime)
+	clm.log.Debugf("Cluster %s: report collected data\n%+v", cluster.Name, *s)
 	c <- s
+}
 
+// saveClusterStat will write the cluster stat to the outputs, logging with the given context log
+// and tracing the writes under the given span
+func saveClusterStat(s *data.ClusterStat, outputDB *data.DB, outputCol string, log *util.Log, span *util.Span) {
+	detectCluster(s)
+	// counted before the stat is reported, so the usage flushed at the end of the round has all the clusters
+	accountCluster(s)
 	if outputDB != nil && outputDB.URL != "" && outputDB.Name != "" && outputCol != "" {
-		outputDB.SaveData(*s, outputCol)
-		logger.Debugf("Cluster %s: saved to db %s/%s/%s\n", cluster.Name, outputDB.URL, outputDB.Name, outputCol)
+		outputDB.SaveDataSpan(*s, outputCol, span)
+		log.Debugf("Cluster %s: saved to db %s/%s/%s\n", s.ClusterName, outputDB.URL, outputDB.Name, outputCol)
 	}
 	if url, index := viper.GetString("output.elasticsearch.url"), viper.GetString("output.elasticsearch.index"); url != "" && index != "" {
 		esDoc := make(map[string]interface{})
 		esDoc["cluster_id"] = s.ClusterID
 		esDoc["cluster_name"] = s.ClusterName
+		esDoc["user_id"] = s.UserID
 		esDoc["cpu_percentage"] = s.CPUPercentage
 		esDoc["memory_usage"] = s.Memory
 		esDoc["memory_limit"] = s.MemoryLimit
 		esDoc["memory_percentage"] = s.MemoryPercentage
+		esDoc["memory_working_set"] = s.MemoryWorkingSet
+		esDoc["memory_rss"] = s.MemoryRSS
 		esDoc["network_rx"] = s.NetworkRx
 		esDoc["network_tx"] = s.NetworkTx
 		esDoc["block_read"] = s.BlockRead
 		esDoc["block_write"] = s.BlockWrite
+		esDoc["throttled_containers"] = s.Throttled
+		esDoc["disk_size_rw"] = s.DiskSizeRw
+		esDoc["disk_volumes_size"] = s.DiskVolumesSize
+		esDoc["disk_usage"] = s.DiskUsage
+		esDoc["disk_capacity"] = s.DiskCapacity
 		esDoc["size"] = s.Size
+		esDoc["missing_containers"] = s.Missing
 		esDoc["max_latency"] = s.MaxLatency
 		esDoc["avg_latency"] = s.AvgLatency
 		esDoc["min_latency"] = s.MinLatency
 		esDoc["latencies"] = s.Latencies
+		esDoc["cpu_distribution"] = s.CPUDistribution
+		esDoc["memory_distribution"] = s.MemoryDistribution
+		esDoc["latency_distribution"] = s.LatencyDistribution
 		esDoc["timestamp"] = s.TimeStamp.Format("2006-01-02 15:04:05")
 		data.ESInsertDoc(url, index, "cluster", esDoc)
-		logger.Debugf("Cluster %s: saved to es %s/%s/%s\n", cluster.Name, url, index, "cluster")
+		log.Debugf("Cluster %s: saved to es %s/%s/%s\n", s.ClusterName, url, index, "cluster")
 	}
-	monitTime = time.Now().Sub(monitStart)
-	logger.Debugf("Cluster %s: monit used %s\n", cluster.Name, monitTime)
 }
 
 //Init will finish the initialization
 func (clm *ClusterMonitor) Init(cluster *data.Cluster, output *data.DB, dockerClient *client.Client) error {
 	clm.cluster = cluster
 	clm.output = output
+	if clm.log == nil {
+		clm.log = contextLog(clm.Log, util.LogFields{"cluster_id": cluster.ID})
+	}
 
 	/*
 		defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
@@ -104,8 +137,8 @@ func (clm *ClusterMonitor) Init(cluster *data.Cluster, output *data.DB, dockerCl
 		}
 		cli, err := client.NewClient(clm.cluster.DaemonURL, "v1.22", &httpClient, defaultHeaders)
 		if err != nil {
-			logger.Errorf("Cannot init connection to docker host=%s\n", clm.cluster.DaemonURL)
-			logger.Error(err)
+			clm.log.Errorf("Cannot init connection to docker host=%s\n", clm.cluster.DaemonURL)
+			clm.log.Error(err)
 			return err
 		}
 		clm.DockerClient = cli
@@ -120,9 +153,11 @@ func (clm *ClusterMonitor) CollectData() (*data.ClusterStat, error) {
 	//var hasErr bool = false
 	containers := clm.cluster.Containers
 	lenContainers := len(containers)
-	logger.Debugf("Cluster %s: monit %d containers\n", clm.cluster.Name, lenContainers)
+	clm.span = util.StartSpan(clm.Span, "cluster.collect", "cluster_id", clm.cluster.ID, "containers", lenContainers)
+	defer clm.span.Finish()
+	clm.log.Debugf("Cluster %s: monit %d containers\n", clm.cluster.Name, lenContainers)
 	if lenContainers <= 0 {
-		logger.Debugf("%d containers, just return\n", lenContainers)
+		clm.log.Debugf("%d containers, just return\n", lenContainers)
 		return nil, errors.New("No container found in cluster")
 	}
 
@@ -131,8 +166,9 @@ func (clm *ClusterMonitor) CollectData() (*data.ClusterStat, error) {
 	defer close(ct)
 	names := []string{}
 	for name, id := range containers {
-		ctm := new(ContainerMonitor)
-		go ctm.Monit(clm.DockerClient, clm.cluster.DaemonURL, id, name, viper.GetString("output.mongo.col_container"), clm.output, ct)
+		ctm := &ContainerMonitor{LogServer: clm.LogServer, Log: clm.log, Span: clm.span}
+		cli, daemonURL := clm.clientFor(name)
+		go ctm.Monit(cli, daemonURL, id, name, viper.GetString("output.mongo.col_container"), clm.output, ct)
 		names = append(names, name)
 	}
 	sort.Strings(names)
@@ -142,21 +178,24 @@ func (clm *ClusterMonitor) CollectData() (*data.ClusterStat, error) {
 	for s := range ct {
 		if s != nil { //collect some data
 			csList = append(csList, s)
-			logger.Debugf("Cluster %s/Container %s: monit done\n", clm.cluster.Name, s.ContainerID)
+			clm.log.Debugf("Cluster %s/Container %s: monit done\n", clm.cluster.Name, s.ContainerID)
 		}
 		number++
-		logger.Debugf("Cluster %s/Container [%d/%d]: monit done\n", clm.cluster.Name, number, lenContainers)
+		clm.log.Debugf("Cluster %s/Container [%d/%d]: monit done\n", clm.cluster.Name, number, lenContainers)
 		if number >= lenContainers {
 			break
 		}
 	}
 	if len(csList) != lenContainers {
-		logger.Errorf("Cluster %s: only collected %d/%d container data\n", clm.cluster.Name, len(csList), lenContainers)
-		return nil, errors.New("Not enough container data collected")
+		clm.log.Errorf("Cluster %s: only collected %d/%d container data\n", clm.cluster.Name, len(csList), lenContainers)
+		err := errors.New("Not enough container data collected")
+		clm.span.SetError(err)
+		return nil, err
 	}
 	cs := data.ClusterStat{
 		ClusterID:        clm.cluster.ID,
 		ClusterName:      clm.cluster.Name,
+		UserID:           clm.cluster.UserID,
 		CPUPercentage:    0.0,
 		Memory:           0.0,
 		MemoryLimit:      0.0,
@@ -167,6 +206,7 @@ func (clm *ClusterMonitor) CollectData() (*data.ClusterStat, error) {
 		BlockWrite:       0.0,
 		PidsCurrent:      0,
 		Size:             uint64(len(clm.cluster.Containers)),
+		DiskCapacity:     clm.cluster.DiskQuota * 1e9,
 		AvgLatency:       0.0,
 		MaxLatency:       0.0,
 		MinLatency:       0.0,
@@ -178,38 +218,54 @@ func (clm *ClusterMonitor) CollectData() (*data.ClusterStat, error) {
 	if len(names) > 1 {
 		latencies, err := clm.calculateLatency(names)
 		if err != nil {
-			logger.Errorf("Cluster %s: Error to calculate latency\n", clm.cluster.Name)
+			clm.log.Errorf("Cluster %s: Error to calculate latency\n", clm.cluster.Name)
+			clm.span.SetError(err)
 			return &cs, err
 		}
 
-		cs.Latencies = latencies
-		cs.AvgLatency = util.Avg(latencies)
-		cs.MaxLatency = util.Max(latencies)
-		cs.MinLatency = util.Min(latencies)
+		cs.SetLatencies(latencies)
 	}
 
-	logger.Debugf("Cluster %s: collected data = %+v\n", clm.cluster.Name, cs)
+	clm.log.Debugf("Cluster %s: collected data = %+v\n", clm.cluster.Name, cs)
 	return &cs, nil
 }
 
+// clientFor returns the docker client and daemon url to reach the container.
+// A nil client means the daemon of the node cannot be reached in this round.
+func (clm *ClusterMonitor) clientFor(name string) (*client.Client, string) {
+	daemonURL, ok := clm.cluster.Nodes[name]
+	if !ok || daemonURL == clm.cluster.DaemonURL {
+		return clm.DockerClient, clm.cluster.DaemonURL
+	}
+	return clm.NodeClients[daemonURL], daemonURL
+}
+
 //getLatency will calculate the latency among the containers
 func (clm *ClusterMonitor) calculateLatency(containers []string) ([]float64, error) {
 	lenContainers := len(containers)
 	if lenContainers <= 1 {
-		logger.Warningf("Too few %d container to calculate latency", lenContainers)
+		clm.log.Warningf("Too few %d container to calculate latency", lenContainers)
 		return []float64{}, errors.New("Too few container")
 	}
 	//defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
 	//cli, err := client.NewClient(clm.cluster.DaemonURL, "", nil, defaultHeaders)
 	//if err != nil {
-	//	logger.Warningf("Cannot connect to docker host=%s\n", clm.cluster.DaemonURL)
+	//	clm.log.Warningf("Cannot connect to docker host=%s\n", clm.cluster.DaemonURL)
 	//	return nil, err
 	//}
 
+	span := util.StartSpan(clm.span, "cluster.latency", "probes", lenContainers*(lenContainers-1)/2)
+	defer span.Finish()
 	c := make(chan float64)
 	for i := 0; i < lenContainers-1; i++ {
 		for j := i + 1; j < lenContainers; j++ {
-			go getLantecy(clm.DockerClient, containers[i], containers[j], c)
+			cli, _ := clm.clientFor(containers[i])
+			go func(src, dst string) {
+				// getLantecy exits the goroutine when done, the deferred finish still runs
+				probe := util.StartSpan(span, "latency.probe", "src", src, "dst", dst)
+				defer probe.Finish()
+				probe.SetError(getLantecy(cli, src, dst, c, clm.log))
+			}(containers[i], containers[j])
 		}
 	}
 
@@ -226,8 +282,13 @@ func (clm *ClusterMonitor) calculateLatency(containers []string) ([]float64, err
 	return result, nil
 }
 
-func getLantecy(cli *client.Client, src, dst string, c chan float64) error {
+func getLantecy(cli *client.Client, src, dst string, c chan float64, log *util.Log) error {
 	//logger.Debugf("%s -> %s\n", src, dst)
+	if cli == nil {
+		log.Errorf("No docker client to exec from %s\n", src)
+		c <- 2000
+		return errors.New("docker client nil")
+	}
 	execConfig := types.ExecConfig{
 		Container:    src,
 		AttachStdout: true,
@@ -236,23 +297,23 @@ func getLantecy(cli *client.Client, src, dst string, c chan float64) error {
 	response, err := cli.ContainerExecCreate(context.Background(), execConfig)
 
 	if err != nil {
-		logger.Error("exec create failure")
-		logger.Error(err)
+		log.Error("exec create failure")
+		log.Error(err)
 		c <- 2000
 		return err
 	}
 
 	execID := response.ID
 	if execID == "" {
-		logger.Error("exec ID empty")
+		log.Error("exec ID empty")
 		c <- 2000
 		return errors.New("Exec ID empty")
 	}
 	res, err := cli.ContainerExecAttach(context.Background(), execID, execConfig)
 
 	if err != nil {
-		logger.Errorf("Cannot attach docker exec from %s to %s\n", src, dst)
-		logger.Error(err)
+		log.Errorf("Cannot attach docker exec from %s to %s\n", src, dst)
+		log.Error(err)
 		c <- 2000
 		return err
 	}
@@ -263,8 +324,8 @@ func getLantecy(cli *client.Client, src, dst string, c chan float64) error {
 	var n int
 	n, err = res.Reader.Read(v)
 	if err != nil {
-		logger.Errorf("Cannot parse cmd output from %s to %s\n", src, dst)
-		logger.Error(err)
+		log.Errorf("Cannot parse cmd output from %s to %s\n", src, dst)
+		log.Error(err)
 		c <- 2000
 		return err
 	}
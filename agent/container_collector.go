@@ -3,17 +3,18 @@ package agent
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
-	"net/http"
 	"strings"
 	"time"
 
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/filters"
+	"github.com/spf13/viper"
 	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
 	"golang.org/x/net/context"
 )
 
@@ -24,58 +25,122 @@ type ContainerMonitor struct {
 	containerName string
 	outputDB      *data.DB
 	DaemonURL     string
+	LogServer     string     // syslog server to forward the matched log lines
+	Log           *util.Log  // with the host and cluster context, nil to use the agent log
+	Span          *util.Span // of the cluster, the parent of the container span
+	log           *util.Log
 }
 
 // Monit will collect data for a container, exactly return a result pointer to chan
 func (ctm *ContainerMonitor) Monit(dockerClient *client.Client, daemonURL, containerID, containerName, outputCol string, outputDB *data.DB, c chan *data.ContainerStat) {
-	logger.Debugf("Container %s: Start monit task\n", containerName)
+	ctm.log = contextLog(ctm.Log, util.LogFields{"container": containerName})
+	ctm.log.Debugf("Container %s: Start monit task\n", containerName)
 	if err := ctm.Init(dockerClient, daemonURL, containerID, containerName, outputCol, outputDB); err != nil {
 		c <- nil
-		logger.Errorf("Container %s: Error to init monitor\n", containerName)
-		logger.Error(err)
+		ctm.log.Errorf("Container %s: Error to init monitor\n", containerName)
+		ctm.log.Error(err)
 		return
 	}
 	if s, err := ctm.CollectData(); err != nil {
-		logger.Errorf("Container %s: Error to collect container data with daemon %s\n", containerName, daemonURL)
-		logger.Error(err)
+		ctm.log.Errorf("Container %s: Error to collect container data with daemon %s\n", containerName, daemonURL)
+		ctm.log.Error(err)
 		c <- nil
 	} else {
-		c <- s
-		if outputDB != nil && outputDB.URL != "" && outputDB.Name != "" && outputCol != "" {
-			outputDB.SaveData(s, outputCol)
-			logger.Debugf("Container %s: saved to db %s/%s/%s\n", containerName, outputDB.URL, outputDB.Name, outputCol)
+		// saved before it is reported, as the round is flushed once all are reported,
+		// in a span under the cluster as the collection span is finished
+		saveSpan := util.StartSpan(ctm.Span, "container.save", "container", containerName)
+		saveContainerStat(s, outputDB, outputCol, ctm.log, saveSpan)
+		if processDue(daemonURL, containerName, time.Now()) {
+			collectProcesses(ctm.client, containerID, containerName, outputDB, ctm.log, saveSpan)
 		}
+		saveSpan.Finish()
+		c <- s
 	}
 	//return
 }
 
+// saveContainerStat will write the container stat to the outputs, logging with the given context log
+// and tracing the writes under the given span
+func saveContainerStat(s *data.ContainerStat, outputDB *data.DB, outputCol string, log *util.Log, span *util.Span) {
+	detectContainer(s)
+	if outputDB != nil && outputDB.URL != "" && outputDB.Name != "" && outputCol != "" {
+		outputDB.SaveDataSpan(s, outputCol, span)
+		log.Debugf("Container %s: saved to db %s/%s/%s\n", s.ContainerName, outputDB.URL, outputDB.Name, outputCol)
+	}
+	if url, index := viper.GetString("output.elasticsearch.url"), viper.GetString("output.elasticsearch.index"); url != "" && index != "" {
+		esDoc := make(map[string]interface{})
+		esDoc["container_id"] = s.ContainerID
+		esDoc["container_name"] = s.ContainerName
+		esDoc["cpu_percentage"] = s.CPUPercentage
+		esDoc["memory_usage"] = s.Memory
+		esDoc["memory_limit"] = s.MemoryLimit
+		esDoc["memory_percentage"] = s.MemoryPercentage
+		esDoc["memory_raw_usage"] = s.RawUsage
+		esDoc["memory_working_set"] = s.WorkingSet
+		esDoc["memory_rss"] = s.RSS
+		esDoc["memory_cache"] = s.Cache
+		esDoc["memory_swap"] = s.Swap
+		esDoc["memory_mapped_file"] = s.MappedFile
+		esDoc["memory_active_file"] = s.ActiveFile
+		esDoc["memory_inactive_file"] = s.InactiveFile
+		esDoc["memory_pgfault"] = s.PgFault
+		esDoc["memory_pgmajfault"] = s.PgMajFault
+		esDoc["memory_max_usage"] = s.MaxUsage
+		esDoc["memory_failcnt"] = s.Failcnt
+		esDoc["network_rx"] = s.NetworkRx
+		esDoc["network_tx"] = s.NetworkTx
+		esDoc["block_read"] = s.BlockRead
+		esDoc["block_write"] = s.BlockWrite
+		esDoc["cpu_user_percentage"] = s.UserPercentage
+		esDoc["cpu_kernel_percentage"] = s.KernelPercentage
+		esDoc["cpu_percpu_percentage"] = s.PerCPU
+		esDoc["cpu_periods"] = s.Periods
+		esDoc["cpu_throttled_periods"] = s.ThrottledPeriods
+		esDoc["cpu_throttled_time"] = s.ThrottledTime
+		esDoc["cpu_throttle_ratio"] = s.ThrottleRatio
+		esDoc["networks"] = s.Networks
+		esDoc["block_devices"] = s.BlockDevices
+		esDoc["disk_size_rw"] = s.SizeRw
+		esDoc["disk_size_root_fs"] = s.SizeRootFs
+		esDoc["disk_volumes_size"] = s.VolumesSize
+		esDoc["disk_volumes"] = s.Volumes
+		esDoc["log_lines"] = s.LogLines
+		esDoc["log_rate"] = s.LogRate
+		esDoc["log_hits"] = s.LogHits
+		esDoc["pid_current"] = s.PidsCurrent
+		esDoc["image"] = s.Image
+		esDoc["image_id"] = s.ImageID
+		esDoc["image_digest"] = s.ImageDigest
+		esDoc["started_at"] = s.StartedAt.Format("2006-01-02 15:04:05")
+		esDoc["uptime"] = s.Uptime
+		esDoc["restart_count"] = s.RestartCount
+		esDoc["status"] = s.Status
+		esDoc["health"] = s.Health
+		esDoc["oom_killed"] = s.OOMKilled
+		esDoc["exit_code"] = s.ExitCode
+		esDoc["cpu_shares"] = s.CPUShares
+		esDoc["cpu_limit"] = s.CPULimit
+		esDoc["memory_limit_config"] = s.MemoryLimitConfig
+		esDoc["memory_reservation"] = s.MemoryReservation
+		esDoc["labels"] = s.Labels
+		esDoc["timestamp"] = s.TimeStamp.Format("2006-01-02 15:04:05")
+		data.ESInsertDoc(url, index, "container", esDoc)
+	}
+}
+
 //Init will finish the setup
 //This should be call first before using any other method
 func (ctm *ContainerMonitor) Init(dockerClient *client.Client, daemonURL, containerID, containerName, outputCol string, outputDB *data.DB) error {
 	ctm.DaemonURL = daemonURL
-	if dockerClient != nil {
-		ctm.client = dockerClient
-	} else {
-		defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
-		httpClient := http.Client{
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   5 * time.Second,
-					KeepAlive: 15 * time.Second,
-				}).Dial,
-				MaxIdleConnsPerHost: 64,
-				DisableKeepAlives:   true, // use this to prevent many connections opened
-			},
-			Timeout: time.Duration(60) * time.Second,
-		}
-		cli, err := client.NewClient(daemonURL, "v1.22", &httpClient, defaultHeaders)
-		if err != nil {
-			logger.Errorf("Cannot init connection to docker host=%s\n", daemonURL)
-			logger.Error(err)
-			return err
-		}
-		ctm.client = cli
+	if ctm.log == nil {
+		ctm.log = contextLog(ctm.Log, util.LogFields{"container": containerName})
+	}
+	// the client is made once for each daemon with the settings of its host
+	if dockerClient == nil {
+		ctm.log.Errorf("Container %s: no connection to docker host=%s\n", containerName, daemonURL)
+		return errors.New("No docker client for daemon " + daemonURL)
 	}
+	ctm.client = dockerClient
 
 	ctm.containerID = containerID
 	ctm.containerName = containerName
@@ -89,32 +154,39 @@ func (ctm *ContainerMonitor) CollectData() (*data.ContainerStat, error) {
 	/*
 		info, err := ctm.client.Info(context.Background())
 		if err != nil {
-			logger.Warningf("Cannot get info from docker host\n")
+			ctm.log.Warningf("Cannot get info from docker host\n")
 			return err
 		}
 	*/
+	span := util.StartSpan(ctm.Span, "container.collect", "container", ctm.containerName, "daemon", ctm.DaemonURL)
+	defer span.Finish()
 	if ctm.client == nil {
-		logger.Errorf("Container %s: docker client nil", ctm.containerName)
-		return nil, errors.New("docker client nil")
+		ctm.log.Errorf("Container %s: docker client nil", ctm.containerName)
+		err := errors.New("docker client nil")
+		span.SetError(err)
+		return nil, err
 	}
 
 	monitStart := time.Now()
 	monitTime := time.Now().Sub(monitStart)
 
+	statsSpan := util.StartSpan(span, "docker.stats")
 	responseBody, err := ctm.client.ContainerStats(context.Background(), ctm.containerName, false)
+	statsSpan.SetError(err)
+	statsSpan.Finish()
 
 	/*
 		res, err := http.Get("http://"+ctm.DaemonURL[6:]+"/containers/"+ctm.containerID+"/stats?stream=0")
 		if err != nil {
-			logger.Errorf("Container %s: Error to get stats info\n", ctm.containerName)
-			logger.Error(err)
+			ctm.log.Errorf("Container %s: Error to get stats info\n", ctm.containerName)
+			ctm.log.Error(err)
 			return nil, err
 		}
 		responseBody := res.Body
 	*/
 
 	monitTime = time.Now().Sub(monitStart)
-	logger.Debugf("Container %s: api call used %s", ctm.containerName, monitTime)
+	ctm.log.With(util.LogFields{"duration": monitTime.Seconds()}).Debugf("Container %s: api call used %s", ctm.containerName, monitTime)
 
 	if responseBody != nil {
 		defer responseBody.Close()
@@ -123,25 +195,101 @@ func (ctm *ContainerMonitor) CollectData() (*data.ContainerStat, error) {
 	}
 
 	if err != nil {
-		logger.Errorf("Container %s: Daemon %s, Error to get stats", ctm.containerName, ctm.DaemonURL)
+		countDockerError("stats", err)
+		ctm.log.Errorf("Container %s: Daemon %s, Error to get stats", ctm.containerName, ctm.DaemonURL)
+		span.SetError(err)
 		return nil, err
 	}
 
-	dec := json.NewDecoder(responseBody)
-	var v *types.StatsJSON
-
-	if err := dec.Decode(&v); err != nil {
-		dec = json.NewDecoder(io.MultiReader(dec.Buffered(), responseBody))
-		logger.Warningf("Container %s: Error to decode stats info", ctm.containerName)
+	s, cpuTotal, err := decodeContainerStat(responseBody, ctm.containerID, ctm.containerName)
+	if err != nil {
+		ctm.log.Warningf("Container %s: Error to decode stats info", ctm.containerName)
+		span.SetError(err)
 		return nil, err
 	}
+	if viper.GetBool("docker.inspect.enabled") {
+		inspectSpan := util.StartSpan(span, "docker.inspect")
+		info, err := containerInfo(ctm.client, ctm.DaemonURL, ctm.containerName, cpuTotal, time.Now(), ctm.log)
+		inspectSpan.SetError(err)
+		inspectSpan.Finish()
+		if err != nil {
+			ctm.log.Warningf("Container %s: Error to inspect: %v\n", ctm.containerName, err)
+		} else {
+			s.ContainerInfo = *info
+			if !info.StartedAt.IsZero() && info.Status == "running" && s.TimeStamp.After(info.StartedAt) {
+				s.Uptime = s.TimeStamp.Sub(info.StartedAt).Seconds()
+			}
+		}
+	}
+
+	if du, ok := containerDisk(ctm.DaemonURL, ctm.containerID, ctm.containerName); ok {
+		s.DiskUsage = du
+	}
+	if viper.GetBool("logs.enabled") {
+		logsSpan := util.StartSpan(span, "docker.logs")
+		ls, err := collectLogs(ctm.client, ctm.DaemonURL, ctm.containerName, ctm.LogServer, time.Now(), ctm.log)
+		logsSpan.SetError(err)
+		logsSpan.Finish()
+		if err != nil {
+			ctm.log.Warningf("Container %s: Error to read the logs: %v\n", ctm.containerName, err)
+		} else if ls != nil {
+			s.LogStat = *ls
+		}
+	}
+
+	ctm.log.Debugf("Container %s: collected data = %+v", ctm.containerName, *s)
+	return s, nil
+}
+
+// dockerCPUStats is the cpu stats with fields of newer daemons
+type dockerCPUStats struct {
+	types.CPUStats
+	OnlineCPUs uint32 `json:"online_cpus,omitempty"` // API >= 1.27, no percpu usage on cgroup v2
+}
 
-	var memPercent, cpuPercent = 0.0, 0.0
-	var previousCPU, previousSystem uint64
+// dockerStats is the stats of a container from various daemon versions,
+// it extends types.StatsJSON with the fields not known by the engine-api client
+type dockerStats struct {
+	types.StatsJSON
+	PreRead     time.Time      `json:"preread"`
+	PreCPUStats dockerCPUStats `json:"precpu_stats,omitempty"`
+	CPUStats    dockerCPUStats `json:"cpu_stats,omitempty"`
+
+	// windows only
+	NumProcs     uint32 `json:"num_procs"`
+	StorageStats struct {
+		ReadSizeBytes  uint64 `json:"read_size_bytes,omitempty"`
+		WriteSizeBytes uint64 `json:"write_size_bytes,omitempty"`
+	} `json:"storage_stats,omitempty"`
+	MemoryStats struct {
+		types.MemoryStats
+		Commit            uint64 `json:"commitbytes,omitempty"`
+		PrivateWorkingSet uint64 `json:"privateworkingset,omitempty"`
+	} `json:"memory_stats,omitempty"`
+}
+
+// isWindows tells the stats are from a windows daemon, which only reports num_procs
+func (v *dockerStats) isWindows() bool {
+	return v.NumProcs > 0
+}
+
+// DecodeContainerStat will decode the raw stats json of a container from the daemon,
+// which can be of any api version, cgroup v1 or v2, or windows.
+func DecodeContainerStat(r io.Reader, containerID, containerName string) (*data.ContainerStat, error) {
+	s, _, err := decodeContainerStat(r, containerID, containerName)
+	return s, err
+}
+
+// decodeContainerStat also returns the cumulative cpu usage, which drops when the container restarts
+func decodeContainerStat(r io.Reader, containerID, containerName string) (*data.ContainerStat, uint64, error) {
+	var v dockerStats
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, 0, err
+	}
 
 	s := data.ContainerStat{
-		ContainerID:      ctm.containerID,
-		ContainerName:    ctm.containerName,
+		ContainerID:      containerID,
+		ContainerName:    containerName,
 		CPUPercentage:    0.0,
 		Memory:           0.0,
 		MemoryLimit:      0.0,
@@ -153,42 +301,152 @@ func (ctm *ContainerMonitor) CollectData() (*data.ContainerStat, error) {
 		PidsCurrent:      0,
 		TimeStamp:        v.Read,
 	}
-	if v.MemoryStats.Limit != 0 {
-		memPercent = float64(v.MemoryStats.Usage) / float64(v.MemoryStats.Limit) * 100.0
+	if v.isWindows() {
+		s.CPUPercentage = calculateCPUPercentWindows(&v)
+		s.Memory = float64(v.MemoryStats.PrivateWorkingSet)
+		s.WorkingSet = s.Memory
+		s.BlockRead = float64(v.StorageStats.ReadSizeBytes)
+		s.BlockWrite = float64(v.StorageStats.WriteSizeBytes)
+	} else {
+		s.CPUPercentage = calculateCPUPercent(v.PreCPUStats.CPUUsage.TotalUsage, v.PreCPUStats.SystemUsage, &v)
+		s.CPUDetail = calculateCPUDetail(&v)
+		s.Memory = float64(calculateMemUsageNoCache(v.MemoryStats.MemoryStats))
+		s.MemoryDetail = calculateMemoryDetail(v.MemoryStats.MemoryStats)
+		s.WorkingSet = s.Memory
+		s.MemoryLimit = float64(v.MemoryStats.Limit)
+		if v.MemoryStats.Limit != 0 {
+			s.MemoryPercentage = s.Memory / s.MemoryLimit * 100.0
+		}
+		blkRead, blkWrite := calculateBlockIO(v.BlkioStats)
+		s.BlockRead = float64(blkRead)
+		s.BlockWrite = float64(blkWrite)
+		s.BlockDevices = calculateBlockDevices(v.BlkioStats)
 	}
-
-	previousCPU = v.PreCPUStats.CPUUsage.TotalUsage
-	previousSystem = v.PreCPUStats.SystemUsage
-	cpuPercent = calculateCPUPercent(previousCPU, previousSystem, v)
-	blkRead, blkWrite := calculateBlockIO(v.BlkioStats)
-	s.CPUPercentage = cpuPercent
-	s.Memory = float64(v.MemoryStats.Usage)
-	s.MemoryLimit = float64(v.MemoryStats.Limit)
-	s.MemoryPercentage = memPercent
 	s.NetworkRx, s.NetworkTx = calculateNetwork(v.Networks)
-	s.BlockRead = float64(blkRead)
-	s.BlockWrite = float64(blkWrite)
+	s.Networks = calculateNetworkInterfaces(v.Networks)
 	s.PidsCurrent = v.PidsStats.Current
-
-	logger.Debugf("Container %s: collected data = %+v", ctm.containerName, s)
-	return &s, nil
+	return &s, v.CPUStats.CPUUsage.TotalUsage, nil
 }
 
-func calculateCPUPercent(previousCPU, previousSystem uint64, v *types.StatsJSON) float64 {
+func calculateCPUPercent(previousCPU, previousSystem uint64, v *dockerStats) float64 {
 	var (
 		cpuPercent = 0.0
 		// calculate the change for the cpu usage of the container in between readings
 		cpuDelta = float64(v.CPUStats.CPUUsage.TotalUsage) - float64(previousCPU)
 		// calculate the change for the entire system between readings
 		systemDelta = float64(v.CPUStats.SystemUsage) - float64(previousSystem)
+		// percpu usage is not reported on cgroup v2, so prefer online cpus
+		onlineCPUs = float64(v.CPUStats.OnlineCPUs)
 	)
 
+	if onlineCPUs == 0.0 {
+		onlineCPUs = float64(len(v.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if onlineCPUs == 0.0 { // at least count as percent of one cpu
+		onlineCPUs = 1.0
+	}
 	if systemDelta > 0.0 && cpuDelta > 0.0 {
-		cpuPercent = (cpuDelta / systemDelta) * float64(len(v.CPUStats.CPUUsage.PercpuUsage)) * 100.0
+		cpuPercent = (cpuDelta / systemDelta) * onlineCPUs * 100.0
 	}
 	return cpuPercent
 }
 
+// calculateCPUDetail returns the user, kernel and per cpu percentages between the two
+// readings, the same way as calculateCPUPercent, and the throttling of the cfs quota
+func calculateCPUDetail(v *dockerStats) data.CPUDetail {
+	cur, pre := v.CPUStats, v.PreCPUStats
+	throttling := cur.ThrottlingData
+	d := data.CPUDetail{
+		Periods:          float64(throttling.Periods),
+		ThrottledPeriods: float64(throttling.ThrottledPeriods),
+		ThrottledTime:    float64(throttling.ThrottledTime),
+	}
+	// throttled periods since the last reading, or since the start without one
+	periods, throttled := throttling.Periods, throttling.ThrottledPeriods
+	if p := pre.ThrottlingData; p.Periods > 0 && p.Periods <= periods && p.ThrottledPeriods <= throttled {
+		periods, throttled = periods-p.Periods, throttled-p.ThrottledPeriods
+	}
+	if periods > 0 {
+		d.ThrottleRatio = float64(throttled) / float64(periods)
+	}
+
+	systemDelta := float64(cur.SystemUsage) - float64(pre.SystemUsage)
+	if systemDelta <= 0 {
+		return d
+	}
+	onlineCPUs := float64(cur.OnlineCPUs)
+	if onlineCPUs == 0.0 {
+		onlineCPUs = float64(len(cur.CPUUsage.PercpuUsage))
+	}
+	if onlineCPUs == 0.0 {
+		onlineCPUs = 1.0
+	}
+	percent := func(now, before uint64) float64 {
+		if now <= before {
+			return 0.0
+		}
+		return float64(now-before) / systemDelta * onlineCPUs * 100.0
+	}
+	d.UserPercentage = percent(cur.CPUUsage.UsageInUsermode, pre.CPUUsage.UsageInUsermode)
+	d.KernelPercentage = percent(cur.CPUUsage.UsageInKernelmode, pre.CPUUsage.UsageInKernelmode)
+	if n := len(cur.CPUUsage.PercpuUsage); n > 0 && n == len(pre.CPUUsage.PercpuUsage) {
+		d.PerCPU = make([]float64, n)
+		for i := range d.PerCPU {
+			d.PerCPU[i] = percent(cur.CPUUsage.PercpuUsage[i], pre.CPUUsage.PercpuUsage[i])
+		}
+	}
+	return d
+}
+
+// calculateCPUPercentWindows uses the 100ns intervals between the two readings
+func calculateCPUPercentWindows(v *dockerStats) float64 {
+	possIntervals := uint64(v.Read.Sub(v.PreRead).Nanoseconds()) / 100 * uint64(v.NumProcs)
+	if v.PreRead.IsZero() || possIntervals <= 0 || v.CPUStats.CPUUsage.TotalUsage < v.PreCPUStats.CPUUsage.TotalUsage {
+		return 0.0
+	}
+	intervalsUsed := v.CPUStats.CPUUsage.TotalUsage - v.PreCPUStats.CPUUsage.TotalUsage
+	return float64(intervalsUsed) / float64(possIntervals) * 100.0
+}
+
+// calculateMemUsageNoCache returns the memory usage without the inactive page cache, same as docker stats
+func calculateMemUsageNoCache(mem types.MemoryStats) uint64 {
+	// cgroup v1
+	if v, ok := mem.Stats["total_inactive_file"]; ok && v < mem.Usage {
+		return mem.Usage - v
+	}
+	// cgroup v2
+	if v := mem.Stats["inactive_file"]; v < mem.Usage {
+		return mem.Usage - v
+	}
+	return mem.Usage
+}
+
+// calculateMemoryDetail returns the breakdown from memory.stat, the hierarchical total_*
+// values are preferred on cgroup v1, and cgroup v2 names anon, file and file_mapped
+func calculateMemoryDetail(mem types.MemoryStats) data.MemoryDetail {
+	stat := func(names ...string) float64 {
+		for _, name := range names {
+			if v, ok := mem.Stats[name]; ok {
+				return float64(v)
+			}
+		}
+		return 0
+	}
+	return data.MemoryDetail{
+		RawUsage:     float64(mem.Usage),
+		RSS:          stat("total_rss", "rss", "anon"),
+		Cache:        stat("total_cache", "cache", "file"),
+		Swap:         stat("total_swap", "swap"),
+		MappedFile:   stat("total_mapped_file", "mapped_file", "file_mapped"),
+		ActiveFile:   stat("total_active_file", "active_file"),
+		InactiveFile: stat("total_inactive_file", "inactive_file"),
+		PgFault:      stat("total_pgfault", "pgfault"),
+		PgMajFault:   stat("total_pgmajfault", "pgmajfault"),
+		MaxUsage:     float64(mem.MaxUsage),
+		Failcnt:      float64(mem.Failcnt),
+	}
+}
+
 func calculateBlockIO(blkio types.BlkioStats) (blkRead uint64, blkWrite uint64) {
 	for _, bioEntry := range blkio.IoServiceBytesRecursive {
 		switch strings.ToLower(bioEntry.Op) {
@@ -201,6 +459,65 @@ func calculateBlockIO(blkio types.BlkioStats) (blkRead uint64, blkWrite uint64)
 	return
 }
 
+// calculateBlockDevices returns the read and write counters of each device, nil for no device
+func calculateBlockDevices(blkio types.BlkioStats) map[string]data.BlockDevice {
+	var devices map[string]data.BlockDevice
+	add := func(entries []types.BlkioStatEntry, read, write func(d *data.BlockDevice, v float64)) {
+		for _, e := range entries {
+			op := strings.ToLower(e.Op)
+			if op != "read" && op != "write" {
+				continue
+			}
+			if devices == nil {
+				devices = make(map[string]data.BlockDevice)
+			}
+			key := fmt.Sprintf("%d:%d", e.Major, e.Minor)
+			d := devices[key]
+			d.Major, d.Minor = e.Major, e.Minor
+			if op == "read" {
+				read(&d, float64(e.Value))
+			} else {
+				write(&d, float64(e.Value))
+			}
+			devices[key] = d
+		}
+	}
+	add(blkio.IoServiceBytesRecursive,
+		func(d *data.BlockDevice, v float64) { d.ReadBytes += v },
+		func(d *data.BlockDevice, v float64) { d.WriteBytes += v })
+	add(blkio.IoServicedRecursive,
+		func(d *data.BlockDevice, v float64) { d.ReadOps += v },
+		func(d *data.BlockDevice, v float64) { d.WriteOps += v })
+	add(blkio.IoServiceTimeRecursive,
+		func(d *data.BlockDevice, v float64) { d.ServiceTime += v },
+		func(d *data.BlockDevice, v float64) { d.ServiceTime += v })
+	add(blkio.IoQueuedRecursive,
+		func(d *data.BlockDevice, v float64) { d.Queued += v },
+		func(d *data.BlockDevice, v float64) { d.Queued += v })
+	return devices
+}
+
+// calculateNetworkInterfaces returns the counters of each interface, nil for no interface
+func calculateNetworkInterfaces(network map[string]types.NetworkStats) map[string]data.NetworkInterface {
+	if len(network) == 0 {
+		return nil
+	}
+	result := make(map[string]data.NetworkInterface, len(network))
+	for name, v := range network {
+		result[strings.Replace(name, ".", "_", -1)] = data.NetworkInterface{
+			RxBytes:   float64(v.RxBytes),
+			RxPackets: float64(v.RxPackets),
+			RxErrors:  float64(v.RxErrors),
+			RxDropped: float64(v.RxDropped),
+			TxBytes:   float64(v.TxBytes),
+			TxPackets: float64(v.TxPackets),
+			TxErrors:  float64(v.TxErrors),
+			TxDropped: float64(v.TxDropped),
+		}
+	}
+	return result
+}
+
 func calculateNetwork(network map[string]types.NetworkStats) (float64, float64) {
 	var rx, tx float64
 
@@ -215,7 +532,7 @@ func calculateNetwork(network map[string]types.NetworkStats) (float64, float64)
 // @deprecated, just keep for testing
 func (ctm *ContainerMonitor) ListContainer() ([]types.Container, error) {
 	if ctm.client == nil {
-		logger.Warning("Container client is not inited, pls Init first")
+		ctm.log.Warning("Container client is not inited, pls Init first")
 		return nil, errors.New("Container Client Not Inited")
 	}
 	filter := filters.NewArgs()
@@ -227,7 +544,7 @@ func (ctm *ContainerMonitor) ListContainer() ([]types.Container, error) {
 	}
 
 	//for _, c := range containers {
-	//	logger.Debug(c)
+	//	ctm.log.Debug(c)
 	//}
 	return containers, nil
 }
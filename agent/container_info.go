@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+	"golang.org/x/net/context"
+)
+
+// dockerInspect is the inspect of a container with the fields not known by the engine-api client
+type dockerInspect struct {
+	types.ContainerJSON
+	State *struct {
+		types.ContainerState
+		Health *struct {
+			Status string
+		} `json:",omitempty"` // API >= 1.24
+	}
+	HostConfig *struct {
+		container.HostConfig
+		NanoCPUs int64 `json:"NanoCpus"` // API >= 1.25
+	}
+}
+
+// DecodeContainerInfo will decode the raw inspect json of a container, keeping the labels given
+func DecodeContainerInfo(r io.Reader, labels []string) (*data.ContainerInfo, error) {
+	var v dockerInspect
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, err
+	}
+	info := data.ContainerInfo{}
+	if v.ContainerJSONBase != nil {
+		info.ImageID = v.ContainerJSONBase.Image
+		info.RestartCount = v.RestartCount
+	}
+	if v.Config != nil {
+		info.Image = v.Config.Image
+		for _, name := range labels {
+			name = strings.TrimSpace(name)
+			if value, ok := v.Config.Labels[name]; ok && name != "" {
+				if info.Labels == nil {
+					info.Labels = make(map[string]string)
+				}
+				info.Labels[strings.Replace(name, ".", "_", -1)] = value
+			}
+		}
+	}
+	if v.State != nil {
+		info.Status = v.State.Status
+		info.OOMKilled = v.State.OOMKilled
+		info.ExitCode = v.State.ExitCode
+		if t, err := time.Parse(time.RFC3339Nano, v.State.StartedAt); err == nil && t.Year() > 1 {
+			info.StartedAt = t.UTC()
+		}
+		if v.State.Health != nil {
+			info.Health = v.State.Health.Status
+		}
+	}
+	if v.HostConfig != nil {
+		info.CPUShares = v.HostConfig.CPUShares
+		info.CPUQuota = v.HostConfig.CPUQuota
+		info.CPUPeriod = v.HostConfig.CPUPeriod
+		info.MemoryLimitConfig = v.HostConfig.Memory
+		info.MemoryReservation = v.HostConfig.MemoryReservation
+		switch {
+		case v.HostConfig.NanoCPUs > 0:
+			info.CPULimit = float64(v.HostConfig.NanoCPUs) / 1e9
+		case info.CPUQuota > 0:
+			period := info.CPUPeriod
+			if period <= 0 {
+				period = 100000 // default cfs period in us
+			}
+			info.CPULimit = float64(info.CPUQuota) / float64(period)
+		}
+	}
+	return &info, nil
+}
+
+// inspectEntry is a cached inspect of a container
+type inspectEntry struct {
+	info     data.ContainerInfo
+	fetched  time.Time
+	seen     time.Time
+	cpuTotal uint64 // cumulative cpu usage at the last sample, which drops when restarted
+}
+
+// inspectCache keeps the inspects by daemon and container, and the digests by image id
+var inspectCache = struct {
+	sync.Mutex
+	entries map[string]*inspectEntry
+	digests map[string]string
+	swept   time.Time
+}{entries: make(map[string]*inspectEntry), digests: make(map[string]string)}
+
+// containerInfo returns the cached inspect of the container, refreshed when it is
+// older than docker.inspect.refresh seconds, or the container is restarted
+func containerInfo(cli *client.Client, daemonURL, name string, cpuTotal uint64, now time.Time, log *util.Log) (*data.ContainerInfo, error) {
+	key := daemonURL + "/" + name
+	refresh := time.Duration(viper.GetInt("docker.inspect.refresh")) * time.Second
+
+	inspectCache.Lock()
+	e, ok := inspectCache.entries[key]
+	restarted := ok && cpuTotal < e.cpuTotal
+	if ok && !restarted && now.Sub(e.fetched) < refresh {
+		e.seen, e.cpuTotal = now, cpuTotal
+		info := e.info
+		inspectCache.Unlock()
+		return &info, nil
+	}
+	inspectCache.Unlock()
+
+	_, raw, err := cli.ContainerInspectWithRaw(context.Background(), name, false)
+	if err != nil {
+		countDockerError("inspect", err)
+		return nil, err
+	}
+	labels := strings.Split(viper.GetString("docker.inspect.labels"), ",")
+	info, err := DecodeContainerInfo(bytes.NewReader(raw), labels)
+	if err != nil {
+		return nil, err
+	}
+	info.ImageDigest = imageDigest(cli, info.ImageID, log)
+	log.Debugf("Container %s: refreshed inspect, restarted=%v\n", name, restarted)
+
+	inspectCache.Lock()
+	inspectCache.entries[key] = &inspectEntry{info: *info, fetched: now, seen: now, cpuTotal: cpuTotal}
+	// drop the containers gone for an hour, and the digests of the images none of the rest runs
+	if now.Sub(inspectCache.swept) > time.Hour {
+		images := make(map[string]bool)
+		for k, e := range inspectCache.entries {
+			if now.Sub(e.seen) > time.Hour {
+				delete(inspectCache.entries, k)
+			} else {
+				images[e.info.ImageID] = true
+			}
+		}
+		for imageID := range inspectCache.digests {
+			if !images[imageID] {
+				delete(inspectCache.digests, imageID)
+			}
+		}
+		inspectCache.swept = now
+	}
+	inspectCache.Unlock()
+	return info, nil
+}
+
+// imageDigest returns the first repo digest of the image, cached as an image id never changes,
+// until no container cached runs the image
+func imageDigest(cli *client.Client, imageID string, log *util.Log) string {
+	if imageID == "" {
+		return ""
+	}
+	inspectCache.Lock()
+	digest, ok := inspectCache.digests[imageID]
+	inspectCache.Unlock()
+	if ok {
+		return digest
+	}
+	image, _, err := cli.ImageInspectWithRaw(context.Background(), imageID, false)
+	if err != nil {
+		countDockerError("image_inspect", err)
+		log.Warningf("Cannot inspect image %s: %v\n", imageID, err)
+		return ""
+	}
+	if len(image.RepoDigests) > 0 {
+		digest = image.RepoDigests[0]
+	}
+	inspectCache.Lock()
+	inspectCache.digests[imageID] = digest
+	inspectCache.Unlock()
+	return digest
+}
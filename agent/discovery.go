@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"strings"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+	"golang.org/x/net/context"
+)
+
+// DiscoverClusters will list the running containers on the host, and group
+// them into clusters by the configured labels.
+// A container joins the cluster named by the first of input.discovery.cluster_labels it has,
+// containers with none of those labels are ignored. The id of a cluster is scoped by the host
+// as host id/label value, as a compose project of the same name may run on several hosts.
+func DiscoverClusters(cli *client.Client, host *data.Host) ([]data.Cluster, error) {
+	filter := filters.NewArgs()
+	for _, f := range util.GetStringList("input.discovery.filter") {
+		filter.Add("label", f)
+	}
+	options := types.ContainerListOptions{All: false, Filter: filter}
+	containers, err := cli.ContainerList(context.Background(), options)
+	if err != nil {
+		countDockerError("container_list", err)
+		logger.Errorf("Host %s: Cannot list containers for discovery\n", host.Name)
+		return nil, err
+	}
+
+	clusterLabels := util.GetStringList("input.discovery.cluster_labels")
+	nameLabel := viper.GetString("input.discovery.name_label")
+	userLabel := viper.GetString("input.discovery.user_label")
+
+	clusters := []data.Cluster{}
+	index := make(map[string]int) // cluster id -> position in clusters
+	for _, ct := range containers {
+		value := ""
+		for _, l := range clusterLabels {
+			if v := ct.Labels[l]; v != "" {
+				value = v
+				break
+			}
+		}
+		if value == "" || len(ct.Names) <= 0 {
+			continue
+		}
+		clusterID := host.ID + "/" + value
+		i, ok := index[clusterID]
+		if !ok {
+			clusters = append(clusters, data.Cluster{
+				ID:         clusterID,
+				Name:       value,
+				HostID:     host.ID,
+				DaemonURL:  host.DaemonURL,
+				Containers: make(map[string]string),
+			})
+			i = len(clusters) - 1
+			index[clusterID] = i
+		}
+		cluster := &clusters[i]
+		if v := ct.Labels[nameLabel]; nameLabel != "" && v != "" {
+			cluster.Name = v
+		}
+		if v := ct.Labels[userLabel]; userLabel != "" && v != "" {
+			cluster.UserID = v
+		}
+		cluster.Containers[strings.TrimPrefix(ct.Names[0], "/")] = ct.ID
+		cluster.Size = uint64(len(cluster.Containers))
+	}
+	logger.Debugf("Host %s: discovered %d clusters from %d containers\n", host.Name, len(clusters), len(containers))
+	return clusters, nil
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+)
+
+// dockerDiskUsage is the response of the docker disk usage api, the engine-api client does not support it
+type dockerDiskUsage struct {
+	LayersSize int64
+	Containers []struct {
+		ID         string `json:"Id"`
+		Names      []string
+		SizeRw     int64
+		SizeRootFs int64
+		Mounts     []struct {
+			Type string
+			Name string
+		}
+	}
+	Volumes []struct {
+		Name      string
+		UsageData *struct {
+			Size int64 // -1 when not calculated
+		}
+	}
+	BuildCache []struct {
+		Size   int64
+		Shared bool
+	} // API >= 1.31
+}
+
+// DecodeDiskUsage will decode the docker disk usage of a daemon, into the usage of the host
+// and the usages of the containers by their ids and names
+func DecodeDiskUsage(r io.Reader) (*data.HostDisk, map[string]data.DiskUsage, error) {
+	var v dockerDiskUsage
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, nil, err
+	}
+	hd, containers := v.usages()
+	return hd, containers, nil
+}
+
+// usages sums the usage of the host, and finds the usages of the containers
+func (v *dockerDiskUsage) usages() (*data.HostDisk, map[string]data.DiskUsage) {
+	hd := data.HostDisk{DiskImages: float64(v.LayersSize)}
+	volumes := make(map[string]float64)
+	for _, vol := range v.Volumes {
+		if vol.UsageData != nil && vol.UsageData.Size >= 0 {
+			volumes[vol.Name] = float64(vol.UsageData.Size)
+			hd.DiskVolumes += float64(vol.UsageData.Size)
+		}
+	}
+	for _, b := range v.BuildCache {
+		if !b.Shared {
+			hd.DiskBuildCache += float64(b.Size)
+		}
+	}
+
+	containers := make(map[string]data.DiskUsage)
+	for _, c := range v.Containers {
+		du := data.DiskUsage{SizeRw: float64(c.SizeRw), SizeRootFs: float64(c.SizeRootFs)}
+		for _, m := range c.Mounts {
+			size, ok := volumes[m.Name]
+			if m.Type != "volume" || !ok {
+				continue
+			}
+			if du.Volumes == nil {
+				du.Volumes = make(map[string]float64)
+			}
+			du.Volumes[strings.Replace(m.Name, ".", "_", -1)] = size
+			du.VolumesSize += size
+		}
+		hd.DiskContainers += du.SizeRw
+		containers[c.ID] = du
+		for _, name := range c.Names {
+			containers[strings.TrimPrefix(name, "/")] = du
+		}
+	}
+	hd.DiskUsage = hd.DiskImages + hd.DiskContainers + hd.DiskVolumes + hd.DiskBuildCache
+	return &hd, containers
+}
+
+// diskEntry is the last disk usage of a daemon
+type diskEntry struct {
+	host       data.HostDisk
+	containers map[string]data.DiskUsage
+	fetched    time.Time
+}
+
+// diskCache keeps the disk usages by daemon, the api is slow as the daemon walks the layers
+var diskCache = struct {
+	sync.Mutex
+	entries map[string]*diskEntry
+}{entries: make(map[string]*diskEntry)}
+
+// collectDisk refreshes the disk usage of the daemon every disk.interval seconds,
+// and returns the last one, or nil when disabled or never collected
+func collectDisk(httpClient *http.Client, daemonURL string, capacityGB float64, now time.Time, log *util.Log) *data.HostDisk {
+	if !viper.GetBool("disk.enabled") || httpClient == nil {
+		return nil
+	}
+	interval := time.Duration(viper.GetInt("disk.interval")) * time.Second
+	diskCache.Lock()
+	e, ok := diskCache.entries[daemonURL]
+	diskCache.Unlock()
+	if ok && now.Sub(e.fetched) < interval {
+		hd := e.host
+		return &hd
+	}
+
+	var v dockerDiskUsage
+	if err := dockerAPIGet(httpClient, daemonURL, "/system/df", nil, &v); err != nil {
+		countDockerError("system_df", err)
+		log.Warningf("Daemon %s: Error to get the disk usage: %v\n", daemonURL, err)
+		if ok {
+			hd := e.host
+			return &hd
+		}
+		return nil
+	}
+	hd, containers := v.usages()
+	hd.DiskCapacity = capacityGB * 1e9
+	if ok {
+		hd.SetGrowth(e.host.DiskUsage, now.Sub(e.fetched).Hours())
+	}
+	log.Debugf("Daemon %s: disk usage %.0f bytes, growing %.0f bytes per hour\n", daemonURL, hd.DiskUsage, hd.DiskGrowthRate)
+
+	diskCache.Lock()
+	diskCache.entries[daemonURL] = &diskEntry{host: *hd, containers: containers, fetched: now}
+	diskCache.Unlock()
+	return hd
+}
+
+// containerDisk returns the last disk usage of the container by its id or name
+func containerDisk(daemonURL, containerID, name string) (data.DiskUsage, bool) {
+	diskCache.Lock()
+	defer diskCache.Unlock()
+	e, ok := diskCache.entries[daemonURL]
+	if !ok {
+		return data.DiskUsage{}, false
+	}
+	if du, ok := e.containers[containerID]; ok {
+		return du, true
+	}
+	du, ok := e.containers[name]
+	return du, ok
+}
@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+	"golang.org/x/net/context"
+)
+
+// dockerMaxAPIVersion is the newest api version used, the stats of newer versions are still parsed
+const dockerMaxAPIVersion = "1.41"
+
+// TLS modes of the daemon connection
+const (
+	tlsModeNone     = "none"     // plain http
+	tlsModeVerify   = "verify"   // verify the daemon certificate with the CA
+	tlsModeInsecure = "insecure" // present client certificate, but skip verifying the daemon
+)
+
+// newDockerClient creates the client to the docker daemon of the host,
+// with the TLS setting of the host (or the global docker.tls config),
+// and opens a ssh tunnel for the ssh:// daemon url.
+// It also returns the http client under it and the url actually dialed.
+func newDockerClient(host *data.Host) (*client.Client, *http.Client, string, error) {
+	daemonURL := host.DaemonURL
+	if u, err := url.Parse(daemonURL); err == nil && u.Scheme == "ssh" {
+		if daemonURL, err = sshTunnels.open(u); err != nil {
+			logger.Errorf("Cannot open ssh tunnel to docker host=%s\n", host.DaemonURL)
+			return nil, nil, "", err
+		}
+	}
+
+	transport := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		MaxIdleConnsPerHost: 64,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+	tlsOptions, err := hostTLSOptions(host)
+	if err != nil {
+		logger.Errorf("Invalid TLS setting for docker host=%s\n", host.DaemonURL)
+		return nil, nil, "", err
+	}
+	if tlsOptions != nil {
+		// a new tls config for each client, as the server name is set per host
+		if transport.TLSClientConfig, err = tlsconfig.Client(*tlsOptions); err != nil {
+			logger.Errorf("Cannot load TLS config for docker host=%s\n", host.DaemonURL)
+			return nil, nil, "", err
+		}
+	}
+	httpClient := &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(30) * time.Second,
+	}
+
+	// an unversioned client to ask the daemon version first
+	cli, err := client.NewClient(daemonURL, "", httpClient, dockerHeaders)
+	if err != nil {
+		logger.Errorf("Cannot init connection to docker host=%s\n", host.DaemonURL)
+		return nil, nil, "", err
+	}
+	return negotiateClient(cli, daemonURL, httpClient, host.DaemonURL), httpClient, daemonURL, nil
+}
+
+// dockerHeaders are sent with each request to the daemons
+var dockerHeaders = map[string]string{"User-Agent": "engine-api-cli-1.0"}
+
+// negotiateClient returns the client with the api version of the daemon.
+// The unversioned client is returned when the daemon does not answer,
+// it uses the current api of the daemon, and should be negotiated again later.
+func negotiateClient(cli *client.Client, daemonURL string, httpClient *http.Client, hostURL string) *client.Client {
+	version, err := negotiateAPIVersion(cli)
+	if err != nil {
+		logger.Warningf("Cannot get api version of docker host=%s, negotiate it again later: %v\n", hostURL, err)
+		return cli
+	}
+	versioned, err := client.NewClient(daemonURL, version, httpClient, dockerHeaders)
+	if err != nil {
+		logger.Errorf("Cannot init connection to docker host=%s\n", hostURL)
+		return cli
+	}
+	logger.Debugf("Use api version %s with docker host=%s\n", version, hostURL)
+	return versioned
+}
+
+// negotiateAPIVersion returns the api version to talk with the daemon,
+// that is the daemon version, but no newer than dockerMaxAPIVersion.
+func negotiateAPIVersion(cli *client.Client) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	v, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	if v.APIVersion == "" || compareAPIVersion(v.APIVersion, dockerMaxAPIVersion) > 0 {
+		return dockerMaxAPIVersion, nil
+	}
+	return v.APIVersion, nil
+}
+
+// compareAPIVersion compares two api versions like 1.22, returns -1, 0 or 1
+func compareAPIVersion(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// hostTLSOptions returns the TLS options of the host, nil means no TLS.
+// The fields in the host document take precedence over docker.tls config.
+func hostTLSOptions(host *data.Host) (*tlsconfig.Options, error) {
+	pick := func(hostValue, key string) string {
+		if hostValue != "" {
+			return hostValue
+		}
+		return viper.GetString(key)
+	}
+	mode := pick(host.TLSMode, "docker.tls.mode")
+	options := tlsconfig.Options{
+		CAFile:   pick(host.TLSCA, "docker.tls.ca_file"),
+		CertFile: pick(host.TLSCert, "docker.tls.cert_file"),
+		KeyFile:  pick(host.TLSKey, "docker.tls.key_file"),
+	}
+	if mode == "" { // enable TLS when any cert is given
+		mode = tlsModeNone
+		if options.CAFile != "" || options.CertFile != "" || options.KeyFile != "" {
+			mode = tlsModeVerify
+		}
+	}
+
+	switch mode {
+	case tlsModeNone:
+		return nil, nil
+	case tlsModeVerify:
+		if options.CAFile == "" {
+			return nil, fmt.Errorf("TLS mode verify of host %s needs a CA file", host.Name)
+		}
+		if err := checkCertFile(options.CAFile, host.Name); err != nil {
+			return nil, err
+		}
+	case tlsModeInsecure:
+		options.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("Unknown TLS mode %s of host %s, should be none, verify or insecure", mode, host.Name)
+	}
+
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, fmt.Errorf("TLS cert and key of host %s should be given together", host.Name)
+	}
+	if options.CertFile != "" {
+		if err := checkCertFile(options.CertFile, host.Name); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(options.KeyFile); err != nil {
+			return nil, fmt.Errorf("TLS key file %s of host %s is not readable: %v", options.KeyFile, host.Name, err)
+		}
+	}
+	return &options, nil
+}
+
+// checkCertFile makes sure the PEM certificates in the file exist and are valid for now
+func checkCertFile(path, hostName string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("TLS cert file %s of host %s is not readable: %v", path, hostName, err)
+	}
+	now, found := time.Now(), false
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("TLS cert file %s of host %s is invalid: %v", path, hostName, err)
+		}
+		found = true
+		if now.After(cert.NotAfter) {
+			return fmt.Errorf("TLS cert %s in %s of host %s expired at %s", cert.Subject.CommonName, path, hostName, cert.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(cert.NotBefore) {
+			return fmt.Errorf("TLS cert %s in %s of host %s is not valid until %s", cert.Subject.CommonName, path, hostName, cert.NotBefore.Format(time.RFC3339))
+		}
+	}
+	if !found {
+		return fmt.Errorf("No certificate found in TLS cert file %s of host %s", path, hostName)
+	}
+	return nil
+}
+
+// sshTunnel forwards a local tcp port to the remote docker socket with the ssh command
+type sshTunnel struct {
+	localURL string
+	cmd      *exec.Cmd
+	done     chan struct{} // closed when the ssh process exits
+}
+
+// sshTunnelPool keeps one tunnel for each ssh daemon url
+type sshTunnelPool struct {
+	mutex   sync.Mutex
+	tunnels map[string]*sshTunnel
+}
+
+var sshTunnels = &sshTunnelPool{tunnels: make(map[string]*sshTunnel)}
+
+// open returns the local url of the tunnel to the ssh://[user@]host[:port][/socket/path] daemon,
+// a new tunnel is started when there is none or the old one is gone.
+func (p *sshTunnelPool) open(u *url.URL) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if t, ok := p.tunnels[u.String()]; ok {
+		select {
+		case <-t.done:
+			logger.Warningf("SSH tunnel to %s exited, reopen it\n", u.Host)
+		default:
+			return t.localURL, nil
+		}
+	}
+
+	// take a free local port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	localAddr := l.Addr().String()
+	l.Close()
+
+	socket := u.Path
+	if socket == "" || socket == "/" {
+		socket = "/var/run/docker.sock"
+	}
+	target, port := u.Host, ""
+	if h, p, err := net.SplitHostPort(u.Host); err == nil {
+		target, port = h, p
+	}
+	if u.User != nil && u.User.Username() != "" {
+		target = u.User.Username() + "@" + target
+	}
+	args := []string{"-N", "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes", "-L", localAddr + ":" + socket}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if identity := viper.GetString("docker.ssh.identity_file"); identity != "" {
+		args = append(args, "-i", identity)
+	}
+	args = append(args, target)
+
+	t := &sshTunnel{
+		localURL: "tcp://" + localAddr,
+		cmd:      exec.Command("ssh", args...),
+		done:     make(chan struct{}),
+	}
+	if err := t.cmd.Start(); err != nil {
+		return "", fmt.Errorf("Cannot start ssh to %s: %v", u.Host, err)
+	}
+	go func() {
+		t.cmd.Wait()
+		close(t.done)
+	}()
+
+	// wait until the local end is ready
+	timeout := time.Duration(viper.GetInt("docker.ssh.timeout")) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	for deadline := time.Now().Add(timeout); ; time.Sleep(100 * time.Millisecond) {
+		select {
+		case <-t.done:
+			return "", errors.New("ssh to " + u.Host + " exited, check the host is reachable with key auth")
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", localAddr, time.Second); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.cmd.Process.Kill()
+			return "", errors.New("ssh tunnel to " + u.Host + " is not ready in " + strconv.Itoa(int(timeout.Seconds())) + " seconds")
+		}
+	}
+	p.tunnels[u.String()] = t
+	logger.Infof("Opened ssh tunnel %s to %s:%s\n", t.localURL, u.Host, socket)
+	return t.localURL, nil
+}
+
+// closeAll stops the ssh process of each tunnel and waits for it to exit
+func (p *sshTunnelPool) closeAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, t := range p.tunnels {
+		t.cmd.Process.Kill()
+		<-t.done
+		delete(p.tunnels, key)
+		logger.Infof("Closed ssh tunnel %s\n", t.localURL)
+	}
+}
+
+// CloseSSHTunnels stops the ssh tunnels to the daemons, it should be called before exit
+func CloseSSHTunnels() {
+	sshTunnels.closeAll()
+}
+
+// DockerErrorType classifies an error of the docker api for the self metrics
+func DockerErrorType(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || err == context.DeadlineExceeded || strings.Contains(msg, "timeout") {
+		return "timeout"
+	}
+	switch {
+	case client.IsErrContainerNotFound(err), client.IsErrImageNotFound(err), strings.Contains(msg, "No such"):
+		return "not_found"
+	case client.IsErrUnauthorized(err):
+		return "unauthorized"
+	case err == client.ErrConnectionFailed, strings.Contains(msg, "connection refused"), strings.Contains(msg, "no route to host"):
+		return "connection"
+	case strings.Contains(msg, "Error response from daemon"), strings.Contains(msg, "returns 5"):
+		return "daemon"
+	}
+	return "other"
+}
+
+// countDockerError records the error of the docker api in the self metrics
+func countDockerError(api string, err error) {
+	util.AddCounter(util.MetricName("docker_api_errors_total", "api", api, "type", DockerErrorType(err)), 1)
+}
@@ -1,11 +1,20 @@
 package agent
 
 import (
-	"github.com/op/go-logging"
 	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
 )
 
-var logger = logging.MustGetLogger("cmonit")
+// logger adds the round, and the context given by With, to the records of the agent
+var logger = util.NewLog("cmonit")
+
+// contextLog returns the base log, or the agent log when nil, with more fields
+func contextLog(base *util.Log, fields util.LogFields) *util.Log {
+	if base == nil {
+		base = logger
+	}
+	return base.With(fields)
+}
 
 // Monitor is used to collect data
 type Monitor interface {
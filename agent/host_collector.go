@@ -4,7 +4,6 @@ import (
 	"time"
 
 	"errors"
-	"net"
 	"net/http"
 
 	"strings"
@@ -12,78 +11,224 @@ import (
 	"github.com/docker/engine-api/client"
 	"github.com/spf13/viper"
 	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+	"golang.org/x/net/context"
 )
 
 // HostMonitor is used to collect data from a whole docker host.
 // It may include many clusters
 type HostMonitor struct {
 	host         *data.Host
-	inputDB      *data.DB
+	inventory    data.Inventory
 	outputDB     *data.DB //output db
 	outputCol    string   //output collection
 	dockerClient *client.Client
+	httpClient   *http.Client
+	daemonURL    string
+	kubelet      *KubeletMonitor // only for kubernetes nodes
+	swarm        *SwarmMonitor   // only for swarm managers
+	ncpu         int             // from the daemon info, 0 when unknown
+	memTotal     float64
+	clustersUsed uint64         // clusters found on the host in the round
+	collected    int            // clusters collected in the round
+	capacity     data.FleetHost // of the last round
+	log          *util.Log      // with the host name
+	span         *util.Span     // of the current collection
 }
 
+// errNoCluster means there is no cluster to monitor on the host
+var errNoCluster = errors.New("No cluster in host")
+
 //Init will do initialization
-func (hm *HostMonitor) Init(host *data.Host, input, output *data.DB, colName string) error {
-	logger.Debugf("Init host=%s", host.Name)
+func (hm *HostMonitor) Init(host *data.Host, inventory data.Inventory, output *data.DB, colName string) error {
+	hm.log = logger.With(util.LogFields{"host": host.Name})
+	hm.log.Debugf("Init host=%s", host.Name)
 	hm.host = host
-	hm.inputDB = input
+	hm.inventory = inventory
 	hm.outputDB = output
 	hm.outputCol = colName
+	// inited again when the settings of the host changed
+	if hm.httpClient != nil {
+		if transport, ok := hm.httpClient.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+	hm.dockerClient, hm.httpClient, hm.kubelet, hm.swarm = nil, nil, nil, nil
+	hm.ncpu, hm.memTotal = 0, 0
+
+	if host.Type == data.HostTypeKubernetes {
+		kube, ok := inventory.(*data.KubeInventory)
+		if !ok {
+			return errors.New("Kubernetes host is only supported with kubernetes input")
+		}
+		hm.kubelet = new(KubeletMonitor)
+		if err := hm.kubelet.Init(kube.Client, host.Name); err != nil {
+			return err
+		}
+		hm.log.Infof("Inited kubelet monitor with node=%s", host.Name)
+		return nil
+	}
 
-	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
-
-	httpClient := http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			MaxIdleConnsPerHost: 64,
-			//DisableKeepAlives:   true, // use this to prevent many connections opened
-			TLSHandshakeTimeout: 5 * time.Second,
-		},
-		Timeout: time.Duration(30) * time.Second,
-	}
-	cli, err := client.NewClient(host.DaemonURL, "v1.22", &httpClient, defaultHeaders)
+	cli, httpClient, daemonURL, err := newDockerClient(host)
 	if err != nil {
-		logger.Errorf("Cannot init connection to docker host=%s\n", host.DaemonURL)
-		logger.Error(err)
+		hm.log.Errorf("Cannot init connection to docker host=%s\n", host.DaemonURL)
+		hm.log.Error(err)
 		return err
 	}
 
 	hm.dockerClient = cli
+	hm.httpClient = httpClient
+	hm.daemonURL = daemonURL
+	hm.readDaemonInfo()
 
-	logger.Infof("Inited connection with host=%s", host.DaemonURL)
+	if host.Type == data.HostTypeSwarm {
+		hm.swarm = new(SwarmMonitor)
+		if err := hm.swarm.Init(host, daemonURL, inventory, hm.httpClient); err != nil {
+			return err
+		}
+	}
+
+	hm.log.Infof("Inited connection with host=%s", host.DaemonURL)
 	return nil
 }
 
-// CollectData will collect information for each cluster at the host
+// connectionChanged tells if the host is connected with other settings than the last time
+func (hm *HostMonitor) connectionChanged(host *data.Host) bool {
+	old := hm.host
+	return old != nil && (old.DaemonURL != host.DaemonURL || old.Type != host.Type || old.TLSMode != host.TLSMode ||
+		old.TLSCA != host.TLSCA || old.TLSCert != host.TLSCert || old.TLSKey != host.TLSKey)
+}
+
+// readDaemonInfo gets the cpu and memory capacity of the daemon
+func (hm *HostMonitor) readDaemonInfo() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if info, err := hm.dockerClient.Info(ctx); err != nil {
+		countDockerError("info", err)
+		hm.log.Warningf("Host %s: Cannot get daemon info, the cpu and memory capacity is unknown\n", hm.host.Name)
+	} else {
+		hm.ncpu, hm.memTotal = info.NCPU, float64(info.MemTotal)
+	}
+}
+
+// reconnect negotiates the api version and reads the daemon info again,
+// when the daemon did not answer them before
+func (hm *HostMonitor) reconnect() {
+	if hm.dockerClient == nil {
+		return
+	}
+	if hm.dockerClient.ClientVersion() == "" {
+		hm.dockerClient = negotiateClient(hm.dockerClient, hm.daemonURL, hm.httpClient, hm.host.DaemonURL)
+	}
+	if hm.ncpu == 0 {
+		hm.readDaemonInfo()
+	}
+}
+
+// CollectData will collect information for each cluster at the host, in a span of the round
 func (hm *HostMonitor) CollectData() (*data.HostStat, error) {
+	hm.span = util.StartSpan(util.RoundSpan(), "host.collect", "host", hm.host.Name)
+	hs, err := hm.collectData()
+	if err != errNoCluster {
+		hm.span.SetError(err)
+	}
+	hm.span.Finish()
+	return hs, err
+}
+
+// collectData will collect information for each cluster at the host
+func (hm *HostMonitor) collectData() (*data.HostStat, error) {
 	//var hasErr bool = false
 	var clusters *[]data.Cluster
 	var err error
-	if clusters, err = hm.inputDB.GetClusters(map[string]interface{}{"host_id": hm.host.ID}); err != nil {
-		logger.Errorf("Host %s: Cannot get clusters: %+v\n", hm.host.Name, err.Error())
+	hm.reconnect()
+	if clusters, err = hm.inventory.GetClusters(map[string]interface{}{"host_id": hm.host.ID}); err != nil {
+		hm.log.Errorf("Host %s: Cannot get clusters: %+v\n", hm.host.Name, err.Error())
 		return nil, err
 	}
+	if hm.swarm != nil {
+		if swarmClusters, err := hm.swarm.Clusters(); err != nil {
+			hm.log.Warningf("Host %s: Fail to get swarm clusters\n", hm.host.Name)
+			hm.log.Warning(err)
+		} else {
+			clusters = mergeClusters(clusters, swarmClusters)
+		}
+	}
+	if viper.GetBool("input.discovery.enabled") && hm.dockerClient != nil {
+		if discovered, err := DiscoverClusters(hm.dockerClient, hm.host); err != nil {
+			hm.log.Warningf("Host %s: Fail to discover clusters\n", hm.host.Name)
+			hm.log.Warning(err)
+		} else {
+			clusters = mergeClusters(clusters, discovered)
+		}
+	}
 	lenClusters := len(*clusters)
+	hm.clustersUsed = uint64(lenClusters)
+	hm.span.SetAttr("clusters", lenClusters)
 	// Use go routine to collect data and send result pointer to channel
-	logger.Debugf("Host %s: has %d clusters\n", hm.host.Name, lenClusters)
+	hm.log.Debugf("Host %s: has %d clusters\n", hm.host.Name, lenClusters)
 	if lenClusters <= 0 {
-		logger.Debugf("Host %s: only %d clusters, just return\n", hm.host.Name, lenClusters)
-		return nil, errors.New("No cluster in host")
+		hm.log.Debugf("Host %s: only %d clusters, just return\n", hm.host.Name, lenClusters)
+		return nil, errNoCluster
+	}
+	// the disk usage is ready before the containers look up theirs
+	diskSpan := util.StartSpan(hm.span, "host.disk")
+	disk := collectDisk(hm.httpClient, hm.daemonURL, hm.host.DiskCapacity, time.Now(), hm.log)
+	diskSpan.Finish()
+	var csList []*data.ClusterStat
+	if hm.kubelet != nil {
+		csList = hm.collectKubelet(clusters)
+	} else {
+		csList = hm.collectClusters(clusters)
+	}
+	hm.collected = len(csList)
+
+	if len(csList) != lenClusters {
+		hm.log.Errorf("Host %s: only collected %d/%d cluster\n", hm.host.Name, len(csList), lenClusters)
+		return nil, errors.New("Not enough cluster data is collected")
+	}
+
+	hs := data.HostStat{
+		HostID:           hm.host.ID,
+		HostName:         hm.host.Name,
+		CPUPercentage:    0.0,
+		Memory:           0.0,
+		MemoryLimit:      0.0,
+		MemoryPercentage: 0.0,
+		NetworkRx:        0.0,
+		NetworkTx:        0.0,
+		BlockRead:        0.0,
+		BlockWrite:       0.0,
+		PidsCurrent:      0,
+		AvgLatency:       0.0,
+		MaxLatency:       0.0,
+		MinLatency:       0.0,
+		TimeStamp:        time.Now().UTC(),
+	}
+	(&hs).CalculateStat(csList)
+	if disk != nil {
+		hs.HostDisk = *disk
+	}
+	hm.log.Debugf("Host %s: collected result = %+v\n", hm.host.Name, hs)
+	return &hs, nil
+}
+
+// collectClusters will monit each cluster with the docker daemon of the host
+func (hm *HostMonitor) collectClusters(clusters *[]data.Cluster) []*data.ClusterStat {
+	lenClusters := len(*clusters)
+	var nodeClients map[string]*client.Client
+	if hm.swarm != nil {
+		nodeClients = hm.swarm.NodeClients(*clusters)
 	}
 	c := make(chan *data.ClusterStat, lenClusters)
 	defer close(c)
 	for _, cluster := range *clusters {
-		logger.Debugf("Host %s: start monitor cluster %s\n", hm.host.Name, cluster.ID)
+		hm.log.Debugf("Host %s: start monitor cluster %s\n", hm.host.Name, cluster.ID)
 		if strings.HasPrefix(cluster.UserID, "__") {
-			logger.Debugf("Host %s: cluster %s is in unstable status, ignore\n", hm.host.Name, cluster.ID)
+			hm.log.Debugf("Host %s: cluster %s is in unstable status, ignore\n", hm.host.Name, cluster.ID)
 			c <- nil
 		} else {
-			clm := new(ClusterMonitor)
+			clm := &ClusterMonitor{NodeClients: nodeClients, LogServer: hm.logServer(), Log: hm.log, Span: hm.span}
 			go clm.Monit(cluster, hm.outputDB, viper.GetString("output.mongo.col_cluster"), hm.dockerClient, c)
 		}
 	}
@@ -94,66 +239,143 @@ func (hm *HostMonitor) CollectData() (*data.HostStat, error) {
 	for s := range c {
 		if s != nil { //collect some data
 			csList = append(csList, s)
-			logger.Debugf("Host %s/Cluster %s [%d/%d]: monit done\n", hm.host.Name, s.ClusterID, number, lenClusters)
+			hm.log.Debugf("Host %s/Cluster %s [%d/%d]: monit done\n", hm.host.Name, s.ClusterID, number, lenClusters)
 		}
 		number++
-		logger.Debugf("Host %s/Cluster [%d/%d]: monit done\n", hm.host.Name, number, lenClusters)
+		hm.log.Debugf("Host %s/Cluster [%d/%d]: monit done\n", hm.host.Name, number, lenClusters)
 		if number >= lenClusters {
 			break
 		}
 	}
 
-	if len(csList) != lenClusters {
-		logger.Errorf("Host %s: only collected %d/%d cluster\n", hm.host.Name, len(csList), lenClusters)
-		return nil, errors.New("Not enough cluster data is collected")
+	return csList
+}
+
+// logServer returns the syslog server of the host to forward the matched log lines
+func (hm *HostMonitor) logServer() string {
+	if !viper.GetBool("logs.forward") || hm.host.LogType != "syslog" {
+		return ""
 	}
+	return hm.host.LogServer
+}
 
-	hs := data.HostStat{
-		HostID:           hm.host.ID,
-		HostName:         hm.host.Name,
-		CPUPercentage:    0.0,
-		Memory:           0.0,
-		MemoryLimit:      0.0,
-		MemoryPercentage: 0.0,
-		NetworkRx:        0.0,
-		NetworkTx:        0.0,
-		BlockRead:        0.0,
-		BlockWrite:       0.0,
-		PidsCurrent:      0,
-		AvgLatency:       0.0,
-		MaxLatency:       0.0,
-		MinLatency:       0.0,
-		TimeStamp:        time.Now().UTC(),
+// collectKubelet will get the cluster stats from the kubelet summary of the node
+func (hm *HostMonitor) collectKubelet(clusters *[]data.Cluster) []*data.ClusterStat {
+	csList := []*data.ClusterStat{}
+	span := util.StartSpan(hm.span, "kubelet.summary")
+	stats, err := hm.kubelet.CollectData()
+	if err == nil {
+		// the containers of the clusters on the other nodes
+		err = hm.kubelet.CollectNodes(*clusters, stats)
 	}
-	(&hs).CalculateStat(csList)
-	logger.Debugf("Host %s: collected result = %+v\n", hm.host.Name, hs)
-	return &hs, nil
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		hm.log.Error(err)
+		return csList
+	}
+	hm.kubelet.Log, hm.kubelet.Span = hm.log, hm.span
+	for _, cluster := range *clusters {
+		if cs, err := hm.kubelet.ClusterData(cluster, stats, hm.outputDB); err != nil {
+			hm.log.Error(err)
+		} else {
+			csList = append(csList, cs)
+		}
+	}
+	return csList
+}
+
+// mergeClusters will add the clusters found from the host,
+// the ones already known by the inventory, by id or by a container, are kept as they are
+func mergeClusters(clusters *[]data.Cluster, found []data.Cluster) *[]data.Cluster {
+	known, containers := make(map[string]bool), make(map[string]bool)
+	for _, cluster := range *clusters {
+		known[cluster.ID] = true
+		for name, id := range cluster.Containers {
+			containers[name], containers[id] = true, true
+		}
+	}
+	merged := *clusters
+	for _, cluster := range found {
+		if known[cluster.ID] {
+			continue
+		}
+		dup := false
+		for name, id := range cluster.Containers {
+			if containers[name] || containers[id] {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			merged = append(merged, cluster)
+		}
+	}
+	return &merged
+}
+
+// setCapacity calculates the capacity usage of the round, hs is nil when no cluster or not all collected
+func (hm *HostMonitor) setCapacity(host *data.Host, hs *data.HostStat) data.HostCapacity {
+	c := data.CalculateCapacity(host, hs, hm.clustersUsed, hm.ncpu, hm.memTotal,
+		viper.GetFloat64("capacity.min_cpu_headroom"), viper.GetFloat64("capacity.min_memory_headroom"))
+	hm.capacity = data.FleetHost{HostID: host.ID, HostName: host.Name, Status: host.Status, HostCapacity: c}
+	return c
+}
+
+// Capacity returns the capacity usage of the host in the last round
+func (hm *HostMonitor) Capacity() data.FleetHost {
+	return hm.capacity
 }
 
 // Monit will start the monit task on the host
-func (hm *HostMonitor) Monit(host data.Host, inputDB, outputDB *data.DB, c chan string) {
+func (hm *HostMonitor) Monit(host data.Host, inventory data.Inventory, outputDB *data.DB, c chan string) {
+	// the host may be changed since the last round, e.g., in a reloaded inventory file
+	reconnect := hm.connectionChanged(&host)
+	hm.host = &host
+	// counted again from the clusters found in the round
+	hm.clustersUsed, hm.collected = uint64(len(host.Clusters)), 0
 	if host.Status != "active" {
-		logger.Infof("Host %s: Inactive, just return", host.Name)
+		hm.log.Infof("Host %s: Inactive, just return", host.Name)
+		hm.setCapacity(&host, nil)
 		c <- host.Name
 		return
 	}
+	if reconnect {
+		hm.log.Infof("Host %s: Connection settings changed, init again", host.Name)
+		if err := hm.Init(&host, inventory, outputDB, hm.outputCol); err != nil {
+			hm.log.Warningf("<<Fail to init connection to %s", host.Name)
+			hm.capacity = data.FleetHost{HostID: host.ID, HostName: host.Name, Status: "unreachable"}
+			c <- host.Name
+			return
+		}
+	}
 
-	logger.Infof(">>Host %s: Starting monit with %d clusters...", host.Name, len(host.Clusters))
+	hm.log.Infof(">>Host %s: Starting monit with %d clusters...", host.Name, len(host.Clusters))
 	/*
-		if err := hm.Init(&host, inputDB, outputDB, viper.GetString("output.mongo.col_host")); err != nil {
-			logger.Warningf("<<Fail to init connection to %s", host.Name)
+		if err := hm.Init(&host, inventory, outputDB, viper.GetString("output.mongo.col_host")); err != nil {
+			hm.log.Warningf("<<Fail to init connection to %s", host.Name)
 			c <- host.Name
 			return
 		}*/
 	monitStart := time.Now()
 	monitTime := time.Now().Sub(monitStart)
-	if hs, err := hm.CollectData(); err != nil {
-		logger.Warningf("<<Host %s: Fail to collect data!\n", host.Name)
-		logger.Error(err)
+	hs, err := hm.CollectData()
+	util.Observe(util.MetricName("host_collect_seconds", "host", host.Name), time.Since(monitStart).Seconds())
+	if err != nil {
+		if err == errNoCluster || hm.collected > 0 { // the host answered, only some clusters failed
+			hm.setCapacity(&host, nil)
+		} else {
+			hm.capacity = data.FleetHost{HostID: host.ID, HostName: host.Name, Status: "unreachable"}
+		}
+		hm.log.Warningf("<<Host %s: Fail to collect data!\n", host.Name)
+		hm.log.Error(err)
 	} else {
+		hs.HostCapacity = hm.setCapacity(&host, hs)
 		if outputDB != nil && outputDB.URL != "" && outputDB.Name != "" && hm.outputCol != "" {
-			outputDB.SaveData(hs, hm.outputCol)
-			logger.Infof("Host %s: saved to DB=%s/%s/%s\n", host.Name, outputDB.URL, outputDB.Name, hm.outputCol)
+			saveSpan := util.StartSpan(util.RoundSpan(), "host.save", "host", host.Name)
+			outputDB.SaveDataSpan(hs, hm.outputCol, saveSpan)
+			saveSpan.Finish()
+			hm.log.Infof("Host %s: saved to DB=%s/%s/%s\n", host.Name, outputDB.URL, outputDB.Name, hm.outputCol)
 		}
 		if url, index := viper.GetString("output.elasticsearch.url"), viper.GetString("output.elasticsearch.index"); url != "" && index != "" {
 			esDoc := make(map[string]interface{})
@@ -162,21 +384,43 @@ func (hm *HostMonitor) Monit(host data.Host, inputDB, outputDB *data.DB, c chan
 			esDoc["cpu_percentage"] = hs.CPUPercentage
 			esDoc["memory_usage"] = hs.Memory
 			esDoc["memory_limit"] = hs.MemoryLimit
+			esDoc["memory_working_set"] = hs.MemoryWorkingSet
+			esDoc["memory_rss"] = hs.MemoryRSS
 			esDoc["memory_percentage"] = hs.MemoryPercentage
 			esDoc["network_rx"] = hs.NetworkRx
 			esDoc["network_tx"] = hs.NetworkTx
 			esDoc["block_read"] = hs.BlockRead
 			esDoc["block_write"] = hs.BlockWrite
+			esDoc["throttled_containers"] = hs.Throttled
 			esDoc["max_latency"] = hs.MaxLatency
 			esDoc["avg_latency"] = hs.AvgLatency
 			esDoc["min_latency"] = hs.MinLatency
+			esDoc["cpu_distribution"] = hs.CPUDistribution
+			esDoc["memory_distribution"] = hs.MemoryDistribution
+			esDoc["latency_distribution"] = hs.LatencyDistribution
+			esDoc["capacity"] = hs.Capacity
+			esDoc["clusters_used"] = hs.ClustersUsed
+			esDoc["free_slots"] = hs.FreeSlots
+			esDoc["cpu_capacity"] = hs.CPUCapacity
+			esDoc["cpu_headroom"] = hs.CPUHeadroom
+			esDoc["memory_capacity"] = hs.MemoryCapacity
+			esDoc["memory_headroom"] = hs.MemoryHeadroom
+			esDoc["accepting"] = hs.Accepting
+			esDoc["disk_images"] = hs.DiskImages
+			esDoc["disk_containers"] = hs.DiskContainers
+			esDoc["disk_volumes_size"] = hs.DiskVolumes
+			esDoc["disk_build_cache"] = hs.DiskBuildCache
+			esDoc["disk_usage"] = hs.DiskUsage
+			esDoc["disk_capacity"] = hs.DiskCapacity
+			esDoc["disk_growth_rate"] = hs.DiskGrowthRate
+			esDoc["disk_full_days"] = hs.DiskFullDays
 			esDoc["timestamp"] = hs.TimeStamp.Format("2006-01-02 15:04:05")
 			data.ESInsertDoc(url, index, "host", esDoc)
-			logger.Infof("Host %s: saved to ES=%s/%s/%s\n", host.Name, url, index, "host")
+			hm.log.Infof("Host %s: saved to ES=%s/%s/%s\n", host.Name, url, index, "host")
 		}
 
 		monitTime = time.Now().Sub(monitStart)
-		logger.Infof("<<Host %s: End monit with %s\n", host.Name, monitTime)
+		hm.log.With(util.LogFields{"duration": monitTime.Seconds()}).Infof("<<Host %s: End monit with %s\n", host.Name, monitTime)
 	}
 	c <- host.Name
 	return
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+)
+
+// kubeletCPU is the cpu stats in kubelet summary
+type kubeletCPU struct {
+	Time                 time.Time `json:"time"`
+	UsageNanoCores       uint64    `json:"usageNanoCores"`
+	UsageCoreNanoSeconds uint64    `json:"usageCoreNanoSeconds"`
+}
+
+// kubeletMemory is the memory stats in kubelet summary
+type kubeletMemory struct {
+	Time            time.Time `json:"time"`
+	AvailableBytes  uint64    `json:"availableBytes"`
+	UsageBytes      uint64    `json:"usageBytes"`
+	WorkingSetBytes uint64    `json:"workingSetBytes"`
+	RSSBytes        uint64    `json:"rssBytes"`
+}
+
+// kubeletNetwork is the network stats of a pod in kubelet summary
+type kubeletNetwork struct {
+	RxBytes uint64 `json:"rxBytes"`
+	TxBytes uint64 `json:"txBytes"`
+}
+
+// kubeletContainer is the stats of a container in kubelet summary
+type kubeletContainer struct {
+	Name   string         `json:"name"`
+	CPU    *kubeletCPU    `json:"cpu"`
+	Memory *kubeletMemory `json:"memory"`
+}
+
+// kubeletSummary is the part of kubelet /stats/summary used here
+type kubeletSummary struct {
+	Pods []struct {
+		PodRef struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"podRef"`
+		Containers []kubeletContainer `json:"containers"`
+		Network    *kubeletNetwork    `json:"network"`
+	} `json:"pods"`
+}
+
+// KubeletMonitor is used to collect container stats of a kubernetes node
+// from the kubelet summary api, proxied by the API server.
+type KubeletMonitor struct {
+	client *data.KubeClient
+	node   string
+	Log    *util.Log  // with the host context, nil to use the agent log
+	Span   *util.Span // of the host, the parent of the writes
+}
+
+// Init will finish the setup
+func (km *KubeletMonitor) Init(client *data.KubeClient, node string) error {
+	if client == nil {
+		return errors.New("kubernetes client is nil")
+	}
+	km.client = client
+	km.node = node
+	return nil
+}
+
+// CollectData will read the kubelet summary of the node,
+// and return the container stats indexed by data.KubeContainerRef
+func (km *KubeletMonitor) CollectData() (map[string]*data.ContainerStat, error) {
+	result := make(map[string]*data.ContainerStat)
+	if err := km.collectNode(km.node, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CollectNodes will add the container stats of the other nodes the clusters span,
+// given by their daemon urls in Cluster.Nodes
+func (km *KubeletMonitor) CollectNodes(clusters []data.Cluster, stats map[string]*data.ContainerStat) error {
+	nodes := make(map[string]bool)
+	for _, c := range clusters {
+		for _, daemonURL := range c.Nodes {
+			nodes[path.Base(strings.TrimSuffix(daemonURL, "/proxy"))] = true
+		}
+	}
+	delete(nodes, km.node)
+	for node := range nodes {
+		if err := km.collectNode(node, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectNode will add the container stats in the kubelet summary of the node
+func (km *KubeletMonitor) collectNode(node string, result map[string]*data.ContainerStat) error {
+	log := contextLog(km.Log, nil)
+	var summary kubeletSummary
+	if err := km.client.Get("/api/v1/nodes/"+node+"/proxy/stats/summary", nil, &summary); err != nil {
+		log.Errorf("Node %s: Error to get kubelet stats summary\n", node)
+		return err
+	}
+
+	for _, pod := range summary.Pods {
+		// network is only reported per pod, so count it on the first container
+		sort.Sort(byKubeContainerName(pod.Containers))
+		for i, ct := range pod.Containers {
+			ref := data.KubeContainerRef(pod.PodRef.Namespace, pod.PodRef.Name, ct.Name)
+			s := data.ContainerStat{
+				ContainerID:   ref,
+				ContainerName: pod.PodRef.Name + "/" + ct.Name,
+				TimeStamp:     time.Now().UTC(),
+			}
+			if ct.CPU != nil {
+				s.CPUPercentage = float64(ct.CPU.UsageNanoCores) / 1e9 * 100.0
+				s.TimeStamp = ct.CPU.Time
+			}
+			if ct.Memory != nil {
+				// the working set as the usage without the inactive files of the docker stats,
+				// the usage with the page cache is kept as the raw one
+				s.Memory = float64(ct.Memory.WorkingSetBytes)
+				s.RawUsage = float64(ct.Memory.UsageBytes)
+				s.WorkingSet = float64(ct.Memory.WorkingSetBytes)
+				s.RSS = float64(ct.Memory.RSSBytes)
+				// available bytes is only given when the container has a limit
+				if ct.Memory.AvailableBytes > 0 {
+					s.MemoryLimit = float64(ct.Memory.AvailableBytes + ct.Memory.WorkingSetBytes)
+					s.MemoryPercentage = s.Memory / s.MemoryLimit * 100.0
+				}
+			}
+			if i == 0 && pod.Network != nil {
+				s.NetworkRx = float64(pod.Network.RxBytes)
+				s.NetworkTx = float64(pod.Network.TxBytes)
+			}
+			result[ref] = &s
+		}
+	}
+	log.Debugf("Node %s: collected %d container stats from kubelet\n", node, len(summary.Pods))
+	return nil
+}
+
+// ClusterData will pick the container stats of the cluster from the collected ones,
+// save them and return the stat of the cluster, with the containers not in the summary counted as missing
+func (km *KubeletMonitor) ClusterData(cluster data.Cluster, stats map[string]*data.ContainerStat, outputDB *data.DB) (*data.ClusterStat, error) {
+	log := contextLog(km.Log, util.LogFields{"cluster_id": cluster.ID})
+	csList := []*data.ContainerStat{}
+	for name, ref := range cluster.Containers {
+		s, ok := stats[ref]
+		if !ok {
+			log.Warningf("Cluster %s/Container %s: no stats in kubelet summary\n", cluster.Name, name)
+			continue
+		}
+		csList = append(csList, s)
+		detectContainer(s)
+		if outputCol := viper.GetString("output.mongo.col_container"); outputDB != nil && outputDB.URL != "" && outputDB.Name != "" && outputCol != "" {
+			outputDB.SaveDataSpan(s, outputCol, km.Span)
+		}
+	}
+	if len(csList) <= 0 {
+		log.Errorf("Cluster %s: no container data collected\n", cluster.Name)
+		return nil, errors.New("No container data collected")
+	}
+	cs := data.ClusterStat{
+		ClusterID:    cluster.ID,
+		ClusterName:  cluster.Name,
+		UserID:       cluster.UserID,
+		Size:         uint64(len(cluster.Containers)),
+		DiskCapacity: cluster.DiskQuota * 1e9,
+		Latencies:    []float64{},
+		TimeStamp:    time.Now().UTC(),
+	}
+	(&cs).CalculateStat(csList)
+	// the size of the cluster, not only of the containers collected
+	cs.Size, cs.Missing = uint64(len(cluster.Containers)), uint64(len(cluster.Containers)-len(csList))
+	if cs.Missing > 0 {
+		log.Warningf("Cluster %s: only collected %d/%d container stats from kubelet\n", cluster.Name, len(csList), len(cluster.Containers))
+	}
+	saveClusterStat(&cs, outputDB, viper.GetString("output.mongo.col_cluster"), log, km.Span)
+	return &cs, nil
+}
+
+// byKubeContainerName sorts the containers of a pod by name
+type byKubeContainerName []kubeletContainer
+
+func (s byKubeContainerName) Len() int           { return len(s) }
+func (s byKubeContainerName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKubeContainerName) Less(i, j int) bool { return s[i].Name < s[j].Name }
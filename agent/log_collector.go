@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+	"golang.org/x/net/context"
+)
+
+// defaultLogPatterns are matched when logs.patterns is not given
+var defaultLogPatterns = map[string]string{
+	"panic":             "panic",
+	"error":             "ERRO",
+	"consensus_timeout": "consensus timeout",
+}
+
+// maxLogLine is the bytes of a log line kept to match, the rest of a longer line is skipped
+const maxLogLine = 1024 * 1024
+
+// LogMatch is a log line matching a pattern
+type LogMatch struct {
+	Pattern string
+	Line    string
+}
+
+// LogCount is the result of reading the log lines after a time
+type LogCount struct {
+	Lines   uint64
+	Hits    map[string]uint64
+	Last    time.Time  // timestamp of the last line
+	Matched []LogMatch // the first ones only, up to the max lines
+}
+
+// CountLogs reads the logs with timestamps from the docker logs api, multiplexed or not (tty),
+// and counts the lines after since and the ones matching each pattern.
+// At most maxLines lines are matched, the rest are only counted.
+func CountLogs(r io.Reader, since time.Time, patterns map[string]*regexp.Regexp, maxLines int) (LogCount, error) {
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := LogCount{Hits: make(map[string]uint64), Last: since}
+	br := bufio.NewReaderSize(newLogReader(r), 64*1024)
+	for {
+		line, err := readLogLine(br)
+		if err == io.EOF && line == "" {
+			return result, nil
+		}
+		if err != nil && err != io.EOF {
+			return result, err
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, line[:i])
+		if err != nil || !ts.After(since) {
+			continue
+		}
+		if ts.After(result.Last) {
+			result.Last = ts
+		}
+		result.Lines++
+		if maxLines > 0 && result.Lines > uint64(maxLines) {
+			continue
+		}
+		line = line[i+1:]
+		for _, name := range names {
+			if patterns[name].MatchString(line) {
+				result.Hits[name]++
+				result.Matched = append(result.Matched, LogMatch{Pattern: name, Line: line})
+			}
+		}
+	}
+}
+
+// readLogLine reads a line without the line end, a line longer than maxLogLine is cut,
+// so the reading goes on after it with the timestamp of the line kept
+func readLogLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(line) < maxLogLine {
+			if n := maxLogLine - len(line); len(chunk) > n {
+				line = append(line, chunk[:n]...)
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return strings.TrimRight(string(line), "\r\n"), err
+		}
+	}
+}
+
+// logReader strips the 8 bytes header of each frame of a multiplexed stream,
+// the stream of a tty container is read as it is
+type logReader struct {
+	r     *bufio.Reader
+	muxed bool
+	left  uint32 // bytes left in the frame
+}
+
+func newLogReader(r io.Reader) *logReader {
+	lr := &logReader{r: bufio.NewReader(r)}
+	if header, err := lr.r.Peek(8); err == nil && header[0] <= 2 && header[1] == 0 && header[2] == 0 && header[3] == 0 {
+		lr.muxed = true
+	}
+	return lr
+}
+
+func (lr *logReader) Read(p []byte) (int, error) {
+	if !lr.muxed {
+		return lr.r.Read(p)
+	}
+	for lr.left == 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(lr.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		lr.left = binary.BigEndian.Uint32(header[4:])
+	}
+	if uint32(len(p)) > lr.left {
+		p = p[:lr.left]
+	}
+	n, err := lr.r.Read(p)
+	lr.left -= uint32(n)
+	return n, err
+}
+
+// logCursor is where the logs of a container were read to
+type logCursor struct {
+	since time.Time // timestamp of the last line read
+	read  time.Time
+}
+
+// logState keeps the cursors by daemon and container, the compiled patterns and the lines to forward by log server
+var logState = struct {
+	sync.Mutex
+	cursors    map[string]*logCursor
+	patterns   map[string]*regexp.Regexp
+	forwarders map[string]chan string
+}{cursors: make(map[string]*logCursor), forwarders: make(map[string]chan string)}
+
+// logForwardQueue is the lines waiting to be sent to a log server, more are dropped
+const logForwardQueue = 1000
+
+// logRedial is the time to wait before connecting again to a log server not reached
+var logRedial = 30 * time.Second
+
+// logPatterns compiles the logs.patterns once, the invalid ones are skipped
+func logPatterns() map[string]*regexp.Regexp {
+	logState.Lock()
+	defer logState.Unlock()
+	if logState.patterns != nil {
+		return logState.patterns
+	}
+	conf := viper.GetStringMapString("logs.patterns")
+	if len(conf) == 0 {
+		conf = defaultLogPatterns
+	}
+	logState.patterns = make(map[string]*regexp.Regexp)
+	for name, expr := range conf {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logger.Warningf("Invalid log pattern %s=%s: %v\n", name, expr, err)
+			continue
+		}
+		logState.patterns[strings.Replace(name, ".", "_", -1)] = re
+	}
+	return logState.patterns
+}
+
+// collectLogs reads the logs of the container since the last reading, and forwards the matched lines
+// to the syslog server when given. The first reading only sets the cursor and returns nil.
+func collectLogs(cli *client.Client, daemonURL, name, logServer string, now time.Time, log *util.Log) (*data.LogStat, error) {
+	key := daemonURL + "/" + name
+	logState.Lock()
+	cursor, ok := logState.cursors[key]
+	if !ok {
+		logState.cursors[key] = &logCursor{since: now, read: now}
+		// drop the containers not read for long
+		for k, c := range logState.cursors {
+			if now.Sub(c.read) > time.Hour {
+				delete(logState.cursors, k)
+			}
+		}
+	}
+	logState.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	since := cursor.since
+	body, err := cli.ContainerLogs(context.Background(), types.ContainerLogsOptions{
+		ContainerID: name,
+		ShowStdout:  true,
+		ShowStderr:  true,
+		Since:       fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+		Timestamps:  true,
+		Tail:        "all",
+	})
+	if err != nil {
+		countDockerError("logs", err)
+		return nil, err
+	}
+	defer body.Close()
+	count, err := CountLogs(body, since, logPatterns(), viper.GetInt("logs.max_lines"))
+	if err != nil {
+		return nil, err
+	}
+
+	logState.Lock()
+	elapsed := now.Sub(cursor.read).Seconds()
+	cursor.since, cursor.read = count.Last, now
+	logState.Unlock()
+
+	s := data.LogStat{LogLines: count.Lines}
+	if elapsed > 0 {
+		s.LogRate = float64(count.Lines) / elapsed
+	}
+	if len(count.Hits) > 0 {
+		s.LogHits = count.Hits
+	}
+	if logServer != "" {
+		for _, m := range count.Matched {
+			forwardLog(logServer, name, m, log)
+		}
+	}
+	return &s, nil
+}
+
+// forwardLog queues the matched line to the syslog server like udp://10.0.0.1:514,
+// the lines are sent by a goroutine per server so a slow server does not hold the collection
+func forwardLog(server, container string, m LogMatch, log *util.Log) {
+	logState.Lock()
+	lines, ok := logState.forwarders[server]
+	if !ok {
+		lines = make(chan string, logForwardQueue)
+		logState.forwarders[server] = lines
+		go sendLogs(server, lines)
+	}
+	logState.Unlock()
+	select {
+	case lines <- fmt.Sprintf("container=%s pattern=%s %s", container, m.Pattern, m.Line):
+	default:
+		log.Warningf("Too many logs waiting for the log server %s, dropped one of container %s\n", server, container)
+	}
+}
+
+// sendLogs sends the queued lines to the log server, connecting again after an error.
+// The lines are dropped while the server cannot be reached.
+func sendLogs(server string, lines <-chan string) {
+	network, addr := "udp", server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		network, addr = u.Scheme, u.Host
+	}
+	var w *syslog.Writer
+	var retry time.Time
+	for line := range lines {
+		if w == nil {
+			if time.Now().Before(retry) {
+				continue
+			}
+			var err error
+			if w, err = syslog.Dial(network, addr, syslog.LOG_WARNING|syslog.LOG_DAEMON, "cmonit"); err != nil {
+				logger.Warningf("Cannot connect to the log server %s: %v\n", server, err)
+				w, retry = nil, time.Now().Add(logRedial)
+				continue
+			}
+		}
+		if err := w.Warning(line); err != nil {
+			logger.Warningf("Cannot forward the log to %s: %v\n", server, err)
+			w.Close()
+			w = nil
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+	"golang.org/x/net/context"
+)
+
+// psArgs are the ps arguments of the container top, the daemon runs ps on the host
+// and keeps the processes of the container. Windows daemons ignore them.
+var psArgs = []string{"-eo", "pid,ppid,user,pcpu,time,rss,etime,args"}
+
+// processSampled keeps the last time the processes of a container were sampled
+var processSampled = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// processDue tells whether to sample the processes of the container, every process.interval seconds
+func processDue(daemonURL, name string, now time.Time) bool {
+	if !viper.GetBool("process.enabled") {
+		return false
+	}
+	interval := time.Duration(viper.GetInt("process.interval")) * time.Second
+	key := daemonURL + "/" + name
+	processSampled.Lock()
+	defer processSampled.Unlock()
+	if last, ok := processSampled.last[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+	processSampled.last[key] = now
+	// drop the containers not sampled for long
+	for k, last := range processSampled.last {
+		if now.Sub(last) > interval+time.Hour {
+			delete(processSampled.last, k)
+		}
+	}
+	processCPUs.Forget(now.Add(-interval - time.Hour))
+	return true
+}
+
+// processCPUs keeps the cpu time of the processes sampled in each container
+var processCPUs = new(ProcessCPU)
+
+// collectProcesses gets the top processes of the container and saves them into the process collection
+func collectProcesses(cli *client.Client, containerID, name string, outputDB *data.DB, log *util.Log, span *util.Span) {
+	list, err := cli.ContainerTop(context.Background(), name, psArgs)
+	if err != nil {
+		countDockerError("top", err)
+		log.Warningf("Container %s: Error to get the processes: %v\n", name, err)
+		return
+	}
+	now := time.Now()
+	sortBy := viper.GetString("process.sort")
+	processes, total := ParseContainerTop(list, 0, sortBy)
+	processCPUs.Rate(containerID, processes, now)
+	processes = TopProcesses(processes, viper.GetInt("process.top"), sortBy)
+	s := data.ProcessStat{
+		ContainerID:   containerID,
+		ContainerName: name,
+		Total:         total,
+		SortBy:        sortBy,
+		Processes:     processes,
+		TimeStamp:     now.UTC(),
+	}
+	log.Debugf("Container %s: collected %d of %d processes\n", name, len(processes), total)
+	if outputDB != nil && outputDB.URL != "" && outputDB.Name != "" {
+		outputDB.SaveDataSpan(s, "process", span)
+	}
+}
+
+// ParseContainerTop returns the top n processes by cpu or rss, and the number of all processes.
+// The columns are found by the titles of ps on linux, or of the windows daemon,
+// the first title given is taken when several are there.
+func ParseContainerTop(list types.ContainerProcessList, n int, sortBy string) ([]data.Process, int) {
+	column := func(titles ...string) int {
+		for _, title := range titles {
+			for i, t := range list.Titles {
+				if strings.EqualFold(t, title) {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	pid, ppid, user := column("PID"), column("PPID"), column("USER", "UID")
+	cpu, cpuTime, rss := column("%CPU", "C"), column("TIME", "CPU"), column("RSS", "Private Working Set")
+	elapsed, command := column("ELAPSED"), column("COMMAND", "CMD", "Name")
+
+	cell := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
+	processes := make([]data.Process, 0, len(list.Processes))
+	for _, row := range list.Processes {
+		p := data.Process{
+			PID:     cell(row, pid),
+			PPID:    cell(row, ppid),
+			User:    cell(row, user),
+			Elapsed: cell(row, elapsed),
+			Command: cell(row, command),
+		}
+		p.CPUPercentage, _ = strconv.ParseFloat(cell(row, cpu), 64)
+		p.CPUTime = parseCPUTime(cell(row, cpuTime))
+		p.RSS = parseProcessSize(cell(row, rss))
+		processes = append(processes, p)
+	}
+	return TopProcesses(processes, n, sortBy), len(list.Processes)
+}
+
+// TopProcesses sorts the processes by cpu or rss, and returns the first n, all when n <= 0
+func TopProcesses(processes []data.Process, n int, sortBy string) []data.Process {
+	sort.Stable(processesBy{processes, sortBy})
+	if n > 0 && len(processes) > n {
+		processes = processes[:n]
+	}
+	return processes
+}
+
+// parseCPUTime returns the seconds of the cpu time like [DD-]HH:MM:SS from ps, or 00:00:01.250 from windows
+func parseCPUTime(s string) float64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+	var days float64
+	if i := strings.Index(s, "-"); i >= 0 {
+		days, _ = strconv.ParseFloat(s[:i], 64)
+		s = s[i+1:]
+	}
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		v, _ := strconv.ParseFloat(part, 64)
+		seconds = seconds*60 + v
+	}
+	return days*24*3600 + seconds
+}
+
+// parseProcessSize returns the bytes of the rss in KiB from ps, or a size like 12.5MB from windows
+func parseProcessSize(s string) float64 {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"kB", 1 << 10}, {"KB", 1 << 10}, {"B", 1}}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			v, _ := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			return v * u.scale
+		}
+	}
+	v, _ := strconv.ParseFloat(s, 64)
+	return v * 1024
+}
+
+// processesBy sorts the processes by cpu or rss, the larger first
+type processesBy struct {
+	list   []data.Process
+	sortBy string
+}
+
+func (s processesBy) Len() int      { return len(s.list) }
+func (s processesBy) Swap(i, j int) { s.list[i], s.list[j] = s.list[j], s.list[i] }
+func (s processesBy) Less(i, j int) bool {
+	if s.sortBy == "rss" {
+		return s.list[i].RSS > s.list[j].RSS
+	}
+	return s.list[i].CPUPercentage > s.list[j].CPUPercentage
+}
+
+// cpuSample is the cpu time of the processes of a container at a sample, by pid
+type cpuSample struct {
+	at  time.Time
+	cpu map[string]float64
+}
+
+// ProcessCPU keeps the cpu time of the processes of each container at the last sample,
+// to get the cpu percentage between two samples, as the one of ps is over the process lifetime
+type ProcessCPU struct {
+	sync.Mutex
+	last map[string]cpuSample // by container
+}
+
+// Rate sets the cpu percentage of the processes seen in the last sample of the container
+// from the cpu time used since then, the others keep the percentage of ps
+func (pc *ProcessCPU) Rate(container string, processes []data.Process, now time.Time) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.last == nil {
+		pc.last = make(map[string]cpuSample)
+	}
+	last, ok := pc.last[container]
+	elapsed := now.Sub(last.at).Seconds()
+	current := cpuSample{at: now, cpu: make(map[string]float64, len(processes))}
+	for i := range processes {
+		p := &processes[i]
+		// the pid may be reused by a new process, which has used less cpu time
+		if cpu, seen := last.cpu[p.PID]; ok && seen && elapsed > 0 && p.CPUTime >= cpu {
+			p.CPUPercentage = (p.CPUTime - cpu) / elapsed * 100.0
+		}
+		current.cpu[p.PID] = p.CPUTime
+	}
+	pc.last[container] = current
+}
+
+// Forget drops the containers last sampled before the given time
+func (pc *ProcessCPU) Forget(before time.Time) {
+	pc.Lock()
+	defer pc.Unlock()
+	for container, sample := range pc.last {
+		if sample.at.Before(before) {
+			delete(pc.last, container)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+)
+
+// swarmService is the part of a swarm service used here
+type swarmService struct {
+	ID   string `json:"ID"`
+	Spec struct {
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Spec"`
+}
+
+// swarmTask is the part of a swarm task used here
+type swarmTask struct {
+	ID           string `json:"ID"`
+	ServiceID    string `json:"ServiceID"`
+	Slot         int    `json:"Slot"`
+	NodeID       string `json:"NodeID"`
+	DesiredState string `json:"DesiredState"`
+	Status       struct {
+		State           string `json:"State"`
+		ContainerStatus struct {
+			ContainerID string `json:"ContainerID"`
+		} `json:"ContainerStatus"`
+	} `json:"Status"`
+}
+
+// swarmNode is the part of a swarm node used here
+type swarmNode struct {
+	ID          string `json:"ID"`
+	Description struct {
+		Hostname string `json:"Hostname"`
+	} `json:"Description"`
+	Status struct {
+		State string `json:"State"`
+		Addr  string `json:"Addr"`
+	} `json:"Status"`
+}
+
+// SwarmMonitor is used to map the services of a swarm manager into clusters.
+// The tasks are followed on each round, and the stats of each task are
+// collected from the node currently running it.
+type SwarmMonitor struct {
+	host       *data.Host
+	daemonURL  string // url to reach the manager, may differ from host for ssh tunnel
+	inventory  data.Inventory
+	httpClient *http.Client
+	nodeHosts  map[string]data.Host      // daemon url of node -> host
+	clients    map[string]*client.Client // daemon url of node -> client
+}
+
+// Init will finish the setup
+func (sm *SwarmMonitor) Init(host *data.Host, daemonURL string, inventory data.Inventory, httpClient *http.Client) error {
+	if httpClient == nil {
+		return errors.New("http client is nil")
+	}
+	sm.host = host
+	sm.daemonURL = daemonURL
+	sm.nodeHosts = make(map[string]data.Host)
+	sm.inventory = inventory
+	sm.httpClient = httpClient
+	sm.clients = make(map[string]*client.Client)
+	return nil
+}
+
+// Clusters lists the services and their running tasks, and returns the clusters
+// with Nodes telling the daemon of each container
+func (sm *SwarmMonitor) Clusters() ([]data.Cluster, error) {
+	var services []swarmService
+	if err := dockerAPIGet(sm.httpClient, sm.daemonURL, "/services", nil, &services); err != nil {
+		logger.Errorf("Host %s: Cannot list swarm services\n", sm.host.Name)
+		return nil, err
+	}
+	filter := filters.NewArgs()
+	filter.Add("desired-state", "running")
+	param, _ := filters.ToParam(filter)
+	var tasks []swarmTask
+	if err := dockerAPIGet(sm.httpClient, sm.daemonURL, "/tasks", url.Values{"filters": []string{param}}, &tasks); err != nil {
+		logger.Errorf("Host %s: Cannot list swarm tasks\n", sm.host.Name)
+		return nil, err
+	}
+	nodeURLs, err := sm.nodeDaemonURLs()
+	if err != nil {
+		return nil, err
+	}
+
+	clusterLabel := viper.GetString("input.swarm.cluster_label")
+	userLabel := viper.GetString("input.swarm.user_label")
+	serviceByID := make(map[string]swarmService)
+	for _, s := range services {
+		serviceByID[s.ID] = s
+	}
+
+	clusters := []data.Cluster{}
+	index := make(map[string]int) // cluster id -> position in clusters
+	for _, t := range tasks {
+		// tasks being scheduled or moved have no container yet, they will join in the next round
+		if t.Status.State != "running" || t.Status.ContainerStatus.ContainerID == "" {
+			logger.Debugf("Host %s: task %s is %s, ignore\n", sm.host.Name, t.ID, t.Status.State)
+			continue
+		}
+		s, ok := serviceByID[t.ServiceID]
+		if !ok {
+			continue
+		}
+		nodeURL, ok := nodeURLs[t.NodeID]
+		if !ok {
+			logger.Warningf("Host %s: no daemon known for node %s of task %s\n", sm.host.Name, t.NodeID, t.ID)
+			continue
+		}
+		clusterID := s.Spec.Labels[clusterLabel]
+		if clusterLabel == "" || clusterID == "" {
+			clusterID = s.Spec.Name
+		}
+		i, ok := index[clusterID]
+		if !ok {
+			clusters = append(clusters, data.Cluster{
+				ID:         clusterID,
+				Name:       clusterID,
+				HostID:     sm.host.ID,
+				UserID:     s.Spec.Labels[userLabel],
+				DaemonURL:  sm.host.DaemonURL,
+				Containers: make(map[string]string),
+				Nodes:      make(map[string]string),
+			})
+			i = len(clusters) - 1
+			index[clusterID] = i
+		}
+		// same as the container name created by swarm
+		slot := strconv.Itoa(t.Slot)
+		if t.Slot == 0 { // global service
+			slot = t.NodeID
+		}
+		name := s.Spec.Name + "." + slot + "." + t.ID
+		clusters[i].Containers[name] = t.Status.ContainerStatus.ContainerID
+		clusters[i].Nodes[name] = nodeURL
+		clusters[i].Size = uint64(len(clusters[i].Containers))
+	}
+	logger.Debugf("Host %s: found %d swarm clusters from %d tasks\n", sm.host.Name, len(clusters), len(tasks))
+	return clusters, nil
+}
+
+// nodeDaemonURLs returns the daemon url of each ready node.
+// A node is matched with the host of same name in the inventory first,
+// or reached by its address with the configured daemon port.
+func (sm *SwarmMonitor) nodeDaemonURLs() (map[string]string, error) {
+	var nodes []swarmNode
+	if err := dockerAPIGet(sm.httpClient, sm.daemonURL, "/nodes", nil, &nodes); err != nil {
+		logger.Errorf("Host %s: Cannot list swarm nodes\n", sm.host.Name)
+		return nil, err
+	}
+	known := make(map[string]data.Host)
+	if hosts, err := sm.inventory.GetHosts(); err == nil {
+		for _, h := range *hosts {
+			known[h.Name] = h
+		}
+	}
+	port := viper.GetString("input.swarm.daemon_port")
+	result := make(map[string]string)
+	for _, n := range nodes {
+		if n.Status.State != "ready" {
+			continue
+		}
+		h, ok := known[n.Description.Hostname]
+		if !ok {
+			if n.Status.Addr == "" {
+				continue
+			}
+			h = data.Host{
+				ID:        n.ID,
+				Name:      n.Description.Hostname,
+				DaemonURL: "tcp://" + net.JoinHostPort(n.Status.Addr, port),
+			}
+		}
+		result[n.ID] = h.DaemonURL
+		sm.nodeHosts[h.DaemonURL] = h
+	}
+	return result, nil
+}
+
+// NodeClients returns the docker clients of the nodes used by the clusters,
+// new clients are created for the nodes not seen before.
+func (sm *SwarmMonitor) NodeClients(clusters []data.Cluster) map[string]*client.Client {
+	for _, c := range clusters {
+		for _, u := range c.Nodes {
+			// the client without api version is made again, as the node did not answer
+			if cli, ok := sm.clients[u]; ok && cli.ClientVersion() != "" {
+				continue
+			}
+			if u == sm.host.DaemonURL {
+				continue
+			}
+			h, ok := sm.nodeHosts[u]
+			if !ok {
+				continue
+			}
+			cli, _, _, err := newDockerClient(&h)
+			if err != nil {
+				logger.Errorf("Cannot init connection to swarm node=%s\n", u)
+				logger.Error(err)
+				continue
+			}
+			sm.clients[u] = cli
+		}
+	}
+	result := make(map[string]*client.Client, len(sm.clients))
+	for u, cli := range sm.clients {
+		result[u] = cli
+	}
+	return result
+}
+
+// dockerAPIGet sends a GET request to the docker daemon api, and decodes the json response into v.
+// It is used for the api not supported by the engine-api client.
+func dockerAPIGet(httpClient *http.Client, daemonURL, path string, query url.Values, v interface{}) error {
+	proto, addr, basePath, err := client.ParseHost(daemonURL)
+	if err != nil {
+		return err
+	}
+	if proto != "tcp" {
+		return fmt.Errorf("Unsupported protocol %s of daemon %s", proto, daemonURL)
+	}
+	scheme := "http"
+	if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		scheme = "https"
+	}
+	u := scheme + "://" + addr + basePath + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("docker api %s returns %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
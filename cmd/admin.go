@@ -0,0 +1,136 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+)
+
+// health is the state of the monitor task reported by the admin listener
+var health = struct {
+	sync.Mutex
+	started   time.Time
+	lastRound time.Time // end of the last successful round
+}{started: time.Now()}
+
+// roundDone records a successful round
+func roundDone(start, end time.Time) {
+	util.ObserveHistogram("monit_round_seconds", end.Sub(start).Seconds(), util.DefaultBuckets)
+	util.SetGauge("goroutines", float64(runtime.NumGoroutine()))
+	health.Lock()
+	health.lastRound = end
+	health.Unlock()
+}
+
+// HealthReport is the body of /healthz and /readyz
+type HealthReport struct {
+	Status       string    `json:"status"` // ok or failing
+	Input        string    `json:"input"`  // ok, or the error to reach the input
+	LastRound    time.Time `json:"last_round,omitempty"`
+	LastRoundAge float64   `json:"last_round_age"` // seconds, since the start before the first round
+	MaxRoundAge  float64   `json:"max_round_age"`
+	Role         string    `json:"role,omitempty"`   // leader or standby in the ha mode
+	Leader       string    `json:"leader,omitempty"` // holder of the lease
+	LeaderToken  int64     `json:"leader_token,omitempty"`
+	LeaseExpires time.Time `json:"lease_expires,omitempty"`
+}
+
+// checkHealth reports the input connectivity and the age of the last successful round,
+// it is healthy while a round is done within maxAge, and ready when the input is also reachable.
+// In the ha mode, a standby is healthy while the lease is read within maxAge.
+func checkHealth(input data.Inventory, maxAge time.Duration, now time.Time) (report HealthReport, healthy, ready bool) {
+	health.Lock()
+	last, started := health.lastRound, health.started
+	health.Unlock()
+
+	report = HealthReport{Input: "ok", LastRound: last, MaxRoundAge: maxAge.Seconds()}
+	if last.IsZero() {
+		report.LastRoundAge = now.Sub(started).Seconds()
+	} else {
+		report.LastRoundAge = now.Sub(last).Seconds()
+	}
+	if err := input.Ping(); err != nil {
+		report.Input = err.Error()
+	}
+	healthy = report.LastRoundAge <= maxAge.Seconds()
+	ready = healthy && !last.IsZero() && report.Input == "ok"
+	if lease != nil {
+		current, checked := lease.Current()
+		report.Leader, report.LeaderToken, report.LeaseExpires = current.Holder, current.Token, current.Expires
+		report.Role = "standby"
+		if lease.IsLeader(now) {
+			report.Role = "leader"
+		} else {
+			healthy = now.Sub(checked) <= maxAge
+			ready = healthy && report.Input == "ok"
+		}
+	}
+	return report, healthy, ready
+}
+
+// adminServer serves the self metrics, health checks and optionally pprof on admin.listen
+func adminServer(input data.Inventory) {
+	addr := viper.GetString("admin.listen")
+	maxAge := time.Duration(viper.GetInt("admin.max_round_age")) * time.Second
+	if maxAge <= 0 {
+		maxAge = 3 * time.Duration(viper.GetInt("monitor.interval")) * time.Second
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		util.SetGauge("goroutines", float64(runtime.NumGoroutine()))
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		util.WriteMetrics(w)
+	})
+	probe := func(readiness bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			report, healthy, ready := checkHealth(input, maxAge, time.Now())
+			ok := healthy
+			if readiness {
+				ok = ready
+			}
+			report.Status = "ok"
+			w.Header().Set("Content-Type", "application/json")
+			if !ok {
+				report.Status = "failing"
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(report)
+		}
+	}
+	mux.HandleFunc("/healthz", probe(false))
+	mux.HandleFunc("/readyz", probe(true))
+	if viper.GetBool("admin.pprof") {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	logger.Infof("Serving the admin api on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("Admin listener on %s stopped: %v\n", addr, err)
+	}
+}
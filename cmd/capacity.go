@@ -0,0 +1,87 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+)
+
+// capacityCmd represents the capacity command
+var capacityCmd = &cobra.Command{
+	Use:   "capacity",
+	Short: "Print the capacity of the hosts",
+	Long:  `Print the latest fleet capacity in the output db, with the hosts can accept new clusters first.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		return printCapacity(format)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(capacityCmd)
+	capacityCmd.Flags().String("format", "table", "output format: table or json")
+}
+
+// printCapacity reads the latest fleet document and prints it
+func printCapacity(format string) error {
+	conf := mongoConfig("output")
+	if conf.URL == "" {
+		return fmt.Errorf("No output.mongo.url is configured")
+	}
+	output := new(data.DB)
+	if err := output.Init(conf); err != nil {
+		return err
+	}
+	defer output.Close()
+	output.SetCol("fleet", viper.GetString("output.mongo.col_fleet"))
+
+	var fleet data.FleetStat
+	if err := output.GetLatest("fleet", &fleet); err != nil {
+		return fmt.Errorf("Cannot get the fleet capacity: %v", err)
+	}
+
+	switch format {
+	case "json":
+		encoded, err := json.MarshalIndent(fleet, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(encoded))
+	case "table":
+		fmt.Printf("Fleet at %s: %d hosts, %d active, %d accepting, %d clusters used, %d free slots\n\n",
+			fleet.TimeStamp.Format("2006-01-02 15:04:05"), fleet.Hosts, fleet.ActiveHosts, fleet.AcceptingHosts, fleet.ClustersUsed, fleet.FreeSlots)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tSTATUS\tACCEPTING\tCLUSTERS\tCAPACITY\tCPU HEADROOM %\tMEMORY HEADROOM MB")
+		for _, h := range fleet.Members {
+			capacity := "-"
+			if h.Capacity > 0 {
+				capacity = fmt.Sprint(h.Capacity)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%v\t%d\t%s\t%.1f\t%.0f\n", h.HostName, h.Status, h.Accepting,
+				h.ClustersUsed, capacity, h.CPUHeadroom, h.MemoryHeadroom/1024/1024)
+		}
+		w.Flush()
+	default:
+		return fmt.Errorf("Unknown format %s, should be table or json", format)
+	}
+	return nil
+}
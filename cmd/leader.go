@@ -0,0 +1,85 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+)
+
+// lease is the leader lease in the ha mode, nil when every instance collects
+var lease *data.LeaderLease
+
+// openLease opens the leader lease in the output db, or in the input db without output,
+// and fences the writes of the output with it
+func openLease(input data.Inventory, output *data.DB) (*data.LeaderLease, error) {
+	db := output
+	if db == nil {
+		db, _ = input.(*data.DB)
+	}
+	if db == nil {
+		return nil, errors.New("ha.enabled needs a mongo input or output")
+	}
+	id := viper.GetString("ha.id")
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	l := &data.LeaderLease{
+		Name: viper.GetString("ha.name"),
+		ID:   id,
+		TTL:  time.Duration(viper.GetInt("ha.lease_ttl")) * time.Second,
+	}
+	db.SetCol("lease", viper.GetString("ha.col"))
+	if err := l.Init(db, "lease"); err != nil {
+		return nil, err
+	}
+	if output != nil {
+		output.SetFence(l.Fence)
+	}
+	// a lone instance leads at once
+	if leader, err := l.Acquire(time.Now()); err == nil {
+		current, _ := l.Current()
+		logger.Infof("Instance %s joined the lease %s, leader = %t, holder = %s\n", l.ID, l.Name, leader, current.Holder)
+	}
+	return l, nil
+}
+
+// leaseTask renews the lease, or tries to take it over, three times in each ttl
+func leaseTask(l *data.LeaderLease) {
+	for {
+		time.Sleep(l.TTL / 3)
+		leader, err := l.Acquire(time.Now())
+		if err != nil {
+			logger.Warningf("Failed to renew the lease %s: %v\n", l.Name, err)
+		}
+		if leader {
+			util.SetGauge("leader", 1)
+		} else {
+			util.SetGauge("leader", 0)
+		}
+	}
+}
+
+// leading tells whether the instance should collect and write, always true out of the ha mode
+func leading() bool {
+	return lease == nil || lease.IsLeader(time.Now())
+}
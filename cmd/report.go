@@ -0,0 +1,233 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/data"
+)
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Print the reports from the output db",
+	Long:  `Print the reports from the output db, see the sub commands.`,
+}
+
+// reportUsageCmd represents the report usage command
+var reportUsageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Export the resource usage of each user per day",
+	Long:  `Export the daily usage records in [from, to] in the output db, for billing.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		now := time.Now().UTC()
+		from, err := parseDay(cmd, "from", time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			return err
+		}
+		to, err := parseDay(cmd, "to", now)
+		if err != nil {
+			return err
+		}
+		if to.Before(from) {
+			return fmt.Errorf("--to %s is before --from %s", to.Format(data.UsageDayFormat), from.Format(data.UsageDayFormat))
+		}
+		format, _ := cmd.Flags().GetString("format")
+		return printUsage(from, to, format)
+	},
+}
+
+// reportForecastCmd represents the report forecast command
+var reportForecastCmd = &cobra.Command{
+	Use:   "forecast",
+	Short: "Forecast when the hosts and clusters run out of capacity",
+	Long:  `Fit the trends of the rolled up stats in the output db, and print when the usages reach the capacities.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		return printForecast(format)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reportCmd)
+	reportCmd.AddCommand(reportUsageCmd)
+	reportCmd.AddCommand(reportForecastCmd)
+	reportForecastCmd.Flags().String("format", "markdown", "output format: markdown, html or json")
+	reportUsageCmd.Flags().String("from", "", "first day to export, YYYY-MM-DD in UTC, default to the first day of this month")
+	reportUsageCmd.Flags().String("to", "", "last day to export, YYYY-MM-DD in UTC, default to today")
+	reportUsageCmd.Flags().String("format", "csv", "output format: csv or json")
+}
+
+// parseDay returns the day given in the flag, or the default one
+func parseDay(cmd *cobra.Command, flag string, defaultDay time.Time) (time.Time, error) {
+	value, _ := cmd.Flags().GetString(flag)
+	if value == "" {
+		return defaultDay, nil
+	}
+	day, err := time.Parse(data.UsageDayFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid --%s %s, should be YYYY-MM-DD", flag, value)
+	}
+	return day, nil
+}
+
+// printUsage reads the usage records in [from, to] and prints them
+func printUsage(from, to time.Time, format string) error {
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("Unknown format %s, should be csv or json", format)
+	}
+	conf := mongoConfig("output")
+	if conf.URL == "" {
+		return fmt.Errorf("No output.mongo.url is configured")
+	}
+	output := new(data.DB)
+	if err := output.Init(conf); err != nil {
+		return err
+	}
+	defer output.Close()
+	output.SetCol("usage", viper.GetString("output.mongo.col_usage"))
+
+	records, err := output.GetUsage("usage", from, to)
+	if err != nil {
+		return fmt.Errorf("Cannot get the usage records: %v", err)
+	}
+	if format == "json" {
+		if records == nil {
+			records = []data.UsageRecord{}
+		}
+		encoded, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(encoded))
+		return nil
+	}
+	return writeUsageCSV(os.Stdout, records)
+}
+
+// writeUsageCSV writes the records with a header line
+func writeUsageCSV(out io.Writer, records []data.UsageRecord) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"user_id", "day", "cpu_seconds", "memory_gb_hours", "network_rx_bytes", "network_tx_bytes", "cluster_hours"})
+	for _, r := range records {
+		w.Write([]string{r.UserID, r.Day,
+			strconv.FormatFloat(r.CPUSeconds, 'f', 3, 64),
+			strconv.FormatFloat(r.MemoryGBHours, 'f', 6, 64),
+			strconv.FormatFloat(r.NetworkRxBytes, 'f', 0, 64),
+			strconv.FormatFloat(r.NetworkTxBytes, 'f', 0, 64),
+			strconv.FormatFloat(r.ClusterHours, 'f', 6, 64),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// openForecaster prepares the forecast with the rollup collections in output db
+func openForecaster(output *data.DB) (*data.Forecaster, error) {
+	level := data.RollupLevel{Name: "1h", Period: time.Hour}
+	for _, t := range data.DefaultForecastTargets {
+		output.SetCol(t.ColKey+"_"+level.Name, viper.GetString("output.mongo.col_"+t.ColKey)+"_"+level.Name)
+	}
+	f := &data.Forecaster{
+		Method:       viper.GetString("forecast.method"),
+		Level:        level,
+		Season:       24,
+		History:      time.Duration(viper.GetInt("forecast.history")) * 24 * time.Hour,
+		Horizon:      time.Duration(viper.GetInt("forecast.horizon")) * 24 * time.Hour,
+		WarningDays:  viper.GetFloat64("forecast.warning_days"),
+		CriticalDays: viper.GetFloat64("forecast.critical_days"),
+	}
+	if err := f.Init(output); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// renderForecast returns the report in the format
+func renderForecast(report *data.ForecastReport, format string) (string, error) {
+	switch format {
+	case "markdown":
+		return report.Markdown(), nil
+	case "html":
+		return report.HTML()
+	case "json":
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		return string(encoded) + "\n", err
+	default:
+		return "", fmt.Errorf("Unknown format %s, should be markdown, html or json", format)
+	}
+}
+
+// printForecast runs the forecast on the output db and prints the report
+func printForecast(format string) error {
+	if _, err := renderForecast(&data.ForecastReport{}, format); err != nil {
+		return err
+	}
+	conf := mongoConfig("output")
+	if conf.URL == "" {
+		return fmt.Errorf("No output.mongo.url is configured")
+	}
+	output := new(data.DB)
+	if err := output.Init(conf); err != nil {
+		return err
+	}
+	defer output.Close()
+	f, err := openForecaster(output)
+	if err != nil {
+		return err
+	}
+	report, err := f.Run(time.Now())
+	if err != nil {
+		return fmt.Errorf("Cannot forecast: %v", err)
+	}
+	content, err := renderForecast(report, format)
+	if err != nil {
+		return err
+	}
+	fmt.Print(content)
+	return nil
+}
+
+// writeForecast writes the report in every format into dir, as forecast-<time>.<ext>
+// and forecast-latest.<ext>
+func writeForecast(report *data.ForecastReport, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	stamp := report.GeneratedAt.Format("20060102-1504")
+	for format, ext := range map[string]string{"markdown": "md", "html": "html", "json": "json"} {
+		content, err := renderForecast(report, format)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"forecast-" + stamp + "." + ext, "forecast-latest." + ext} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
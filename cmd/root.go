@@ -62,9 +62,15 @@ func init() {
 	pFlags.StringVar(&cfgFile, "config", "",
 		"config file (default name is cmonit.yaml, will search paths of $HOME, /etc/, ./ or GOPATH/pkg)")
 	pFlags.String("logging-level", "DEBUG", "logging level: DEBUG, INFO, WARNING, ERROR")
+	pFlags.String("logging-format", "text", "logging format: text, or json for one json object per line")
+	pFlags.Int("logging-sample-first", 10, "debug lines of the same message kept in a round, 0 to keep all")
+	pFlags.Int("logging-sample-thereafter", 100, "keep one of each these many debug lines after the first ones, 0 to drop them")
 
 	// Use viper to track those flags
 	viper.BindPFlag("logging.level", pFlags.Lookup("logging-level"))
+	viper.BindPFlag("logging.format", pFlags.Lookup("logging-format"))
+	viper.BindPFlag("logging.sample.first", pFlags.Lookup("logging-sample-first"))
+	viper.BindPFlag("logging.sample.thereafter", pFlags.Lookup("logging-sample-thereafter"))
 	viper.BindPFlag("config", pFlags.Lookup("config"))
 
 	// Cobra also supports local flags, which will only run
@@ -95,6 +101,7 @@ func init() {
 	replacer := strings.NewReplacer(".", "_")
 	viper.SetEnvKeyReplacer(replacer)
 
+	setLogFormat()
 	loggingLevel := strings.ToUpper(viper.GetString("logging.level"))
 	if logLevel, err := logging.LogLevel(loggingLevel); err != nil {
 		panic(fmt.Errorf("Failed to load logging level: %s", err))
@@ -109,6 +116,15 @@ func init() {
 	})
 }
 
+// setLogFormat sets the json format when logging.format is json, and the sampling of the agent debug lines.
+// The level is set again after it as a new backend logs all levels.
+func setLogFormat() {
+	if strings.ToLower(viper.GetString("logging.format")) == "json" {
+		logging.SetBackend(logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", 0), util.JSONFormatter{}))
+	}
+	util.SetLogSampling(viper.GetInt("logging.sample.first"), viper.GetInt("logging.sample.thereafter"))
+}
+
 func initConfig() {
 
 }
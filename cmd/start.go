@@ -15,16 +15,23 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/yeasy/cmonit/agent"
 	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
 )
 
 // startCmd represents the start command
@@ -48,24 +55,128 @@ func init() {
 	// and all subcommands, e.g.:
 	// startCmd.PersistentFlags().String("foo", "", "A help for foo")
 	pFlags := startCmd.PersistentFlags()
+	pFlags.String("input-source", "mongo", "where to read hosts and clusters from: mongo, file or kubernetes")
+	pFlags.String("input-file-path", "", "path of the yaml/json inventory file, used when input source is file")
+	pFlags.String("input-kubernetes-url", "", "URL of the kubernetes API server, empty to use the in-cluster config")
+	pFlags.String("input-kubernetes-token_file", "", "file of the bearer token to access the API server")
+	pFlags.String("input-kubernetes-ca_file", "", "CA file to verify the API server")
+	pFlags.Bool("input-kubernetes-insecure", false, "skip verifying the API server certificate")
+	pFlags.String("input-kubernetes-namespace", "", "namespace of the pods to monitor, empty for all namespaces")
+	pFlags.String("input-kubernetes-label_selector", "monitor=true", "label selector of the pods to monitor")
+	pFlags.String("input-kubernetes-cluster_label", "", "label to group pods into clusters, empty to group by namespace")
+	pFlags.String("input-kubernetes-user_label", "user_id", "label of the cluster user")
+	pFlags.String("input-swarm-cluster_label", "com.docker.stack.namespace", "label of swarm services to group them into clusters, service name is used if not found")
+	pFlags.String("input-swarm-user_label", "user_id", "label of swarm services for the cluster user")
+	pFlags.String("input-swarm-daemon_port", "2375", "daemon port of the swarm nodes not found in the inventory")
+	pFlags.Bool("input-discovery-enabled", false, "whether to discover clusters from the container labels on each host")
+	pFlags.String("input-discovery-filter", "monitor=true", "comma separated label filters of the containers to discover")
+	pFlags.String("input-discovery-cluster_labels", "cluster_id,com.docker.compose.project", "comma separated labels to group containers into clusters, first found is used")
+	pFlags.String("input-discovery-name_label", "cluster_name", "label of the discovered cluster name")
+	pFlags.String("input-discovery-user_label", "user_id", "label of the discovered cluster user")
 	pFlags.String("input-mongo-url", "mongo:27017", "URL of the db API")
 	pFlags.String("input-mongo-db_name", "dev", "db name to use")
 	pFlags.String("input-mongo-col_host", "host", "name of the host info collection")
 	pFlags.String("input-mongo-col_cluster", "cluster_active", "name of the running cluster collection")
+	addMongoFlags(pFlags, "input")
 
 	pFlags.String("output-mongo-url", "", "URL of the db API")
 	pFlags.String("output-mongo-db_name", "monitor", "db name to use")
 	pFlags.String("output-mongo-col_host", "host", "name of the host info collection")
 	pFlags.String("output-mongo-col_cluster", "cluster", "name of the running cluster collection")
+	addMongoFlags(pFlags, "output")
+	pFlags.Int("output-mongo-batch-size", 500, "number of documents to write in one bulk insert, 1 to write each at once")
+	pFlags.Int("output-mongo-batch-interval", 1000, "Milliseconds to wait before writing a partial batch.")
 	pFlags.String("output-elasticsearch-url", "", "URL of the es API")
 	pFlags.String("output-elasticsearch-index", "monitor", "es index")
 
+	pFlags.String("docker-tls-mode", "", "TLS mode to the docker daemons: none, verify or insecure, empty to verify when any cert is given")
+	pFlags.String("docker-tls-ca_file", "", "CA file to verify the docker daemons")
+	pFlags.String("docker-tls-cert_file", "", "client cert file to the docker daemons")
+	pFlags.String("docker-tls-key_file", "", "client key file to the docker daemons")
+	pFlags.String("docker-ssh-identity_file", "", "identity file for the ssh:// docker daemons")
+	pFlags.Int("docker-ssh-timeout", 10, "Seconds to wait for the ssh tunnel ready.")
+	pFlags.Bool("docker-inspect-enabled", true, "whether to add the inspect metadata to the container stats")
+	pFlags.Int("docker-inspect-refresh", 60, "Seconds to cache the inspect of a container, it is also refreshed when the container restarts.")
+	pFlags.String("docker-inspect-labels", "cluster_id,user_id,com.docker.compose.project,com.docker.compose.service,com.docker.stack.namespace", "comma separated container labels to keep in the stats")
+
 	//pFlags.Int("sync-interval", 30, "Interval to sync the info from db.")
 
+	pFlags.String("output-mongo-col_baseline", "baseline", "name of the collection keeping the anomaly baselines")
+	pFlags.String("output-mongo-col_anomaly", "anomaly", "name of the anomaly collection")
+	pFlags.String("output-mongo-col_fleet", "fleet", "name of the fleet capacity collection")
+	pFlags.String("output-mongo-col_usage", "usage", "name of the daily usage collection")
+	pFlags.String("output-mongo-col_process", "process", "name of the container process collection")
+	pFlags.Bool("process-enabled", false, "whether to sample the top processes of each container")
+	pFlags.Int("process-interval", 300, "Seconds of interval to sample the processes of a container.")
+	pFlags.Int("process-top", 5, "number of processes to keep for each container")
+	pFlags.String("process-sort", "cpu", "sort the processes by cpu or rss")
+	pFlags.Bool("disk-enabled", false, "whether to collect the docker disk usage of the hosts and containers")
+	pFlags.Int("disk-interval", 600, "Seconds of interval to get the disk usage of a daemon.")
+	pFlags.Bool("logs-enabled", false, "whether to count the log lines of each container and match the logs.patterns")
+	pFlags.Int("logs-max_lines", 10000, "max log lines of a container to match each round, the rest are only counted")
+	pFlags.Bool("logs-forward", false, "whether to forward the matched log lines to the syslog log_server of the host")
+	pFlags.Bool("accounting-enabled", false, "whether to account the resource usage of each user per day")
+	pFlags.Float64("capacity-min_cpu_headroom", 10, "percent of cpu capacity to keep free on a host accepting new clusters")
+	pFlags.Float64("capacity-min_memory_headroom", 10, "percent of memory to keep free on a host accepting new clusters")
+	pFlags.Bool("anomaly-enabled", false, "whether to detect the anomalies against the baselines of container and cluster metrics")
+	pFlags.Float64("anomaly-alpha", 0.1, "weight of a new sample in the baseline")
+	pFlags.Float64("anomaly-sigmas", 3, "a sample beyond these standard deviations is a spike")
+	pFlags.Float64("anomaly-shift_sigmas", 1.5, "samples beyond these standard deviations on one side for shift_rounds are a shift")
+	pFlags.Int("anomaly-shift_rounds", 10, "rounds to report a shift, 0 to disable")
+	pFlags.Int("anomaly-warmup", 20, "samples to learn before reporting")
+	pFlags.Float64("anomaly-min_relative_stddev", 0.05, "floor of the standard deviation relative to the mean")
+	pFlags.Int("anomaly-save_interval", 300, "Seconds of interval to save the baselines.")
+	pFlags.Int("anomaly-baseline_expire", 7, "Days to keep the baselines not updated, -1 means never expire.")
+
+	pFlags.Bool("rollup-enabled", true, "whether to roll up the output stats into 1m, 1h and 1d collections")
+	pFlags.Int("rollup-delay", 60, "Seconds to wait for the late stats before rolling up a period.")
+	pFlags.Int("rollup-retention-1m", 30, "Days to keep the 1 minute rollups, -1 means never expire.")
+	pFlags.Int("rollup-retention-1h", 365, "Days to keep the 1 hour rollups, -1 means never expire.")
+	pFlags.Int("rollup-retention-1d", -1, "Days to keep the 1 day rollups, -1 means never expire.")
+
+	pFlags.Bool("forecast-enabled", false, "whether to write the capacity forecast reports periodically, needs rollup")
+	pFlags.String("forecast-method", "holt-winters", "method to fit the trends: linear or holt-winters")
+	pFlags.Int("forecast-interval", 24, "Hours of interval to write the forecast reports.")
+	pFlags.String("forecast-dir", "reports", "directory to write the forecast reports")
+	pFlags.Int("forecast-history", 14, "Days of the hourly rollups to fit the trends.")
+	pFlags.Int("forecast-horizon", 30, "Days to look ahead.")
+	pFlags.Float64("forecast-warning_days", 14, "days left to report a warning")
+	pFlags.Float64("forecast-critical_days", 3, "days left to report a critical")
+
 	pFlags.Int("monitor-expire", 7, "Days wait to expire the monitor data, -1 means never expire.")
 	pFlags.Int("monitor-interval", 30, "Seconds of interval to monitor.")
+	pFlags.String("admin-listen", "127.0.0.1:6060", "address to serve /metrics, /healthz and /readyz, empty to disable")
+	pFlags.Int("admin-max_round_age", 0, "Seconds since the last round before unhealthy, 0 means 3 monitor intervals.")
+	pFlags.Bool("admin-pprof", false, "whether to serve pprof under /debug/pprof/ on the admin listener")
+	pFlags.Bool("ha-enabled", false, "whether to collect only when holding the leader lease among the instances")
+	pFlags.String("ha-name", "cmonit", "name of the leader lease shared by the instances")
+	pFlags.String("ha-id", "", "id of the instance in the lease, default to hostname-pid")
+	pFlags.Int("ha-lease_ttl", 15, "Seconds before a standby takes over the lease not renewed.")
+	pFlags.String("ha-col", "lease", "name of the lease collection in the output db, or the input db without output")
+	pFlags.Bool("trace-enabled", false, "whether to trace each monitor round with spans")
+	pFlags.String("trace-exporter", "otlp", "where to export the spans: otlp or file")
+	pFlags.String("trace-endpoint", "http://localhost:4318/v1/traces", "OTLP/HTTP traces endpoint of the collector")
+	pFlags.String("trace-file", "cmonit-traces.json", "file to append the spans to with the file exporter")
 
 	// Use viper to track those flags
+	viper.BindPFlag("input.source", pFlags.Lookup("input-source"))
+	viper.BindPFlag("input.file.path", pFlags.Lookup("input-file-path"))
+	viper.BindPFlag("input.kubernetes.url", pFlags.Lookup("input-kubernetes-url"))
+	viper.BindPFlag("input.kubernetes.token_file", pFlags.Lookup("input-kubernetes-token_file"))
+	viper.BindPFlag("input.kubernetes.ca_file", pFlags.Lookup("input-kubernetes-ca_file"))
+	viper.BindPFlag("input.kubernetes.insecure", pFlags.Lookup("input-kubernetes-insecure"))
+	viper.BindPFlag("input.kubernetes.namespace", pFlags.Lookup("input-kubernetes-namespace"))
+	viper.BindPFlag("input.kubernetes.label_selector", pFlags.Lookup("input-kubernetes-label_selector"))
+	viper.BindPFlag("input.kubernetes.cluster_label", pFlags.Lookup("input-kubernetes-cluster_label"))
+	viper.BindPFlag("input.kubernetes.user_label", pFlags.Lookup("input-kubernetes-user_label"))
+	viper.BindPFlag("input.swarm.cluster_label", pFlags.Lookup("input-swarm-cluster_label"))
+	viper.BindPFlag("input.swarm.user_label", pFlags.Lookup("input-swarm-user_label"))
+	viper.BindPFlag("input.swarm.daemon_port", pFlags.Lookup("input-swarm-daemon_port"))
+	viper.BindPFlag("input.discovery.enabled", pFlags.Lookup("input-discovery-enabled"))
+	viper.BindPFlag("input.discovery.filter", pFlags.Lookup("input-discovery-filter"))
+	viper.BindPFlag("input.discovery.cluster_labels", pFlags.Lookup("input-discovery-cluster_labels"))
+	viper.BindPFlag("input.discovery.name_label", pFlags.Lookup("input-discovery-name_label"))
+	viper.BindPFlag("input.discovery.user_label", pFlags.Lookup("input-discovery-user_label"))
 	viper.BindPFlag("input.mongo.url", pFlags.Lookup("input-mongo-url"))
 	viper.BindPFlag("input.mongo.db_name", pFlags.Lookup("input-mongo-db_name"))
 	viper.BindPFlag("input.mongo.col_host", pFlags.Lookup("input-mongo-col_host"))
@@ -75,18 +186,124 @@ func init() {
 	viper.BindPFlag("output.mongo.db_name", pFlags.Lookup("output-mongo-db_name"))
 	viper.BindPFlag("output.mongo.col_host", pFlags.Lookup("output-mongo-col_host"))
 	viper.BindPFlag("output.mongo.col_cluster", pFlags.Lookup("output-mongo-col_cluster"))
+	viper.BindPFlag("output.mongo.batch.size", pFlags.Lookup("output-mongo-batch-size"))
+	viper.BindPFlag("output.mongo.batch.interval", pFlags.Lookup("output-mongo-batch-interval"))
 	viper.BindPFlag("output.elasticsearch.url", pFlags.Lookup("output-elasticsearch-url"))
 	viper.BindPFlag("output.elasticsearch.index", pFlags.Lookup("output-elasticsearch-index"))
 
+	viper.BindPFlag("docker.tls.mode", pFlags.Lookup("docker-tls-mode"))
+	viper.BindPFlag("docker.tls.ca_file", pFlags.Lookup("docker-tls-ca_file"))
+	viper.BindPFlag("docker.tls.cert_file", pFlags.Lookup("docker-tls-cert_file"))
+	viper.BindPFlag("docker.tls.key_file", pFlags.Lookup("docker-tls-key_file"))
+	viper.BindPFlag("docker.ssh.identity_file", pFlags.Lookup("docker-ssh-identity_file"))
+	viper.BindPFlag("docker.ssh.timeout", pFlags.Lookup("docker-ssh-timeout"))
+	viper.BindPFlag("docker.inspect.enabled", pFlags.Lookup("docker-inspect-enabled"))
+	viper.BindPFlag("docker.inspect.refresh", pFlags.Lookup("docker-inspect-refresh"))
+	viper.BindPFlag("docker.inspect.labels", pFlags.Lookup("docker-inspect-labels"))
+
+	viper.BindPFlag("output.mongo.col_fleet", pFlags.Lookup("output-mongo-col_fleet"))
+	viper.BindPFlag("output.mongo.col_usage", pFlags.Lookup("output-mongo-col_usage"))
+	viper.BindPFlag("output.mongo.col_process", pFlags.Lookup("output-mongo-col_process"))
+	for _, key := range []string{"enabled", "interval", "top", "sort"} {
+		viper.BindPFlag("process."+key, pFlags.Lookup("process-"+key))
+	}
+	viper.BindPFlag("disk.enabled", pFlags.Lookup("disk-enabled"))
+	viper.BindPFlag("disk.interval", pFlags.Lookup("disk-interval"))
+	for _, key := range []string{"enabled", "max_lines", "forward"} {
+		viper.BindPFlag("logs."+key, pFlags.Lookup("logs-"+key))
+	}
+	viper.BindPFlag("accounting.enabled", pFlags.Lookup("accounting-enabled"))
+	viper.BindPFlag("capacity.min_cpu_headroom", pFlags.Lookup("capacity-min_cpu_headroom"))
+	viper.BindPFlag("capacity.min_memory_headroom", pFlags.Lookup("capacity-min_memory_headroom"))
+	viper.BindPFlag("output.mongo.col_baseline", pFlags.Lookup("output-mongo-col_baseline"))
+	viper.BindPFlag("output.mongo.col_anomaly", pFlags.Lookup("output-mongo-col_anomaly"))
+	for _, key := range []string{"enabled", "alpha", "sigmas", "shift_sigmas", "shift_rounds", "warmup",
+		"min_relative_stddev", "save_interval", "baseline_expire"} {
+		viper.BindPFlag("anomaly."+key, pFlags.Lookup("anomaly-"+key))
+	}
+
+	viper.BindPFlag("rollup.enabled", pFlags.Lookup("rollup-enabled"))
+	viper.BindPFlag("rollup.delay", pFlags.Lookup("rollup-delay"))
+	viper.BindPFlag("rollup.retention.1m", pFlags.Lookup("rollup-retention-1m"))
+	viper.BindPFlag("rollup.retention.1h", pFlags.Lookup("rollup-retention-1h"))
+	viper.BindPFlag("rollup.retention.1d", pFlags.Lookup("rollup-retention-1d"))
+
+	for _, key := range []string{"enabled", "method", "interval", "dir", "history", "horizon", "warning_days", "critical_days"} {
+		viper.BindPFlag("forecast."+key, pFlags.Lookup("forecast-"+key))
+	}
+
 	viper.BindPFlag("monitor.expire", pFlags.Lookup("monitor-expire"))
 	viper.BindPFlag("monitor.interval", pFlags.Lookup("monitor-interval"))
+	for _, key := range []string{"listen", "max_round_age", "pprof"} {
+		viper.BindPFlag("admin."+key, pFlags.Lookup("admin-"+key))
+	}
+	for _, key := range []string{"enabled", "name", "id", "lease_ttl", "col"} {
+		viper.BindPFlag("ha."+key, pFlags.Lookup("ha-"+key))
+	}
+	for _, key := range []string{"enabled", "exporter", "endpoint", "file"} {
+		viper.BindPFlag("trace."+key, pFlags.Lookup("trace-"+key))
+	}
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// startCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// addMongoFlags adds the flags of the connection options for the <prefix>.mongo db.
+// The password is only read from the config file or the password file.
+func addMongoFlags(pFlags *pflag.FlagSet, prefix string) {
+	p := prefix + "-mongo-"
+	pFlags.String(p+"username", "", "username to authenticate with the db")
+	pFlags.String(p+"password_file", "", "file with the password of the db user")
+	pFlags.String(p+"auth_db", "", "db to authenticate against, default to the db in url or admin")
+	pFlags.String(p+"replica_set", "", "name of the db replica set")
+	pFlags.Bool(p+"tls-enabled", false, "whether to connect the db with TLS")
+	pFlags.String(p+"tls-ca_file", "", "CA file to verify the db servers")
+	pFlags.String(p+"tls-cert_file", "", "client cert file to the db servers")
+	pFlags.String(p+"tls-key_file", "", "client key file to the db servers")
+	pFlags.Bool(p+"tls-insecure", false, "skip verifying the db servers")
+	pFlags.String(p+"write_concern-w", "", "nodes to acknowledge the writes: a number, majority or a tag")
+	pFlags.Bool(p+"write_concern-j", false, "wait for the writes to be journaled")
+	pFlags.Int(p+"write_concern-timeout", 0, "Milliseconds to wait for the write concern, 0 for no limit.")
+	pFlags.String(p+"read_preference", "primaryPreferred", "primary, primaryPreferred, secondaryPreferred or nearest")
+	pFlags.Int(p+"timeout-dial", 5, "Seconds to wait for reaching the db.")
+	pFlags.Int(p+"timeout-socket", 60, "Seconds to wait for each db operation.")
+
+	for _, key := range []string{"username", "password_file", "auth_db", "replica_set",
+		"tls.enabled", "tls.ca_file", "tls.cert_file", "tls.key_file", "tls.insecure",
+		"write_concern.w", "write_concern.j", "write_concern.timeout",
+		"read_preference", "timeout.dial", "timeout.socket"} {
+		viper.BindPFlag(prefix+".mongo."+key, pFlags.Lookup(p+strings.Replace(key, ".", "-", -1)))
+	}
+}
+
+// mongoConfig returns the connection config of the <prefix>.mongo db
+func mongoConfig(prefix string) *data.DBConfig {
+	p := prefix + ".mongo."
+	return &data.DBConfig{
+		URL:            viper.GetString(p + "url"),
+		Name:           viper.GetString(p + "db_name"),
+		Username:       viper.GetString(p + "username"),
+		Password:       viper.GetString(p + "password"),
+		PasswordFile:   viper.GetString(p + "password_file"),
+		AuthDB:         viper.GetString(p + "auth_db"),
+		ReplicaSet:     viper.GetString(p + "replica_set"),
+		TLS:            viper.GetBool(p + "tls.enabled"),
+		TLSCA:          viper.GetString(p + "tls.ca_file"),
+		TLSCert:        viper.GetString(p + "tls.cert_file"),
+		TLSKey:         viper.GetString(p + "tls.key_file"),
+		TLSInsecure:    viper.GetBool(p + "tls.insecure"),
+		WriteConcern:   viper.GetString(p + "write_concern.w"),
+		Journal:        viper.GetBool(p + "write_concern.j"),
+		WriteTimeout:   time.Duration(viper.GetInt(p+"write_concern.timeout")) * time.Millisecond,
+		ReadPreference: viper.GetString(p + "read_preference"),
+		DialTimeout:    time.Duration(viper.GetInt(p+"timeout.dial")) * time.Second,
+		SocketTimeout:  time.Duration(viper.GetInt(p+"timeout.socket")) * time.Second,
+	}
+}
+
 func serve(args []string) error {
 
+	setLogFormat()
 	loggingLevel := strings.ToUpper(viper.GetString("logging.level"))
 	if logLevel, err := logging.LogLevel(loggingLevel); err != nil {
 		panic(fmt.Errorf("Failed to load logging level: %s", err))
@@ -99,24 +316,42 @@ func serve(args []string) error {
 		logger.Debugf("%s = %v\n", k, viper.Get(k))
 	}
 
-	//open and init input db
-	input := new(data.DB)
+	// check the db configs before connecting anything
+	inputConf, outputConf := mongoConfig("input"), mongoConfig("output")
+	if source := strings.ToLower(viper.GetString("input.source")); source == "" || source == "mongo" {
+		if err := inputConf.Validate(); err != nil {
+			logger.Error("Invalid input.mongo config")
+			return err
+		}
+	}
+	if outputConf.URL != "" {
+		if err := outputConf.Validate(); err != nil {
+			logger.Error("Invalid output.mongo config")
+			return err
+		}
+	}
+
+	//open and init input inventory
+	input, err := openInventory(inputConf)
+	if err != nil {
+		return err
+	}
 	defer input.Close()
-	if err := input.Init(viper.GetString("input.mongo.url"), viper.GetString("input.mongo.db_name")); err != nil {
-		logger.Errorf("Cannot init input db with %s\n", viper.GetString("input.mongo.url"))
+
+	if viper.GetString("admin.listen") != "" {
+		go adminServer(input)
+	}
+	if err := setTracer(); err != nil {
 		return err
 	}
-	input.SetCol("host", viper.GetString("input.mongo.col_host"))
-	input.SetCol("cluster", viper.GetString("input.mongo.col_cluster"))
-	logger.Debugf("Inited input DB session: %s %s", viper.GetString("input.mongo.url"), viper.GetString("input.mongo.db_name"))
 
 	//open and init output db
 	var output *data.DB
-	outputURL, outputDB := viper.GetString("output.mongo.url"), viper.GetString("output.mongo.db_name")
+	outputURL, outputDB := outputConf.URL, outputConf.Name
 	if outputURL != "" {
 		output = new(data.DB)
 		defer output.Close()
-		if err := output.Init(outputURL, outputDB); err != nil {
+		if err := output.Init(outputConf); err != nil {
 			logger.Errorf("Cannot init output db with %s\n", outputURL)
 			return err
 		}
@@ -124,12 +359,75 @@ func serve(args []string) error {
 		output.SetCol("host", viper.GetString("output.mongo.col_host"))
 		output.SetCol("cluster", viper.GetString("output.mongo.col_cluster"))
 		output.SetCol("container", viper.GetString("output.mongo.col_container"))
+		output.SetCol("fleet", viper.GetString("output.mongo.col_fleet"))
 		output.SetIndex("host", "host_id", viper.GetInt("monitor.expire"))
 		output.SetIndex("cluster", "cluster_id", viper.GetInt("monitor.expire"))
 		output.SetIndex("container", "container_id", viper.GetInt("monitor.expire"))
+		output.SetIndex("fleet", "timestamp", viper.GetInt("monitor.expire"))
+		if viper.GetBool("process.enabled") {
+			output.SetCol("process", viper.GetString("output.mongo.col_process"))
+			output.SetIndex("process", "timestamp", viper.GetInt("monitor.expire"))
+			output.SetCompoundIndex("process", "container_id", "timestamp")
+		}
+		output.SetBatch(viper.GetInt("output.mongo.batch.size"), time.Duration(viper.GetInt("output.mongo.batch.interval"))*time.Millisecond)
 		logger.Debugf("Inited output DB session: %s %s", outputURL, outputDB)
 	}
 
+	// only the leader collects and writes in the ha mode
+	if viper.GetBool("ha.enabled") {
+		if lease, err = openLease(input, output); err != nil {
+			logger.Error("Cannot init the leader lease")
+			return err
+		}
+		go leaseTask(lease)
+	}
+
+	if output != nil {
+		if viper.GetBool("rollup.enabled") {
+			rollups, err := openRollups(output)
+			if err != nil {
+				logger.Error("Cannot init the rollup of output db")
+				return err
+			}
+			go rollupTask(rollups)
+		}
+
+		if viper.GetBool("forecast.enabled") {
+			if !viper.GetBool("rollup.enabled") {
+				return fmt.Errorf("forecast.enabled needs rollup.enabled")
+			}
+			forecaster, err := openForecaster(output)
+			if err != nil {
+				logger.Error("Cannot init the capacity forecast")
+				return err
+			}
+			go forecastTask(forecaster)
+		}
+
+		if viper.GetBool("anomaly.enabled") {
+			detector, err := openDetector(output)
+			if err != nil {
+				logger.Error("Cannot init the anomaly detection")
+				return err
+			}
+			agent.SetDetector(detector)
+			go baselineTask(detector)
+		}
+
+		if viper.GetBool("accounting.enabled") {
+			output.SetCol("usage", viper.GetString("output.mongo.col_usage"))
+			interval := time.Duration(viper.GetInt("monitor.interval")) * time.Second
+			accountant := &data.Accountant{Interval: interval, MaxGap: 3 * interval}
+			if err := accountant.Init(output, "usage"); err != nil {
+				logger.Error("Cannot init the usage accounting")
+				return err
+			}
+			agent.SetAccountant(accountant)
+		}
+	}
+
+	go exitOnSignal(output)
+
 	// period monitor container stats and write into db
 	monitTask(input, output)
 
@@ -141,8 +439,234 @@ func serve(args []string) error {
 	return nil
 }
 
+// endRound ends the span of the round and exports the spans of it
+func endRound(round *util.Span) {
+	round.Finish()
+	util.SetRoundSpan(nil)
+	if err := util.FlushSpans(); err != nil {
+		logger.Warningf("Failed to export the spans of the round: %v\n", err)
+	}
+}
+
+// exitOnSignal saves the usage and the documents queued, and stops the ssh tunnels
+// opened to the daemons before the process exits
+func exitOnSignal(output *data.DB) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	logger.Infof("Received signal %s, exit\n", sig)
+	if err := agent.FlushUsage(); err != nil {
+		logger.Warningf("Failed to save the usage at exit: %v\n", err)
+	}
+	if output != nil {
+		if err := output.Flush(); err != nil {
+			logger.Warningf("Failed to write some data at exit: %v\n", err)
+		}
+	}
+	agent.CloseSSHTunnels()
+	os.Exit(0)
+}
+
+// setTracer exports the spans of each round when trace.enabled
+func setTracer() error {
+	if !viper.GetBool("trace.enabled") {
+		return nil
+	}
+	switch exporter := strings.ToLower(viper.GetString("trace.exporter")); exporter {
+	case "", "otlp":
+		util.SetTracer(&util.OTLPExporter{Endpoint: viper.GetString("trace.endpoint")})
+		logger.Infof("Exporting the spans to %s\n", viper.GetString("trace.endpoint"))
+	case "file":
+		util.SetTracer(&util.FileExporter{Path: viper.GetString("trace.file")})
+		logger.Infof("Exporting the spans to file %s\n", viper.GetString("trace.file"))
+	default:
+		return fmt.Errorf("Unknown trace.exporter %s", exporter)
+	}
+	return nil
+}
+
+// openInventory will open the source of hosts and clusters to monitor
+func openInventory(mongoConf *data.DBConfig) (data.Inventory, error) {
+	switch source := strings.ToLower(viper.GetString("input.source")); source {
+	case "", "mongo":
+		input := new(data.DB)
+		if err := input.Init(mongoConf); err != nil {
+			logger.Errorf("Cannot init input db with %s\n", viper.GetString("input.mongo.url"))
+			return nil, err
+		}
+		input.SetCol("host", viper.GetString("input.mongo.col_host"))
+		input.SetCol("cluster", viper.GetString("input.mongo.col_cluster"))
+		logger.Debugf("Inited input DB session: %s %s", viper.GetString("input.mongo.url"), viper.GetString("input.mongo.db_name"))
+		return input, nil
+	case "file":
+		input := new(data.FileInventory)
+		if err := input.Init(viper.GetString("input.file.path")); err != nil {
+			logger.Errorf("Cannot init input file with %s\n", viper.GetString("input.file.path"))
+			return nil, err
+		}
+		logger.Debugf("Inited input file: %s", viper.GetString("input.file.path"))
+		return input, nil
+	case "kubernetes":
+		kube := new(data.KubeClient)
+		if err := kube.Init(viper.GetString("input.kubernetes.url"), viper.GetString("input.kubernetes.token_file"),
+			viper.GetString("input.kubernetes.ca_file"), viper.GetBool("input.kubernetes.insecure")); err != nil {
+			logger.Errorf("Cannot init kubernetes client with %s\n", viper.GetString("input.kubernetes.url"))
+			return nil, err
+		}
+		input := new(data.KubeInventory)
+		if err := input.Init(kube, viper.GetString("input.kubernetes.namespace"), viper.GetString("input.kubernetes.label_selector"),
+			viper.GetString("input.kubernetes.cluster_label"), viper.GetString("input.kubernetes.user_label")); err != nil {
+			return nil, err
+		}
+		logger.Debugf("Inited input kubernetes: %s", kube.URL)
+		return input, nil
+	default:
+		return nil, fmt.Errorf("Unknown input source %s", source)
+	}
+}
+
+// openRollups prepares the rollup of the host, cluster and container stats
+func openRollups(output *data.DB) ([]*data.Rollup, error) {
+	levels := []data.RollupLevel{
+		{Name: "1m", Period: time.Minute, Retention: viper.GetInt("rollup.retention.1m")},
+		{Name: "1h", Period: time.Hour, Retention: viper.GetInt("rollup.retention.1h")},
+		{Name: "1d", Period: 24 * time.Hour, Retention: viper.GetInt("rollup.retention.1d")},
+	}
+	rollups := []*data.Rollup{}
+	for _, c := range []struct{ key, idField string }{
+		{"host", "host_id"},
+		{"cluster", "cluster_id"},
+		{"container", "container_id"},
+	} {
+		colName := viper.GetString("output.mongo.col_" + c.key)
+		if colName == "" {
+			continue
+		}
+		r := new(data.Rollup)
+		if err := r.Init(output, c.key, colName, c.idField, levels); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, nil
+}
+
+// rollupTask rolls up the finished periods every minute
+func rollupTask(rollups []*data.Rollup) {
+	for {
+		start := time.Now()
+		delay := time.Duration(viper.GetInt("rollup.delay")) * time.Second
+		for _, r := range rollups {
+			if !leading() {
+				break
+			}
+			if err := r.Run(start.UTC(), delay); err != nil {
+				logger.Warning("Failed to roll up stats")
+				logger.Error(err)
+			}
+		}
+		logger.Debugf("Rollup task used %s\n", time.Since(start))
+		time.Sleep(time.Minute - time.Since(start)%time.Minute)
+	}
+}
+
+// forecastTask writes the forecast reports periodically
+func forecastTask(forecaster *data.Forecaster) {
+	for {
+		interval := time.Duration(viper.GetInt("forecast.interval")) * time.Hour
+		if interval <= 0 {
+			interval = 24 * time.Hour
+		}
+		if !leading() {
+			time.Sleep(time.Minute)
+			continue
+		}
+		report, err := forecaster.Run(time.Now())
+		if err == nil {
+			err = writeForecast(report, viper.GetString("forecast.dir"))
+		}
+		if err != nil {
+			logger.Warning("Failed to write the forecast report")
+			logger.Error(err)
+		} else {
+			logger.Infof("Wrote forecast report of %d usages into %s\n", len(report.Forecasts), viper.GetString("forecast.dir"))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// fleetMembers returns the capacity of the hosts in the round, a host failed to init is unreachable
+func fleetMembers(hosts *[]data.Host, hms map[string]*agent.HostMonitor) []data.FleetHost {
+	members := make([]data.FleetHost, 0, len(*hosts))
+	for _, h := range *hosts {
+		if hm, ok := hms[h.DaemonURL]; ok {
+			members = append(members, hm.Capacity())
+		} else { // failed to init
+			members = append(members, data.FleetHost{HostID: h.ID, HostName: h.Name, Status: "unreachable"})
+		}
+	}
+	return members
+}
+
+// unreachableHosts returns the names of the hosts not reached in the round, and counts them in the self metrics
+func unreachableHosts(members []data.FleetHost) []string {
+	names := []string{}
+	for _, m := range members {
+		if m.Status == "unreachable" {
+			names = append(names, m.HostName)
+			util.AddCounter(util.MetricName("monit_host_failures_total", "host", m.HostName), 1)
+		}
+	}
+	return names
+}
+
+// saveFleet writes the capacity of all hosts in the round, traced under the span
+func saveFleet(members []data.FleetHost, output *data.DB, span *util.Span) {
+	fleet := data.CalculateFleet(members)
+	logger.Infof("===Fleet: %d/%d hosts accepting new clusters, %d clusters used\n", fleet.AcceptingHosts, fleet.Hosts, fleet.ClustersUsed)
+	output.SaveDataSpan(fleet, "fleet", span)
+}
+
+// openDetector prepares the anomaly detection with the baselines saved in output db
+func openDetector(output *data.DB) (*data.Detector, error) {
+	output.SetCol("baseline", viper.GetString("output.mongo.col_baseline"))
+	output.SetCol("anomaly", viper.GetString("output.mongo.col_anomaly"))
+	output.SetIndex("baseline", "updated_at", viper.GetInt("anomaly.baseline_expire"))
+	output.SetIndex("anomaly", "timestamp", viper.GetInt("monitor.expire"))
+	detector := &data.Detector{
+		Alpha:             viper.GetFloat64("anomaly.alpha"),
+		Sigmas:            viper.GetFloat64("anomaly.sigmas"),
+		ShiftSigmas:       viper.GetFloat64("anomaly.shift_sigmas"),
+		ShiftRounds:       viper.GetInt("anomaly.shift_rounds"),
+		Warmup:            viper.GetInt("anomaly.warmup"),
+		MinRelativeStdDev: viper.GetFloat64("anomaly.min_relative_stddev"),
+	}
+	if err := detector.Init(output, "baseline", "anomaly"); err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+// baselineTask saves the updated baselines periodically
+func baselineTask(detector *data.Detector) {
+	for {
+		interval := time.Duration(viper.GetInt("anomaly.save_interval")) * time.Second
+		if interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		time.Sleep(interval)
+		if !leading() {
+			continue
+		}
+		if err := detector.Save(); err != nil {
+			logger.Warning("Failed to save the baselines")
+			logger.Error(err)
+		}
+	}
+}
+
 // main process will be done within the function
-func monitTask(input, output *data.DB) {
+func monitTask(input data.Inventory, output *data.DB) {
 	var (
 		hosts *[]data.Host
 		err   error
@@ -152,19 +676,35 @@ func monitTask(input, output *data.DB) {
 
 	for {
 		interval := time.Duration(viper.GetInt("monitor.interval"))
+		if !leading() {
+			current, _ := lease.Current()
+			logger.Debugf("Standby, the leader of %s is %s\n", current.Name, current.Holder)
+			time.Sleep(lease.TTL / 3)
+			continue
+		}
 		logger.Infof(">>>Start monitor task, interval = %d seconds\n", interval)
 
 		//first sync info
 		syncStart := time.Now()
-		if hosts, err = input.GetHosts(); err != nil {
+		roundID := syncStart.UTC().Format("20060102T150405")
+		util.SetLogRound(roundID)
+		round := util.StartSpan(nil, "monit_round", "round_id", roundID)
+		util.SetRoundSpan(round)
+		syncSpan := util.StartSpan(round, "inventory.get_hosts")
+		hosts, err = input.GetHosts()
+		syncSpan.SetError(err)
+		syncSpan.Finish()
+		if err != nil {
 			logger.Warning("<<<Failed to sync host info")
 			logger.Error(err)
+			round.SetError(err)
+			endRound(round)
 			time.Sleep(interval * time.Second)
 
 			if err = input.ReDial(); err != nil {
-				logger.Errorf("Failed to redial db url=%s\n", input.URL)
+				logger.Error("Failed to redial input")
 			}
-			logger.Infof("Redialed db=%s\n", input.URL)
+			logger.Info("Redialed input")
 
 			/*
 				logger.Infof("Redialed db=%s\n", output.URL)
@@ -178,30 +718,45 @@ func monitTask(input, output *data.DB) {
 		lenHosts := len(*hosts)
 		logger.Infof("===Synced task done: %d hosts found\n", lenHosts)
 		logger.Debugf("%+v\n", *hosts)
+		round.SetAttr("hosts", lenHosts)
 
 		if lenHosts <= 0 {
 			logger.Info("No monit will be started without hosts")
+			roundDone(syncStart, time.Now())
+			endRound(round)
 			time.Sleep(interval * time.Second)
 			continue
 		}
 
 		//now collect data
 		monitStart := time.Now()
-		c := make(chan string)
+		// each host sends its name once, even before the reader starts
+		c := make(chan string, lenHosts)
+		var hmsMutex sync.Mutex
 		for i := 0; i < lenHosts; i++ {
 			h := (*hosts)[i]
 			logger.Debugf("Monit task [%d/%d]: start for host=%s", i, lenHosts, h.Name)
-			if _, ok := hms[h.DaemonURL]; !ok { //not see the host before
+			hmsMutex.Lock()
+			hm, ok := hms[h.DaemonURL]
+			hmsMutex.Unlock()
+			if ok {
+				go hm.Monit(h, input, output, c)
+				continue
+			}
+			//not see the host before, init it without waiting for the others
+			go func(h data.Host) {
 				hm := new(agent.HostMonitor)
 				if err := hm.Init(&h, input, output, viper.GetString("output.mongo.col_host")); err != nil {
 					logger.Warningf("<<Fail to init host %s", h.Name)
 					c <- h.Name
-					continue
+					return
 				}
 				logger.Infof("create new hm for host=%s\n", h.Name)
+				hmsMutex.Lock()
 				hms[h.DaemonURL] = hm
-			}
-			go hms[h.DaemonURL].Monit(h, input, output, c)
+				hmsMutex.Unlock()
+				hm.Monit(h, input, output, c)
+			}(h)
 		}
 
 		number := 0
@@ -215,13 +770,47 @@ func monitTask(input, output *data.DB) {
 				break
 			}
 		}
+		members := fleetMembers(hosts, hms)
+		failed := unreachableHosts(members)
+		round.SetAttr("failed_hosts", len(failed))
+		// write the rest of the round
+		if output != nil {
+			flush := util.StartSpan(round, "round.flush")
+			saveFleet(members, output, flush)
+			if err := agent.FlushUsage(); err != nil {
+				logger.Warningf("Failed to save the usage of the round: %v\n", err)
+				flush.SetError(err)
+			}
+			if err := output.FlushSpan(flush); err != nil {
+				logger.Warningf("Failed to write some data of the round: %v\n", err)
+				flush.SetError(err)
+			}
+			flush.Finish()
+		}
 		monitEnd := time.Now()
 		monitTime := monitEnd.Sub(monitStart)
+		// the round is not healthy when no host could be reached
+		if len(failed) >= lenHosts {
+			logger.Warningf("<<<No host reached in the round, failed hosts = %v\n", failed)
+			round.SetError(errors.New("No host reached"))
+		} else {
+			if len(failed) > 0 {
+				logger.Warningf("===Monit task: %d/%d hosts not reached = %v\n", len(failed), lenHosts, failed)
+			}
+			roundDone(syncStart, monitEnd)
+		}
+		endRound(round)
 
 		//runtime.GC()
 
 		runtime.ReadMemStats(&mem)
 		logger.Infof("<<<End monitor task. sync used %s, monit used %s, interval=%d seconds. Memory usage = %d KB.\n\n", syncTime, monitTime, interval, mem.Alloc/1024)
+		if logger.IsEnabledFor(logging.DEBUG) {
+			metrics := util.MetricsSnapshot()
+			for _, name := range util.SortedMetricNames(metrics) {
+				logger.Debugf("self metric %s = %g\n", name, metrics[name])
+			}
+		}
 		time.Sleep(interval * time.Second)
 	}
 }
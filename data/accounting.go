@@ -0,0 +1,236 @@
+package data
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UsageDayFormat is the format of the day in the usage records, in UTC
+const UsageDayFormat = "2006-01-02"
+
+// UsageUnassigned is the user of the clusters without one
+const UsageUnassigned = "unassigned"
+
+// UsageRecord is a document of the resource usage of a user in a day
+type UsageRecord struct {
+	UserID         string    `bson:"user_id" json:"user_id"`
+	Day            string    `bson:"day" json:"day"`
+	CPUSeconds     float64   `bson:"cpu_seconds" json:"cpu_seconds"` // one busy cpu for one second
+	MemoryGBHours  float64   `bson:"memory_gb_hours" json:"memory_gb_hours"`
+	NetworkRxBytes float64   `bson:"network_rx_bytes" json:"network_rx_bytes"`
+	NetworkTxBytes float64   `bson:"network_tx_bytes" json:"network_tx_bytes"`
+	ClusterHours   float64   `bson:"cluster_hours" json:"cluster_hours"`
+	UpdatedAt      time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// clusterSample is the last cluster stat counted
+type clusterSample struct {
+	timestamp time.Time
+	networkRx float64
+	networkTx float64
+}
+
+// Accountant integrates the cluster stats over time into the usage of each user per day.
+// The usage is kept in memory and added to the saved records at Flush.
+type Accountant struct {
+	Interval time.Duration // counted for the first sample of a cluster
+	MaxGap   time.Duration // longest time counted between two samples, as the cluster may be gone in between
+
+	db      *DB
+	colKey  string
+	mutex   sync.Mutex
+	last    map[string]clusterSample // cluster id -> last sample
+	pending map[string]*UsageRecord  // user/day -> usage not saved
+}
+
+// Init will set the collection to save the usage records, db is nil for only counting in memory
+func (a *Accountant) Init(db *DB, colKey string) error {
+	a.db, a.colKey = db, colKey
+	a.last = make(map[string]clusterSample)
+	a.pending = make(map[string]*UsageRecord)
+	if db == nil {
+		return nil
+	}
+	c, ok := db.cols[colKey]
+	if !ok {
+		return errors.New("Cannot reach db collection " + colKey)
+	}
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"user_id", "day"}, Unique: true, Background: true}); err != nil {
+		logger.Warningf("Failed to set index on collection %s\n", colKey)
+		return err
+	}
+	return nil
+}
+
+// Observe counts the usage of the cluster since its last stat
+func (a *Accountant) Observe(s *ClusterStat) {
+	if s == nil || s.ClusterID == "" {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.last == nil {
+		a.last = make(map[string]clusterSample)
+		a.pending = make(map[string]*UsageRecord)
+	}
+	ts := s.TimeStamp.UTC()
+	duration := a.Interval
+	// the network stats are counters since the containers start, they may be counted
+	// by another instance or before a restart, so only the increase from a known sample is billed
+	var rx, tx float64
+	if last, ok := a.last[s.ClusterID]; ok {
+		if !ts.After(last.timestamp) {
+			return
+		}
+		duration = ts.Sub(last.timestamp)
+		rx, tx = counterDelta(last.networkRx, s.NetworkRx), counterDelta(last.networkTx, s.NetworkTx)
+	}
+	a.last[s.ClusterID] = clusterSample{timestamp: ts, networkRx: s.NetworkRx, networkTx: s.NetworkTx}
+	if a.MaxGap > 0 && duration > a.MaxGap {
+		duration = a.MaxGap
+	}
+
+	user := s.UserID
+	if user == "" {
+		user = UsageUnassigned
+	}
+	day := ts.Format(UsageDayFormat)
+	key := user + "/" + day
+	r, ok := a.pending[key]
+	if !ok {
+		r = &UsageRecord{UserID: user, Day: day}
+		a.pending[key] = r
+	}
+	seconds := duration.Seconds()
+	r.CPUSeconds += s.CPUDistribution.Sum / 100.0 * seconds
+	r.MemoryGBHours += s.Memory / (1 << 30) * seconds / 3600.0
+	r.NetworkRxBytes += rx
+	r.NetworkTxBytes += tx
+	r.ClusterHours += seconds / 3600.0
+	r.UpdatedAt = ts
+}
+
+// counterDelta returns the increase of a counter, which restarts from 0 with the container
+func counterDelta(last, current float64) float64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// Pending returns the usage not saved yet, by user and day
+func (a *Accountant) Pending() []UsageRecord {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	result := make([]UsageRecord, 0, len(a.pending))
+	for _, r := range a.pending {
+		result = append(result, *r)
+	}
+	sort.Sort(usageByUserDay(result))
+	return result
+}
+
+// Flush adds the pending usage into the saved records
+func (a *Accountant) Flush() error {
+	records := a.Pending()
+	a.mutex.Lock()
+	a.pending = make(map[string]*UsageRecord)
+	a.mutex.Unlock()
+	if a.db == nil || len(records) == 0 {
+		return nil
+	}
+	if a.db.session == nil {
+		return errors.New("db session is nil")
+	}
+	token, err := a.db.fenced()
+	if err != nil { // counted by the leader
+		logger.Debugf("Skip saving %d usage records: %v\n", len(records), err)
+		return err
+	}
+	c, ok := a.db.cols[a.colKey]
+	if !ok {
+		return errors.New("Cannot reach db collection " + a.colKey)
+	}
+	for i, r := range records {
+		set := bson.M{"updated_at": r.UpdatedAt}
+		if token != 0 {
+			set[LeaseTokenField] = token
+		}
+		_, err := c.Upsert(bson.M{"user_id": r.UserID, "day": r.Day}, bson.M{
+			"$inc": bson.M{
+				"cpu_seconds":      r.CPUSeconds,
+				"memory_gb_hours":  r.MemoryGBHours,
+				"network_rx_bytes": r.NetworkRxBytes,
+				"network_tx_bytes": r.NetworkTxBytes,
+				"cluster_hours":    r.ClusterHours,
+			},
+			"$set": set,
+		})
+		if err != nil {
+			logger.Warningf("Failed to save usage of user %s on %s\n", r.UserID, r.Day)
+			// add the rest back to count them next time
+			a.mutex.Lock()
+			for _, rest := range records[i:] {
+				a.merge(rest)
+			}
+			a.mutex.Unlock()
+			return err
+		}
+	}
+	logger.Debugf("Saved %d usage records\n", len(records))
+	return nil
+}
+
+// merge adds the record back to the pending usage
+func (a *Accountant) merge(r UsageRecord) {
+	key := r.UserID + "/" + r.Day
+	p, ok := a.pending[key]
+	if !ok {
+		a.pending[key] = &r
+		return
+	}
+	p.CPUSeconds += r.CPUSeconds
+	p.MemoryGBHours += r.MemoryGBHours
+	p.NetworkRxBytes += r.NetworkRxBytes
+	p.NetworkTxBytes += r.NetworkTxBytes
+	p.ClusterHours += r.ClusterHours
+	if r.UpdatedAt.After(p.UpdatedAt) {
+		p.UpdatedAt = r.UpdatedAt
+	}
+}
+
+// GetUsage retrieve the usage records of the days in [from, to] from db's collection
+func (db *DB) GetUsage(colName string, from, to time.Time) ([]UsageRecord, error) {
+	if db.session == nil {
+		logger.Error("db session is nil")
+		return nil, errors.New("db session is nil")
+	}
+	c, ok := db.cols[colName]
+	if !ok {
+		logger.Warningf("collection handler %s is nil, should init first.\n", colName)
+		return nil, errors.New("Cannot reach db collection " + colName)
+	}
+	var records []UsageRecord
+	query := bson.M{"day": bson.M{"$gte": from.UTC().Format(UsageDayFormat), "$lte": to.UTC().Format(UsageDayFormat)}}
+	if err := c.Find(query).Sort("user_id", "day").All(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// usageByUserDay sorts the records by user and day
+type usageByUserDay []UsageRecord
+
+func (s usageByUserDay) Len() int      { return len(s) }
+func (s usageByUserDay) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s usageByUserDay) Less(i, j int) bool {
+	if s[i].UserID != s[j].UserID {
+		return s[i].UserID < s[j].UserID
+	}
+	return s[i].Day < s[j].Day
+}
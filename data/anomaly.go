@@ -0,0 +1,203 @@
+package data
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Reasons of the anomalies
+const (
+	AnomalySpike = "spike" // a sample beyond k sigmas of the baseline
+	AnomalyShift = "shift" // samples stay on one side of the baseline for rounds
+)
+
+// Baseline is the exponentially weighted mean and variance of a metric
+type Baseline struct {
+	_ID       bson.ObjectId `bson:"_id,omitempty"`
+	Key       string        `bson:"key"`  // kind/id/metric
+	Kind      string        `bson:"kind"` // container or cluster
+	ID        string        `bson:"id"`
+	Metric    string        `bson:"metric"`
+	Mean      float64       `bson:"mean"`
+	Variance  float64       `bson:"variance"`
+	Samples   int           `bson:"samples"`
+	Shift     int           `bson:"shift"` // consecutive samples beyond the shift sigmas, negative for below the mean
+	UpdatedAt time.Time     `bson:"updated_at"`
+}
+
+// Anomaly is a document of a sample out of the baseline
+type Anomaly struct {
+	_ID       bson.ObjectId `bson:"_id,omitempty"`
+	Kind      string        `bson:"kind,omitempty"`
+	ID        string        `bson:"id,omitempty"`
+	Name      string        `bson:"name,omitempty"`
+	Metric    string        `bson:"metric,omitempty"`
+	Reason    string        `bson:"reason,omitempty"`
+	Value     float64       `bson:"value"`
+	Mean      float64       `bson:"mean"`
+	StdDev    float64       `bson:"stddev"`
+	Score     float64       `bson:"score"` // sigmas away from the mean
+	TimeStamp time.Time     `bson:"timestamp,omitempty"`
+}
+
+// Detector keeps the baselines of the metrics over the rounds, and reports the
+// samples beyond Sigmas, or beyond ShiftSigmas on the same side for ShiftRounds.
+type Detector struct {
+	Alpha             float64 // weight of a new sample in the baseline
+	Sigmas            float64
+	ShiftSigmas       float64
+	ShiftRounds       int
+	Warmup            int     // samples to learn before reporting
+	MinRelativeStdDev float64 // floor of the stddev relative to the mean, so a flat metric is not too sensitive
+
+	db          *DB
+	baselineCol string
+	anomalyCol  string
+	mutex       sync.Mutex
+	baselines   map[string]*Baseline
+	dirty       map[string]bool
+}
+
+// Init loads the saved baselines from the collections set in db
+func (d *Detector) Init(db *DB, baselineCol, anomalyCol string) error {
+	if db == nil || db.session == nil {
+		return errors.New("db session is nil")
+	}
+	if d.Alpha <= 0 || d.Alpha > 1 {
+		return errors.New("Anomaly alpha should be in (0, 1]")
+	}
+	if d.Sigmas <= 0 || d.ShiftSigmas <= 0 {
+		return errors.New("Anomaly sigmas should be positive")
+	}
+	d.db, d.baselineCol, d.anomalyCol = db, baselineCol, anomalyCol
+	d.baselines = make(map[string]*Baseline)
+	d.dirty = make(map[string]bool)
+
+	c, ok := db.cols[baselineCol]
+	if !ok {
+		return errors.New("Cannot reach db collection " + baselineCol)
+	}
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true, Background: true}); err != nil {
+		logger.Warningf("Failed to set index on collection %s\n", baselineCol)
+		return err
+	}
+	var saved []Baseline
+	if err := c.Find(nil).All(&saved); err != nil {
+		logger.Warning("Cannot load the saved baselines")
+		return err
+	}
+	for i := range saved {
+		b := saved[i]
+		d.baselines[b.Key] = &b
+	}
+	logger.Infof("Loaded %d baselines for anomaly detection\n", len(saved))
+	return nil
+}
+
+// Observe adds the sample to the baseline of the metric, and returns the anomaly
+// found, which is also saved into the anomaly collection
+func (d *Detector) Observe(kind, id, name, metric string, value float64, ts time.Time) *Anomaly {
+	key := kind + "/" + id + "/" + metric
+	d.mutex.Lock()
+	if d.baselines == nil {
+		d.baselines = make(map[string]*Baseline)
+		d.dirty = make(map[string]bool)
+	}
+	b, ok := d.baselines[key]
+	if !ok {
+		b = &Baseline{Key: key, Kind: kind, ID: id, Metric: metric, Mean: value}
+		d.baselines[key] = b
+	}
+	var anomaly *Anomaly
+	if b.Samples >= d.Warmup {
+		stddev := math.Max(math.Sqrt(b.Variance), d.MinRelativeStdDev*math.Abs(b.Mean))
+		score := 0.0
+		if stddev > 0 {
+			score = (value - b.Mean) / stddev
+		}
+		reason := ""
+		switch {
+		case math.Abs(score) <= d.ShiftSigmas:
+			b.Shift = 0
+		case score > 0 && b.Shift >= 0:
+			b.Shift++
+		case score < 0 && b.Shift <= 0:
+			b.Shift--
+		default: // crossed to the other side
+			b.Shift = int(math.Copysign(1, score))
+		}
+		if math.Abs(score) > d.Sigmas {
+			reason = AnomalySpike
+		} else if d.ShiftRounds > 0 && (b.Shift >= d.ShiftRounds || -b.Shift >= d.ShiftRounds) {
+			reason = AnomalyShift
+			b.Shift = 0
+		}
+		if reason != "" {
+			anomaly = &Anomaly{Kind: kind, ID: id, Name: name, Metric: metric, Reason: reason,
+				Value: value, Mean: b.Mean, StdDev: stddev, Score: score, TimeStamp: ts}
+		}
+	}
+	// the baseline follows the samples, so a lasting change becomes the new normal
+	diff := value - b.Mean
+	incr := d.Alpha * diff
+	b.Mean += incr
+	b.Variance = (1 - d.Alpha) * (b.Variance + diff*incr)
+	b.Samples++
+	b.UpdatedAt = ts
+	d.dirty[key] = true
+	d.mutex.Unlock()
+
+	if anomaly != nil {
+		logger.Warningf("Anomaly %s of %s %s: %s = %g, baseline %g ± %g\n", anomaly.Reason, kind, name, metric, value, anomaly.Mean, anomaly.StdDev)
+		if d.db != nil {
+			d.db.SaveData(anomaly, d.anomalyCol)
+		}
+	}
+	return anomaly
+}
+
+// Save writes the baselines updated since the last save
+func (d *Detector) Save() error {
+	d.mutex.Lock()
+	changed := make([]Baseline, 0, len(d.dirty))
+	for key := range d.dirty {
+		changed = append(changed, *d.baselines[key])
+	}
+	d.dirty = make(map[string]bool)
+	d.mutex.Unlock()
+	if d.db == nil || d.db.session == nil {
+		return errors.New("db session is nil")
+	}
+	token, err := d.db.fenced()
+	if err != nil { // saved by the leader
+		logger.Debugf("Skip saving %d baselines: %v\n", len(changed), err)
+		return err
+	}
+	c, ok := d.db.cols[d.baselineCol]
+	if !ok {
+		return errors.New("Cannot reach db collection " + d.baselineCol)
+	}
+	for i, b := range changed {
+		doc, err := withLeaseToken(b, token)
+		if err == nil {
+			_, err = c.Upsert(bson.M{"key": b.Key}, doc)
+		}
+		if err != nil {
+			logger.Warningf("Failed to save baseline %s\n", b.Key)
+			// retry the rest next time
+			d.mutex.Lock()
+			for _, rest := range changed[i:] {
+				d.dirty[rest.Key] = true
+			}
+			d.mutex.Unlock()
+			return err
+		}
+	}
+	logger.Debugf("Saved %d baselines\n", len(changed))
+	return nil
+}
@@ -0,0 +1,251 @@
+package data
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yeasy/cmonit/util"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BatchError reports the documents failed in a bulk write
+type BatchError struct {
+	Col    string
+	Total  int
+	Failed []int // positions in the batch of the documents not written
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d documents failed to write into %s: %v", len(e.Failed), e.Total, e.Col, e.Err)
+}
+
+// batchWriter queues the documents of a collection, and writes them with one bulk insert
+type batchWriter struct {
+	db      *DB
+	colName string
+	mutex   sync.Mutex
+	docs    []interface{}
+	timer   *time.Timer
+}
+
+// SetBatch makes SaveData queue the documents and write them in bulk, when size
+// documents are queued or interval passed since the first queued one, or at Flush.
+// size <= 1 means writing each document at once.
+func (db *DB) SetBatch(size int, interval time.Duration) {
+	db.Flush()
+	db.writersMutex.Lock()
+	db.batchSize, db.batchInterval = size, interval
+	db.writersMutex.Unlock()
+}
+
+// writer returns the batch writer of the collection, nil if not batching
+func (db *DB) writer(colName string) *batchWriter {
+	db.writersMutex.Lock()
+	defer db.writersMutex.Unlock()
+	if db.batchSize <= 1 {
+		return nil
+	}
+	if db.writers == nil {
+		db.writers = make(map[string]*batchWriter)
+	}
+	w, ok := db.writers[colName]
+	if !ok {
+		w = &batchWriter{db: db, colName: colName}
+		db.writers[colName] = w
+	}
+	return w
+}
+
+// Flush writes all the queued documents, and returns the first error
+func (db *DB) Flush() error {
+	return db.FlushSpan(nil)
+}
+
+// FlushSpan is Flush with the writes traced under the span of the caller, or in their own traces when nil
+func (db *DB) FlushSpan(parent *util.Span) error {
+	db.writersMutex.Lock()
+	writers := make([]*batchWriter, 0, len(db.writers))
+	for _, w := range db.writers {
+		writers = append(writers, w)
+	}
+	db.writersMutex.Unlock()
+
+	var result error
+	for _, w := range writers {
+		if err := w.flush(parent); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// flushCol writes the queued documents of the collection
+func (db *DB) flushCol(colName string) error {
+	db.writersMutex.Lock()
+	w, ok := db.writers[colName]
+	db.writersMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return w.flush(nil)
+}
+
+// add queues the document, and writes the batch when it is full under the span of the caller
+func (w *batchWriter) add(doc interface{}, parent *util.Span) error {
+	w.mutex.Lock()
+	w.docs = append(w.docs, doc)
+	util.SetGauge(util.MetricName("mongo_queue_depth", "col", w.colName), float64(len(w.docs)))
+	full := len(w.docs) >= w.db.batchSize
+	if !full && w.timer == nil && w.db.batchInterval > 0 {
+		w.timer = time.AfterFunc(w.db.batchInterval, func() { w.flush(nil) })
+	}
+	w.mutex.Unlock()
+	if full {
+		return w.flush(parent)
+	}
+	return nil
+}
+
+// flush writes the queued documents with an unordered bulk insert.
+// Each document is given an _id first, so the failed ones can be found
+// by the ids missing in the collection after the write.
+// The write is traced under the parent span, or in its own trace when nil.
+func (w *batchWriter) flush(parent *util.Span) error {
+	w.mutex.Lock()
+	docs := w.docs
+	w.docs = nil
+	util.SetGauge(util.MetricName("mongo_queue_depth", "col", w.colName), 0)
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mutex.Unlock()
+	if len(docs) == 0 {
+		return nil
+	}
+
+	db := w.db
+	if db.session == nil {
+		logger.Error("db session is nil")
+		w.report(len(docs), len(docs), 0)
+		return &BatchError{Col: w.colName, Total: len(docs), Failed: allPositions(len(docs)), Err: fmt.Errorf("db session is nil")}
+	}
+	token, err := db.fenced()
+	if err != nil {
+		logger.Warningf("Drop %d documents of %s.%s: %v\n", len(docs), db.Name, w.colName, err)
+		w.report(len(docs), len(docs), 0)
+		return &BatchError{Col: w.colName, Total: len(docs), Failed: allPositions(len(docs)), Err: err}
+	}
+	c, ok := db.cols[w.colName]
+	if !ok {
+		logger.Warningf("collection handler %s is nil, should init first.\n", w.colName)
+		w.report(len(docs), len(docs), 0)
+		return &BatchError{Col: w.colName, Total: len(docs), Failed: allPositions(len(docs)), Err: fmt.Errorf("db collection is not opened")}
+	}
+
+	ids := make([]bson.ObjectId, len(docs))
+	withIDs := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		d, id, err := withObjectID(doc)
+		if err != nil { // let the insert report it
+			logger.Errorf("Cannot encode document for %s.%s: %v\n", db.Name, w.colName, err)
+			withIDs[i] = doc
+			continue
+		}
+		if token != 0 {
+			d = append(d, bson.DocElem{Name: LeaseTokenField, Value: token})
+		}
+		ids[i], withIDs[i] = id, d
+	}
+
+	span := util.StartSpan(parent, "mongo.bulk_insert", "col", w.colName, "docs", len(docs))
+	defer span.Finish()
+	start := time.Now()
+	bulk := c.Bulk()
+	bulk.Unordered()
+	bulk.Insert(withIDs...)
+	_, err = bulk.Run()
+	latency := time.Since(start)
+	span.SetError(err)
+	if err == nil {
+		w.report(len(docs), 0, latency)
+		logger.Debugf("Saved %d documents into %s.%s in %s\n", len(docs), db.Name, w.colName, latency)
+		return nil
+	}
+
+	// find out the documents not written
+	var written []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	queryIDs := make([]bson.ObjectId, 0, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			queryIDs = append(queryIDs, id)
+		}
+	}
+	found := make(map[bson.ObjectId]bool, len(ids))
+	if qerr := c.Find(bson.M{"_id": bson.M{"$in": queryIDs}}).Select(bson.M{"_id": 1}).All(&written); qerr == nil {
+		for _, d := range written {
+			found[d.ID] = true
+		}
+	} else {
+		logger.Warningf("Cannot check the written documents in %s.%s: %v\n", db.Name, w.colName, qerr)
+	}
+	failed := []int{}
+	for i, id := range ids {
+		if id == "" || !found[id] {
+			failed = append(failed, i)
+			logger.Warningf("Failed to insert document %d/%d into %s.%s: %+v\n", i, len(docs), db.Name, w.colName, docs[i])
+		}
+	}
+	w.report(len(docs), len(failed), latency)
+	span.SetAttr("failed", len(failed))
+	logger.Error(err)
+	return &BatchError{Col: w.colName, Total: len(docs), Failed: failed, Err: err}
+}
+
+// report records the batch in the self metrics
+func (w *batchWriter) report(size, failed int, latency time.Duration) {
+	util.Observe(util.MetricName("mongo_batch_size", "col", w.colName), float64(size))
+	if latency > 0 {
+		util.Observe(util.MetricName("mongo_batch_latency_ms", "col", w.colName), float64(latency)/float64(time.Millisecond))
+	}
+	util.AddCounter(util.MetricName("mongo_docs_written_total", "col", w.colName), float64(size-failed))
+	if failed > 0 {
+		util.AddCounter(util.MetricName("mongo_docs_failed_total", "col", w.colName), float64(failed))
+		util.AddCounter(util.MetricName("sink_write_errors_total", "sink", "mongo", "col", w.colName), 1)
+	}
+}
+
+// withObjectID returns the document with a new _id added, or the existing one
+func withObjectID(doc interface{}) (bson.D, bson.ObjectId, error) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, "", err
+	}
+	for _, e := range d {
+		if e.Name == "_id" {
+			if id, ok := e.Value.(bson.ObjectId); ok {
+				return d, id, nil
+			}
+			return d, "", nil
+		}
+	}
+	id := bson.NewObjectId()
+	return append(bson.D{{Name: "_id", Value: id}}, d...), id, nil
+}
+
+// allPositions returns 0..n-1
+func allPositions(n int) []int {
+	result := make([]int, n)
+	for i := range result {
+		result[i] = i
+	}
+	return result
+}
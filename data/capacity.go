@@ -0,0 +1,123 @@
+package data
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// HostCapacity is the capacity usage of a host in a round
+type HostCapacity struct {
+	Capacity       uint64  `bson:"capacity" json:"capacity"`               // max clusters, 0 for no limit
+	ClustersUsed   uint64  `bson:"clusters_used" json:"clusters_used"`     // clusters monitored on the host
+	FreeSlots      int64   `bson:"free_slots" json:"free_slots"`           // clusters can be added, -1 for no limit
+	CPUCapacity    float64 `bson:"cpu_capacity" json:"cpu_capacity"`       // 100 for each cpu, 0 when unknown
+	CPUHeadroom    float64 `bson:"cpu_headroom" json:"cpu_headroom"`       // cpu capacity not used by the containers
+	MemoryCapacity float64 `bson:"memory_capacity" json:"memory_capacity"` // bytes, 0 when unknown
+	MemoryHeadroom float64 `bson:"memory_headroom" json:"memory_headroom"`
+	Accepting      bool    `bson:"accepting" json:"accepting"` // whether a new cluster can be placed
+}
+
+// CalculateCapacity returns the capacity usage of the host with the stat of the round.
+// clustersUsed counts the clusters placed on the host, collected or not. A nil stat
+// means the usage is unknown, and a host with clusters does not accept new ones then.
+// The host accepts new clusters when it is active, has free slots, and the headroom
+// is no less than the min percentages.
+func CalculateCapacity(host *Host, hs *HostStat, clustersUsed uint64, ncpu int, memTotal, minCPUHeadroom, minMemoryHeadroom float64) HostCapacity {
+	c := HostCapacity{
+		Capacity:       host.Capacity,
+		ClustersUsed:   clustersUsed,
+		FreeSlots:      -1,
+		CPUCapacity:    float64(ncpu) * 100.0,
+		MemoryCapacity: memTotal,
+	}
+	var cpuUsed, memUsed float64
+	if hs != nil {
+		cpuUsed = hs.CPUDistribution.Sum
+		memUsed = hs.Memory
+	}
+	if c.Capacity > 0 {
+		c.FreeSlots = int64(c.Capacity) - int64(c.ClustersUsed)
+		if c.FreeSlots < 0 {
+			c.FreeSlots = 0
+		}
+	}
+	c.Accepting = host.Status == "active" && c.FreeSlots != 0 && (hs != nil || clustersUsed == 0)
+	if hs == nil && clustersUsed > 0 {
+		return c
+	}
+	if c.CPUCapacity > 0 {
+		c.CPUHeadroom = c.CPUCapacity - cpuUsed
+		if c.CPUHeadroom < c.CPUCapacity*minCPUHeadroom/100.0 {
+			c.Accepting = false
+		}
+	}
+	if c.MemoryCapacity > 0 {
+		c.MemoryHeadroom = c.MemoryCapacity - memUsed
+		if c.MemoryHeadroom < c.MemoryCapacity*minMemoryHeadroom/100.0 {
+			c.Accepting = false
+		}
+	}
+	return c
+}
+
+// FleetHost is the capacity of a host in the fleet view
+type FleetHost struct {
+	HostID       string `bson:"host_id" json:"host_id"`
+	HostName     string `bson:"host_name" json:"host_name"`
+	Status       string `bson:"status" json:"status"`
+	HostCapacity `bson:",inline"`
+}
+
+// FleetStat is a document of the capacity of all hosts in a round
+type FleetStat struct {
+	_ID            bson.ObjectId `bson:"_id,omitempty" json:"-"`
+	Hosts          int           `bson:"hosts" json:"hosts"`
+	ActiveHosts    int           `bson:"active_hosts" json:"active_hosts"`
+	AcceptingHosts int           `bson:"accepting_hosts" json:"accepting_hosts"`
+	Capacity       uint64        `bson:"capacity" json:"capacity"` // of the hosts with a limit
+	ClustersUsed   uint64        `bson:"clusters_used" json:"clusters_used"`
+	FreeSlots      int64         `bson:"free_slots" json:"free_slots"` // of the hosts with a limit
+	CPUHeadroom    float64       `bson:"cpu_headroom" json:"cpu_headroom"`
+	MemoryHeadroom float64       `bson:"memory_headroom" json:"memory_headroom"`
+	Members        []FleetHost   `bson:"members" json:"members"` // the accepting ones first, by free memory
+	TimeStamp      time.Time     `bson:"timestamp" json:"timestamp"`
+}
+
+// CalculateFleet sums up the capacity of the hosts
+func CalculateFleet(hosts []FleetHost) FleetStat {
+	f := FleetStat{Hosts: len(hosts), Members: hosts, TimeStamp: time.Now().UTC()}
+	for _, h := range hosts {
+		if h.Status == "active" {
+			f.ActiveHosts++
+		}
+		if h.Accepting {
+			f.AcceptingHosts++
+		}
+		f.ClustersUsed += h.ClustersUsed
+		if h.Capacity > 0 {
+			f.Capacity += h.Capacity
+			f.FreeSlots += h.FreeSlots
+		}
+		f.CPUHeadroom += h.CPUHeadroom
+		f.MemoryHeadroom += h.MemoryHeadroom
+	}
+	sort.Sort(fleetHostsByHeadroom(f.Members))
+	return f
+}
+
+// fleetHostsByHeadroom puts the accepting hosts with more free memory first
+type fleetHostsByHeadroom []FleetHost
+
+func (s fleetHostsByHeadroom) Len() int      { return len(s) }
+func (s fleetHostsByHeadroom) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s fleetHostsByHeadroom) Less(i, j int) bool {
+	if s[i].Accepting != s[j].Accepting {
+		return s[i].Accepting
+	}
+	if s[i].MemoryHeadroom != s[j].MemoryHeadroom {
+		return s[i].MemoryHeadroom > s[j].MemoryHeadroom
+	}
+	return s[i].HostName < s[j].HostName
+}
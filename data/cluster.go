@@ -3,25 +3,28 @@ package data
 import (
 	"time"
 
+	"github.com/yeasy/cmonit/util"
 	"gopkg.in/mgo.v2/bson"
 )
 
 //Cluster is a document in the host collection
 type Cluster struct {
 	_ID             bson.ObjectId     `bson:"_id,omitempty"`
-	ID              string            `bson:"id,omitempty"`
-	Name            string            `bson:"name,omitempty"`
-	ConsensusPlugin string            `bson:"consensus_plugin,omitempty"`
-	ConsensusMode   string            `bson:"consensus_mode,omitempty"`
-	HostID          string            `bson:"host_id,omitempty"`
-	UserID          string            `bson:"user_id,omitempty"`
-	Containers      map[string]string `bson:"containers,omitempty"`
-	APIURL          string            `bson:"api_url,omitempty"`
-	DaemonURL       string            `bson:"daemon_url,omitempty"`
-	Size            uint64            `bson:"size,omitempty"`
-	CreateTS        time.Time         `bson:"create_ts,omitempty"`
-	ReleaseTS       time.Time         `bson:"release_ts,omitempty"`
-	Duration        time.Time         `bson:"duration,omitempty"`
+	ID              string            `bson:"id,omitempty" json:"id,omitempty" yaml:"id,omitempty"`
+	Name            string            `bson:"name,omitempty" json:"name,omitempty" yaml:"name,omitempty"`
+	ConsensusPlugin string            `bson:"consensus_plugin,omitempty" json:"consensus_plugin,omitempty" yaml:"consensus_plugin,omitempty"`
+	ConsensusMode   string            `bson:"consensus_mode,omitempty" json:"consensus_mode,omitempty" yaml:"consensus_mode,omitempty"`
+	HostID          string            `bson:"host_id,omitempty" json:"host_id,omitempty" yaml:"host_id,omitempty"`
+	UserID          string            `bson:"user_id,omitempty" json:"user_id,omitempty" yaml:"user_id,omitempty"`
+	Containers      map[string]string `bson:"containers,omitempty" json:"containers,omitempty" yaml:"containers,omitempty"`
+	Nodes           map[string]string `bson:"nodes,omitempty" json:"nodes,omitempty" yaml:"nodes,omitempty"` // container name -> daemon url, when not on the cluster daemon
+	APIURL          string            `bson:"api_url,omitempty" json:"api_url,omitempty" yaml:"api_url,omitempty"`
+	DaemonURL       string            `bson:"daemon_url,omitempty" json:"daemon_url,omitempty" yaml:"daemon_url,omitempty"`
+	Size            uint64            `bson:"size,omitempty" json:"size,omitempty" yaml:"size,omitempty"`
+	DiskQuota       float64           `bson:"disk_quota,omitempty" json:"disk_quota,omitempty" yaml:"disk_quota,omitempty"` // GB of storage for the chain data
+	CreateTS        time.Time         `bson:"create_ts,omitempty" json:"create_ts,omitempty" yaml:"create_ts,omitempty"`
+	ReleaseTS       time.Time         `bson:"release_ts,omitempty" json:"release_ts,omitempty" yaml:"release_ts,omitempty"`
+	Duration        time.Time         `bson:"duration,omitempty" json:"duration,omitempty" yaml:"duration,omitempty"`
 }
 
 //ClusterStat is a document of stat info for a cluster
@@ -29,21 +32,36 @@ type ClusterStat struct {
 	_ID              bson.ObjectId `bson:"_id,omitempty"`
 	ClusterID        string        `bson:"cluster_id,omitempty"`
 	ClusterName      string        `bson:"cluster_name,omitempty"`
+	UserID           string        `bson:"user_id,omitempty"`
 	CPUPercentage    float64       `bson:"cpu_percentage,omitempty"`
 	Memory           float64       `bson:"memory_usage,omitempty"`
 	MemoryLimit      float64       `bson:"memory_limit,omitempty"`
 	MemoryPercentage float64       `bson:"memory_percentage,omitempty"`
+	MemoryWorkingSet float64       `bson:"memory_working_set,omitempty"`
+	MemoryRSS        float64       `bson:"memory_rss,omitempty"`
 	NetworkRx        float64       `bson:"network_rx,omitempty"`
 	NetworkTx        float64       `bson:"network_tx,omitempty"`
 	BlockRead        float64       `bson:"block_read,omitempty"`
 	BlockWrite       float64       `bson:"block_write,omitempty"`
 	PidsCurrent      uint64        `bson:"pid_current,omitempty"`
+	Throttled        uint64        `bson:"throttled_containers"` // containers hitting the cpu limit
+	DiskSizeRw       float64       `bson:"disk_size_rw,omitempty"`
+	DiskVolumesSize  float64       `bson:"disk_volumes_size,omitempty"` // a volume shared by the containers is counted once
+	DiskUsage        float64       `bson:"disk_usage,omitempty"`        // the rw layers and the volumes
+	DiskCapacity     float64       `bson:"disk_capacity,omitempty"`     // from the disk_quota of the cluster, 0 when unknown
 	Size             uint64        `bson:"size,omitempty"`
+	Missing          uint64        `bson:"missing_containers,omitempty"` // containers of the cluster not collected
 	MaxLatency       float64       `bson:"max_latency,omitempty"`
 	MinLatency       float64       `bson:"min_latency,omitempty"`
 	AvgLatency       float64       `bson:"avg_latency,omitempty"`
 	Latencies        []float64     `bson:"latencies,omitempty"`
-	TimeStamp        time.Time     `bson:"timestamp,omitempty"`
+	// distributions over the containers, and over the latencies
+	CPUDistribution     util.Distribution `bson:"cpu_distribution,omitempty"`
+	MemoryDistribution  util.Distribution `bson:"memory_distribution,omitempty"` // of the memory percentage
+	LatencyDistribution util.Distribution `bson:"latency_distribution,omitempty"`
+	TimeStamp           time.Time         `bson:"timestamp,omitempty"`
+
+	members []*ContainerStat // for the host stat
 }
 
 // CalculateStat will get the stat result for a cluster
@@ -53,18 +71,71 @@ func (s *ClusterStat) CalculateStat(csList []*ContainerStat) {
 		logger.Warning("Cluster has no container..")
 		return
 	}
+	s.members = csList
+	volumes := make(map[string]float64)
 	for _, cs := range csList {
-		s.CPUPercentage += cs.CPUPercentage
 		s.Memory += cs.Memory
 		s.MemoryLimit += cs.MemoryLimit
-		s.MemoryPercentage += cs.MemoryPercentage
+		s.MemoryWorkingSet += cs.WorkingSet
+		s.MemoryRSS += cs.RSS
 		s.NetworkRx += cs.NetworkRx
 		s.NetworkTx += cs.NetworkTx
 		s.BlockRead += cs.BlockRead
 		s.BlockWrite += cs.BlockWrite
 		s.PidsCurrent += cs.PidsCurrent
+		if cs.Throttled() {
+			s.Throttled++
+		}
+		s.DiskSizeRw += cs.SizeRw
+		for name, size := range cs.Volumes {
+			volumes[name] = size
+		}
 		s.Size = uint64(number)
 	}
-	s.CPUPercentage /= float64(number)
-	s.MemoryPercentage /= float64(number)
+	for _, size := range volumes {
+		s.DiskVolumesSize += size
+	}
+	s.DiskUsage = s.DiskSizeRw + s.DiskVolumesSize
+	cpu, mem := containerPercentages(csList)
+	s.CPUDistribution = util.Aggregate(cpu)
+	s.MemoryDistribution = util.Aggregate(mem)
+	s.CPUPercentage = s.CPUDistribution.Avg
+	s.MemoryPercentage = memoryPercentage(csList)
+}
+
+// SetLatencies will keep the latencies among the containers and their distribution
+func (s *ClusterStat) SetLatencies(latencies []float64) {
+	s.Latencies = latencies
+	s.LatencyDistribution = util.Aggregate(latencies)
+	s.AvgLatency = s.LatencyDistribution.Avg
+	s.MaxLatency = s.LatencyDistribution.Max
+	s.MinLatency = s.LatencyDistribution.Min
+}
+
+// containerPercentages returns the cpu and memory percentages of the containers
+func containerPercentages(csList []*ContainerStat) (cpu, mem []float64) {
+	cpu = make([]float64, 0, len(csList))
+	mem = make([]float64, 0, len(csList))
+	for _, cs := range csList {
+		cpu = append(cpu, cs.CPUPercentage)
+		if cs.MemoryLimit > 0 {
+			mem = append(mem, cs.MemoryPercentage)
+		}
+	}
+	return cpu, mem
+}
+
+// memoryPercentage is the total usage over the total limit of the containers with a limit
+func memoryPercentage(csList []*ContainerStat) float64 {
+	var usage, limit float64
+	for _, cs := range csList {
+		if cs.MemoryLimit > 0 {
+			usage += cs.Memory
+			limit += cs.MemoryLimit
+		}
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return usage / limit * 100.0
 }
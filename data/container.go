@@ -21,4 +21,96 @@ type ContainerStat struct {
 	BlockWrite       float64       `bson:"block_write,omitempty"`
 	PidsCurrent      uint64        `bson:"pid_current,omitempty"`
 	TimeStamp        time.Time     `bson:"timestamp,omitempty"`
+	ContainerInfo    `bson:",inline"`
+	MemoryDetail     `bson:",inline"`
+	CPUDetail        `bson:",inline"`
+	DiskUsage        `bson:",inline"`
+	LogStat          `bson:",inline"`
+	Networks         map[string]NetworkInterface `bson:"networks,omitempty"`      // by interface name
+	BlockDevices     map[string]BlockDevice      `bson:"block_devices,omitempty"` // by major:minor
+}
+
+// NetworkInterface is the counters of a network interface of a container since it starts
+type NetworkInterface struct {
+	RxBytes   float64 `bson:"rx_bytes" json:"rx_bytes"`
+	RxPackets float64 `bson:"rx_packets" json:"rx_packets"`
+	RxErrors  float64 `bson:"rx_errors" json:"rx_errors"`
+	RxDropped float64 `bson:"rx_dropped" json:"rx_dropped"`
+	TxBytes   float64 `bson:"tx_bytes" json:"tx_bytes"`
+	TxPackets float64 `bson:"tx_packets" json:"tx_packets"`
+	TxErrors  float64 `bson:"tx_errors" json:"tx_errors"`
+	TxDropped float64 `bson:"tx_dropped" json:"tx_dropped"`
+}
+
+// BlockDevice is the io counters of a block device used by a container since it starts
+type BlockDevice struct {
+	Major       uint64  `bson:"major" json:"major"`
+	Minor       uint64  `bson:"minor" json:"minor"`
+	ReadBytes   float64 `bson:"read_bytes" json:"read_bytes"`
+	WriteBytes  float64 `bson:"write_bytes" json:"write_bytes"`
+	ReadOps     float64 `bson:"read_ops" json:"read_ops"`
+	WriteOps    float64 `bson:"write_ops" json:"write_ops"`
+	ServiceTime float64 `bson:"service_time" json:"service_time"` // nanoseconds of read and write, cgroup v1 only
+	Queued      float64 `bson:"queued" json:"queued"`             // requests queued at the moment, cgroup v1 only
+}
+
+// CPUDetail is the breakdown and throttling of the cpu usage of a container.
+// The percentages are of one cpu, the same as the cpu percentage.
+type CPUDetail struct {
+	UserPercentage   float64   `bson:"cpu_user_percentage,omitempty" json:"cpu_user_percentage,omitempty"`
+	KernelPercentage float64   `bson:"cpu_kernel_percentage,omitempty" json:"cpu_kernel_percentage,omitempty"`
+	PerCPU           []float64 `bson:"cpu_percpu_percentage,omitempty" json:"cpu_percpu_percentage,omitempty"` // cgroup v1 only
+	Periods          float64   `bson:"cpu_periods,omitempty" json:"cpu_periods,omitempty"`                     // cfs periods since the start
+	ThrottledPeriods float64   `bson:"cpu_throttled_periods,omitempty" json:"cpu_throttled_periods,omitempty"`
+	ThrottledTime    float64   `bson:"cpu_throttled_time,omitempty" json:"cpu_throttled_time,omitempty"` // nanoseconds since the start
+	ThrottleRatio    float64   `bson:"cpu_throttle_ratio" json:"cpu_throttle_ratio"`                     // throttled periods over periods since the last reading, 0-1
+}
+
+// Throttled tells the container hits its cpu limit since the last reading
+func (d CPUDetail) Throttled() bool {
+	return d.ThrottleRatio > 0
+}
+
+// LogStat is the log lines of a container since the last reading
+type LogStat struct {
+	LogLines uint64            `bson:"log_lines,omitempty" json:"log_lines,omitempty"`
+	LogRate  float64           `bson:"log_rate,omitempty" json:"log_rate,omitempty"` // lines per second
+	LogHits  map[string]uint64 `bson:"log_hits,omitempty" json:"log_hits,omitempty"` // lines matching each pattern
+}
+
+// MemoryDetail is the breakdown of the memory of a container from memory.stat, in bytes
+type MemoryDetail struct {
+	RawUsage     float64 `bson:"memory_raw_usage,omitempty" json:"memory_raw_usage,omitempty"`     // including all the page cache
+	WorkingSet   float64 `bson:"memory_working_set,omitempty" json:"memory_working_set,omitempty"` // usage without the inactive file cache
+	RSS          float64 `bson:"memory_rss,omitempty" json:"memory_rss,omitempty"`                 // anonymous memory
+	Cache        float64 `bson:"memory_cache,omitempty" json:"memory_cache,omitempty"`             // page cache
+	Swap         float64 `bson:"memory_swap,omitempty" json:"memory_swap,omitempty"`               // cgroup v1 only
+	MappedFile   float64 `bson:"memory_mapped_file,omitempty" json:"memory_mapped_file,omitempty"`
+	ActiveFile   float64 `bson:"memory_active_file,omitempty" json:"memory_active_file,omitempty"`
+	InactiveFile float64 `bson:"memory_inactive_file,omitempty" json:"memory_inactive_file,omitempty"`
+	PgFault      float64 `bson:"memory_pgfault,omitempty" json:"memory_pgfault,omitempty"` // counters since the start
+	PgMajFault   float64 `bson:"memory_pgmajfault,omitempty" json:"memory_pgmajfault,omitempty"`
+	MaxUsage     float64 `bson:"memory_max_usage,omitempty" json:"memory_max_usage,omitempty"` // cgroup v1 only
+	Failcnt      float64 `bson:"memory_failcnt,omitempty" json:"memory_failcnt,omitempty"`     // times hitting the limit, cgroup v1 only
+}
+
+// ContainerInfo is the metadata of a container from the inspect
+type ContainerInfo struct {
+	Image             string            `bson:"image,omitempty" json:"image,omitempty"` // as given at creation
+	ImageID           string            `bson:"image_id,omitempty" json:"image_id,omitempty"`
+	ImageDigest       string            `bson:"image_digest,omitempty" json:"image_digest,omitempty"` // repo digest, empty for local images
+	StartedAt         time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	Uptime            float64           `bson:"uptime,omitempty" json:"uptime,omitempty"` // seconds since started, of the sample
+	RestartCount      int               `bson:"restart_count" json:"restart_count"`
+	Status            string            `bson:"status,omitempty" json:"status,omitempty"` // running, restarting, exited...
+	Health            string            `bson:"health,omitempty" json:"health,omitempty"` // starting, healthy or unhealthy, empty without health check
+	OOMKilled         bool              `bson:"oom_killed" json:"oom_killed"`
+	ExitCode          int               `bson:"exit_code" json:"exit_code"`
+	CPUShares         int64             `bson:"cpu_shares,omitempty" json:"cpu_shares,omitempty"`
+	CPUQuota          int64             `bson:"cpu_quota,omitempty" json:"cpu_quota,omitempty"`
+	CPUPeriod         int64             `bson:"cpu_period,omitempty" json:"cpu_period,omitempty"`
+	CPULimit          float64           `bson:"cpu_limit,omitempty" json:"cpu_limit,omitempty"` // cpus from the quota or nano cpus, 0 for no limit
+	MemoryLimitConfig int64             `bson:"memory_limit_config,omitempty" json:"memory_limit_config,omitempty"`
+	MemoryReservation int64             `bson:"memory_reservation,omitempty" json:"memory_reservation,omitempty"`
+	Labels            map[string]string `bson:"labels,omitempty" json:"labels,omitempty"` // the selected ones, with . replaced by _
 }
@@ -2,9 +2,11 @@ package data
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/op/go-logging"
+	"github.com/yeasy/cmonit/util"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -15,53 +17,157 @@ var logger = logging.MustGetLogger("cmonit")
 type DB struct {
 	URL     string // mongo api url
 	Name    string // name of the db
+	conf    *DBConfig
 	session *mgo.Session
 	cols    map[string]*mgo.Collection
+
+	sessionMutex sync.RWMutex // the session is replaced by ReDial while Ping is called by the admin listener
+
+	batchSize     int
+	batchInterval time.Duration
+	writers       map[string]*batchWriter // collection -> queued documents
+	writersMutex  sync.Mutex
+	fence         func() (int64, error) // gives the token stamped on each write, nil to always write
 }
 
 // ReDial will try reconnecting to the db
 func (db *DB) ReDial() error {
+	db.sessionMutex.Lock()
 	if db.session != nil {
 		db.session.Close()
 		db.session = nil
 	}
-	var err error
-	if db.session, err = mgo.DialWithTimeout(db.URL, time.Duration(3*time.Second)); err != nil {
+	db.sessionMutex.Unlock()
+	if db.conf == nil {
+		return errors.New("db is not inited")
+	}
+	timeout := db.conf.DialTimeout
+	if timeout <= 0 {
+		timeout = time.Duration(3 * time.Second)
+	}
+	session, err := db.dial(timeout)
+	if err != nil {
 		logger.Errorf("Failed to dial db url=%s\n", db.URL)
-		db.session = nil
 		return err
 	}
+	db.sessionMutex.Lock()
+	defer db.sessionMutex.Unlock()
+	db.session = session
+	// collections are bound to the old session
+	for k, c := range db.cols {
+		db.cols[k] = db.session.DB(db.Name).C(c.Name)
+	}
 	return nil
 }
 
 // Init a db, open session and make collection handler
-func (db *DB) Init(dbURL string, dbName string) error {
+func (db *DB) Init(conf *DBConfig) error {
 	var err error
-	db.URL, db.Name = dbURL, dbName
-	if db.URL == "" {
+	if conf == nil || conf.URL == "" {
 		logger.Error("Empty db.url is given")
 		return errors.New("Empty dbURL")
 	}
-	if db.session, err = mgo.DialWithTimeout(dbURL, time.Duration(5*time.Second)); err != nil {
-		logger.Errorf("Failed to dial db url=%s\n", dbURL)
+	if err = conf.Validate(); err != nil {
+		logger.Errorf("Invalid db config for url=%s\n", conf.URL)
+		return err
+	}
+	db.URL, db.Name, db.conf = conf.URL, conf.Name, conf
+	timeout := conf.DialTimeout
+	if timeout <= 0 {
+		timeout = time.Duration(5 * time.Second)
+	}
+	session, err := db.dial(timeout)
+	if err != nil {
+		logger.Errorf("Failed to dial db url=%s\n", db.URL)
 		logger.Error(err)
 		return err
 	}
-	// Optional. Switch the session to a monotonic behavior.
-	db.session.SetMode(mgo.Monotonic, true)
+	db.sessionMutex.Lock()
+	db.session = session
+	db.sessionMutex.Unlock()
 	db.cols = make(map[string]*mgo.Collection, 4)
 
 	return nil
 }
 
+// dial opens a session with the config
+func (db *DB) dial(timeout time.Duration) (*mgo.Session, error) {
+	info, err := db.conf.DialInfo(timeout)
+	if err != nil {
+		return nil, err
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	db.conf.setMode(session)
+	session.SetSafe(db.conf.Safe())
+	if db.conf.SocketTimeout > 0 {
+		session.SetSocketTimeout(db.conf.SocketTimeout)
+	}
+	return session, nil
+}
+
+// Ping checks the db is reachable, on a copy of the session as ReDial may close it meanwhile
+func (db *DB) Ping() error {
+	db.sessionMutex.RLock()
+	if db.session == nil {
+		db.sessionMutex.RUnlock()
+		return errors.New("db session is nil")
+	}
+	session := db.session.Copy()
+	db.sessionMutex.RUnlock()
+	defer session.Close()
+	return session.Ping()
+}
+
 // Close a db session
 func (db *DB) Close() {
+	db.Flush()
+	db.sessionMutex.Lock()
+	defer db.sessionMutex.Unlock()
 	if db.session != nil {
 		db.session.Close()
 	}
 	db.session = nil
 }
 
+// SetFence makes each write stamped with the token of fence into LeaseTokenField,
+// or fail with its error, e.g., when the leader lease is taken over
+func (db *DB) SetFence(fence func() (int64, error)) {
+	db.fence = fence
+}
+
+// fenced returns the token of the fence, 0 without fence, or the error when the writes are refused
+func (db *DB) fenced() (int64, error) {
+	if db.fence == nil {
+		return 0, nil
+	}
+	return db.fence()
+}
+
+// withLeaseToken returns the document with the lease token, the document as it is when token is 0
+func withLeaseToken(doc interface{}, token int64) (interface{}, error) {
+	if token == 0 {
+		return doc, nil
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	for i, e := range d {
+		if e.Name == LeaseTokenField {
+			d[i].Value = token
+			return d, nil
+		}
+	}
+	return append(d, bson.DocElem{Name: LeaseTokenField, Value: token}), nil
+}
+
 // SetCol will set the cols points to collections
 func (db *DB) SetCol(colKey, colName string) {
 	if db.session == nil {
@@ -99,6 +205,23 @@ func (db *DB) SetIndex(colKey, indexKey string, expireDays int) error {
 	return nil
 }
 
+// SetCompoundIndex will ensure an index on the keys of the collection
+func (db *DB) SetCompoundIndex(colKey string, keys ...string) error {
+	if db.session == nil {
+		logger.Error("db session is nil")
+		return errors.New("db session is nil")
+	}
+	c, ok := db.cols[colKey]
+	if !ok {
+		return errors.New("Cannot reach db collection " + colKey)
+	}
+	if err := c.EnsureIndex(mgo.Index{Key: keys, Background: true}); err != nil {
+		logger.Warningf("Failed to set index on collection %s\n", colKey)
+		return err
+	}
+	return nil
+}
+
 // GetCol retrieve the collection from db
 //depreacted
 func (db *DB) GetCol(colName string) (*[]interface{}, error) {
@@ -147,14 +270,51 @@ func (db *DB) GetHosts() (*[]Host, error) {
 	return &hosts, errors.New("Cannot reach db collection " + colName)
 }
 
-// SaveData save a record into db's collection
+// GetLatest retrieve the latest document by timestamp from db's collection
+func (db *DB) GetLatest(colName string, result interface{}) error {
+	if db.session == nil {
+		logger.Error("db session is nil")
+		return errors.New("db session is nil")
+	}
+	if c, ok := db.cols[colName]; ok {
+		return c.Find(nil).Sort("-timestamp").One(result)
+	}
+	logger.Warningf("collection handler %s is nil, should init first.\n", colName)
+	return errors.New("Cannot reach db collection " + colName)
+}
+
+// SaveData save a record into db's collection,
+// it is queued and written later when batch is set
 func (db *DB) SaveData(s interface{}, colName string) error {
+	return db.SaveDataSpan(s, colName, nil)
+}
+
+// SaveDataSpan is SaveData with the write traced under the span of the caller,
+// or in its own trace when parent is nil
+func (db *DB) SaveDataSpan(s interface{}, colName string, parent *util.Span) error {
 	if db.session == nil {
 		logger.Error("db session is nil")
 		return errors.New("db session is nil")
 	}
+	if w := db.writer(colName); w != nil {
+		return w.add(s, parent)
+	}
+	token, err := db.fenced()
+	if err != nil {
+		logger.Debugf("Skip writing into %s.%s: %v\n", db.Name, colName, err)
+		return err
+	}
 	if c, ok := db.cols[colName]; ok {
-		if err := c.Insert(s); err != nil {
+		if s, err = withLeaseToken(s, token); err != nil {
+			logger.Errorf("Cannot encode document for %s.%s: %v\n", db.Name, colName, err)
+			return err
+		}
+		span := util.StartSpan(parent, "mongo.insert", "col", colName)
+		err = c.Insert(s)
+		span.SetError(err)
+		span.Finish()
+		if err != nil {
+			util.AddCounter(util.MetricName("sink_write_errors_total", "sink", "mongo", "col", colName), 1)
 			logger.Warning("Error to insert data")
 			logger.Error(err)
 			return err
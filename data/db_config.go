@@ -0,0 +1,266 @@
+package data
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// DBConfig is the connection setting of a mongo db.
+// The fields given here take precedence over the same ones in the url.
+type DBConfig struct {
+	URL          string // [mongodb://][user:pass@]host1[:port1][,host2[:port2]...][/db][?options]
+	Name         string // name of the db to use
+	Username     string
+	Password     string
+	PasswordFile string // file with the password, instead of giving it in config
+	AuthDB       string // db to authenticate against, default to the db in url, then admin
+	ReplicaSet   string // name of the replica set, empty to connect to any given server
+
+	TLS         bool
+	TLSCA       string // CA file to verify the servers, empty to use the system CAs
+	TLSCert     string // client cert file, for x509 auth or servers requiring client certs
+	TLSKey      string
+	TLSInsecure bool // skip verifying the servers
+
+	WriteConcern   string        // number of nodes to acknowledge, majority or a tag, 0 for unacknowledged
+	Journal        bool          // wait for the write to be journaled
+	WriteTimeout   time.Duration // timeout to wait for the write concern, 0 for no timeout
+	ReadPreference string        // primary, primaryPreferred, secondaryPreferred or nearest
+
+	DialTimeout   time.Duration // timeout to reach the servers at start
+	SocketTimeout time.Duration // timeout of each operation on the socket
+}
+
+// read preferences supported by mgo, mapped to its consistency modes
+var readPreferences = map[string]string{
+	"":                   "monotonic",
+	"primary":            "strong",
+	"primarypreferred":   "monotonic",
+	"secondarypreferred": "monotonic",
+	"nearest":            "eventual",
+	"strong":             "strong",
+	"monotonic":          "monotonic",
+	"eventual":           "eventual",
+}
+
+// mongoURL is the parts of the mongo url
+type mongoURL struct {
+	addrs   []string
+	user    string
+	pass    string
+	db      string
+	options map[string]string
+}
+
+// parseMongoURL splits the mongo url, in the same format accepted by mgo.Dial
+func parseMongoURL(s string) (*mongoURL, error) {
+	s = strings.TrimPrefix(s, "mongodb://")
+	result := &mongoURL{options: make(map[string]string)}
+	if i := strings.Index(s, "?"); i >= 0 {
+		for _, pair := range strings.FieldsFunc(s[i+1:], func(c rune) bool { return c == ';' || c == '&' }) {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("Invalid option %s in db url", pair)
+			}
+			result.options[kv[0]] = kv[1]
+		}
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		cred := s[:i]
+		s = s[i+1:]
+		if j := strings.Index(cred, ":"); j >= 0 {
+			result.user, result.pass = cred[:j], cred[j+1:]
+		} else {
+			result.user = cred
+		}
+	}
+	if i := strings.Index(s, "/"); i >= 0 {
+		result.db = s[i+1:]
+		s = s[:i]
+	}
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			result.addrs = append(result.addrs, addr)
+		}
+	}
+	if len(result.addrs) == 0 {
+		return nil, errors.New("No server address in db url")
+	}
+	return result, nil
+}
+
+// Validate checks the config and reads the password file,
+// it is called before dialing so a wrong setting fails at startup.
+func (conf *DBConfig) Validate() error {
+	if conf.URL == "" {
+		return errors.New("Empty db url")
+	}
+	if conf.Name == "" {
+		return fmt.Errorf("Empty db name for %s", conf.URL)
+	}
+	u, err := parseMongoURL(conf.URL)
+	if err != nil {
+		return err
+	}
+	for k := range u.options {
+		switch k {
+		case "authSource", "authMechanism", "replicaSet", "ssl", "connect", "maxPoolSize":
+		default:
+			return fmt.Errorf("Unsupported option %s in db url %s", k, conf.URL)
+		}
+	}
+
+	if conf.Password != "" && conf.PasswordFile != "" {
+		return errors.New("Only one of db password and password file can be given")
+	}
+	if conf.PasswordFile != "" {
+		content, err := ioutil.ReadFile(conf.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("Cannot read db password file %s: %v", conf.PasswordFile, err)
+		}
+		conf.Password = strings.TrimSpace(string(content))
+		conf.PasswordFile = ""
+	}
+	if conf.Password != "" && conf.Username == "" && u.user == "" {
+		return errors.New("Db password is given without username")
+	}
+
+	if conf.TLSCA != "" || conf.TLSCert != "" || conf.TLSKey != "" || conf.TLSInsecure {
+		conf.TLS = true
+	}
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		return errors.New("Db TLS cert and key should be given together")
+	}
+	if _, err := conf.tlsConfig(); err != nil {
+		return err
+	}
+
+	if _, ok := readPreferences[strings.ToLower(conf.ReadPreference)]; !ok {
+		return fmt.Errorf("Unknown db read preference %s, should be primary, primaryPreferred, secondaryPreferred or nearest", conf.ReadPreference)
+	}
+	if conf.WriteConcern != "" {
+		if w, err := strconv.Atoi(conf.WriteConcern); err == nil && w < 0 {
+			return fmt.Errorf("Invalid db write concern %s", conf.WriteConcern)
+		}
+	}
+	if conf.WriteTimeout < 0 || conf.DialTimeout < 0 || conf.SocketTimeout < 0 {
+		return errors.New("Db timeouts should not be negative")
+	}
+	return nil
+}
+
+// tlsConfig loads the TLS setting, nil means no TLS
+func (conf *DBConfig) tlsConfig() (*tls.Config, error) {
+	if !conf.TLS {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: conf.TLSInsecure}
+	if conf.TLSCA != "" {
+		ca, err := ioutil.ReadFile(conf.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read db TLS CA file %s: %v", conf.TLSCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No valid certificate found in db TLS CA file %s", conf.TLSCA)
+		}
+		config.RootCAs = pool
+	}
+	if conf.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load db TLS cert %s: %v", conf.TLSCert, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// DialInfo merges the url and the config into the mgo dial info
+func (conf *DBConfig) DialInfo(timeout time.Duration) (*mgo.DialInfo, error) {
+	u, err := parseMongoURL(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	info := &mgo.DialInfo{
+		Addrs:          u.addrs,
+		Timeout:        timeout,
+		Database:       u.db,
+		Username:       u.user,
+		Password:       u.pass,
+		Source:         u.options["authSource"],
+		Mechanism:      u.options["authMechanism"],
+		ReplicaSetName: u.options["replicaSet"],
+		Direct:         u.options["connect"] == "direct",
+	}
+	if v, ok := u.options["maxPoolSize"]; ok {
+		if info.PoolLimit, err = strconv.Atoi(v); err != nil {
+			return nil, errors.New("Bad value for maxPoolSize: " + v)
+		}
+	}
+	if conf.Username != "" {
+		info.Username = conf.Username
+	}
+	if conf.Password != "" {
+		info.Password = conf.Password
+	}
+	if conf.AuthDB != "" {
+		info.Source = conf.AuthDB
+	}
+	if conf.ReplicaSet != "" {
+		info.ReplicaSetName = conf.ReplicaSet
+	}
+
+	useTLS := conf.TLS || u.options["ssl"] == "true"
+	if useTLS {
+		tlsConfig, err := conf.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: timeout}
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), tlsConfig)
+		}
+	}
+	return info, nil
+}
+
+// Safe returns the write concern, nil means not waiting for any acknowledgement
+func (conf *DBConfig) Safe() *mgo.Safe {
+	safe := &mgo.Safe{J: conf.Journal, WTimeout: int(conf.WriteTimeout / time.Millisecond)}
+	switch w, err := strconv.Atoi(conf.WriteConcern); {
+	case conf.WriteConcern == "":
+	case err == nil && w == 0 && !conf.Journal:
+		return nil
+	case err == nil:
+		safe.W = w
+	default:
+		safe.WMode = conf.WriteConcern
+	}
+	return safe
+}
+
+// setMode applies the read preference to the session
+func (conf *DBConfig) setMode(session *mgo.Session) {
+	switch readPreferences[strings.ToLower(conf.ReadPreference)] {
+	case "strong":
+		session.SetMode(mgo.Strong, true)
+	case "eventual":
+		session.SetMode(mgo.Eventual, true)
+	default:
+		session.SetMode(mgo.Monotonic, true)
+	}
+}
@@ -0,0 +1,33 @@
+package data
+
+// DiskUsage is the disk used by a container from the docker disk usage, in bytes
+type DiskUsage struct {
+	SizeRw      float64            `bson:"disk_size_rw,omitempty" json:"disk_size_rw,omitempty"`           // the writable layer
+	SizeRootFs  float64            `bson:"disk_size_root_fs,omitempty" json:"disk_size_root_fs,omitempty"` // the writable layer and the image, which may be shared
+	VolumesSize float64            `bson:"disk_volumes_size,omitempty" json:"disk_volumes_size,omitempty"` // of the named volumes mounted
+	Volumes     map[string]float64 `bson:"disk_volumes,omitempty" json:"disk_volumes,omitempty"`           // by volume name, with . replaced by _
+}
+
+// HostDisk is the disk used by the docker storage of a host, in bytes
+type HostDisk struct {
+	DiskImages     float64 `bson:"disk_images,omitempty"` // unique image layers
+	DiskContainers float64 `bson:"disk_containers,omitempty"`
+	DiskVolumes    float64 `bson:"disk_volumes_size,omitempty"`
+	DiskBuildCache float64 `bson:"disk_build_cache,omitempty"`
+	DiskUsage      float64 `bson:"disk_usage,omitempty"`     // all the above
+	DiskCapacity   float64 `bson:"disk_capacity,omitempty"`  // from the disk_capacity of the host, 0 when unknown
+	DiskGrowthRate float64 `bson:"disk_growth_rate"`         // bytes per hour since the last reading
+	DiskFullDays   float64 `bson:"disk_full_days,omitempty"` // till the capacity at the growth rate, 0 when not growing or unknown
+}
+
+// SetGrowth calculates the growth rate from the usage of the last reading, and when the disk fills up
+func (d *HostDisk) SetGrowth(lastUsage, hours float64) {
+	if hours <= 0 {
+		return
+	}
+	d.DiskGrowthRate = (d.DiskUsage - lastUsage) / hours
+	d.DiskFullDays = 0
+	if d.DiskGrowthRate > 0 && d.DiskCapacity > d.DiskUsage {
+		d.DiskFullDays = (d.DiskCapacity - d.DiskUsage) / d.DiskGrowthRate / 24
+	}
+}
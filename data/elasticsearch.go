@@ -2,6 +2,7 @@ package data
 
 import (
 	"github.com/jmcvetta/napping"
+	"github.com/yeasy/cmonit/util"
 )
 
 // ESInsertDoc will insert a doc to elasticsearch
@@ -9,12 +10,21 @@ func ESInsertDoc(esURL, esIndex, esType string, doc map[string]interface{}) {
 
 	result := make(map[string]interface{})
 	url := "http://" + esURL + "/" + esIndex + "/" + esType
+	span := util.StartSpan(util.RoundSpan(), "elasticsearch.insert", "index", esIndex, "type", esType)
+	defer span.Finish()
 	resp, err := napping.Post(url, &doc, &result, nil)
+	span.SetError(err)
 	if err != nil {
+		util.AddCounter(util.MetricName("sink_write_errors_total", "sink", "elasticsearch", "col", esType), 1)
 		logger.Warningf("Error to send data to es=%s/%s/%s\n", esURL, esIndex, esType)
 		logger.Warning(err)
 		return
 	}
+	span.SetAttr("status", resp.Status())
+	if resp.Status() >= 300 {
+		util.AddCounter(util.MetricName("sink_write_errors_total", "sink", "elasticsearch", "col", esType), 1)
+		logger.Warningf("Error to send data to es=%s/%s/%s: status %d\n", esURL, esIndex, esType, resp.Status())
+	}
 	logger.Debugf("response status code = %d\n", resp.Status())
 	logger.Debug(result)
 }
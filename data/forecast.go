@@ -0,0 +1,364 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/yeasy/cmonit/util"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Methods to fit the trends
+const (
+	ForecastLinear      = "linear"
+	ForecastHoltWinters = "holt-winters"
+)
+
+// Status of a forecast
+const (
+	ForecastOK           = "ok"
+	ForecastWarning      = "warning"
+	ForecastCritical     = "critical"
+	ForecastInsufficient = "insufficient" // too few samples to fit
+)
+
+// ForecastTarget is a usage to forecast against its capacity, from the rollup documents
+type ForecastTarget struct {
+	Kind          string // host or cluster
+	ColKey        string // key of the raw collection, the rollup level is added
+	IDField       string
+	NameField     string
+	Metric        string // name in the report
+	UsageField    string
+	CapacityField string
+}
+
+// DefaultForecastTargets are the usages forecast in the reports
+var DefaultForecastTargets = []ForecastTarget{
+	{Kind: "host", ColKey: "host", IDField: "host_id", NameField: "host_name",
+		Metric: "memory", UsageField: "memory_usage", CapacityField: "memory_capacity"},
+	{Kind: "host", ColKey: "host", IDField: "host_id", NameField: "host_name",
+		Metric: "disk", UsageField: "disk_usage", CapacityField: "disk_capacity"},
+	{Kind: "cluster", ColKey: "cluster", IDField: "cluster_id", NameField: "cluster_name",
+		Metric: "storage", UsageField: "disk_usage", CapacityField: "disk_capacity"},
+}
+
+// Forecast is the trend of a usage, and when it reaches the capacity
+type Forecast struct {
+	Kind        string     `json:"kind"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Metric      string     `json:"metric"`
+	Method      string     `json:"method"`
+	Samples     int        `json:"samples"`
+	Current     float64    `json:"current"`
+	Capacity    float64    `json:"capacity"`
+	SlopePerDay float64    `json:"slope_per_day"`
+	ExhaustAt   *time.Time `json:"exhaust_at,omitempty"` // nil when not within the horizon
+	DaysLeft    float64    `json:"days_left"`            // -1 when not within the horizon
+	Status      string     `json:"status"`
+}
+
+// Forecaster fits the trends of the rollup documents, and predicts when the usages
+// reach the capacities within the horizon
+type Forecaster struct {
+	Method       string
+	Level        RollupLevel // rollup level to read, e.g., 1h
+	Season       int         // periods of a season for holt-winters, e.g., 24 for daily with 1h
+	History      time.Duration
+	Horizon      time.Duration
+	WarningDays  float64
+	CriticalDays float64
+	Targets      []ForecastTarget
+
+	db *DB
+}
+
+// Init will set the db with the rollup collections of the targets
+func (f *Forecaster) Init(db *DB) error {
+	if db == nil || db.session == nil {
+		return errors.New("db session is nil")
+	}
+	if f.Method != ForecastLinear && f.Method != ForecastHoltWinters {
+		return fmt.Errorf("Unknown forecast method %s, should be %s or %s", f.Method, ForecastLinear, ForecastHoltWinters)
+	}
+	if f.Level.Period <= 0 || f.Horizon <= 0 {
+		return errors.New("Forecast period and horizon should be positive")
+	}
+	if f.Targets == nil {
+		f.Targets = DefaultForecastTargets
+	}
+	for _, t := range f.Targets {
+		key := t.ColKey + "_" + f.Level.Name
+		if _, ok := db.cols[key]; !ok {
+			return errors.New("Cannot reach db collection " + key + ", is rollup enabled?")
+		}
+	}
+	f.db = db
+	return nil
+}
+
+// Run reads the history before now and forecasts every target
+func (f *Forecaster) Run(now time.Time) (*ForecastReport, error) {
+	if f.db == nil || f.db.session == nil {
+		return nil, errors.New("db session is nil")
+	}
+	report := &ForecastReport{GeneratedAt: now.UTC(), History: f.History.String(), Horizon: f.Horizon.String(), Method: f.Method}
+	for _, t := range f.Targets {
+		key := t.ColKey + "_" + f.Level.Name
+		var docs []bson.M
+		query := bson.M{"start": bson.M{"$gte": now.Add(-f.History)}}
+		if err := f.db.cols[key].Find(query).Sort("start").All(&docs); err != nil {
+			logger.Warningf("Cannot read %s for forecast\n", key)
+			return nil, err
+		}
+		report.Forecasts = append(report.Forecasts, f.ForecastDocs(t, docs, now)...)
+	}
+	sort.Sort(forecastsByUrgency(report.Forecasts))
+	return report, nil
+}
+
+// ForecastDocs groups the rollup documents (sorted by start) by id, and forecasts each
+func (f *Forecaster) ForecastDocs(t ForecastTarget, docs []bson.M, now time.Time) []Forecast {
+	type series struct {
+		name     string
+		times    []time.Time
+		values   []float64
+		capacity float64
+	}
+	groups := make(map[string]*series)
+	ids := []string{}
+	for _, doc := range docs {
+		id, _ := doc[t.IDField].(string)
+		start, ok := doc["start"].(time.Time)
+		if id == "" || !ok {
+			continue
+		}
+		s, ok := groups[id]
+		if !ok {
+			s = &series{}
+			groups[id] = s
+			ids = append(ids, id)
+		}
+		if name, ok := doc[t.NameField].(string); ok {
+			s.name = name
+		}
+		s.times = append(s.times, start)
+		s.values = append(s.values, rollupAvg(doc[t.UsageField]))
+		if c := rollupAvg(doc[t.CapacityField]); c > 0 {
+			s.capacity = c
+		}
+	}
+	sort.Strings(ids)
+	result := make([]Forecast, 0, len(ids))
+	for _, id := range ids {
+		s := groups[id]
+		fc := f.ForecastSeries(s.times, s.values, s.capacity, now)
+		fc.Kind, fc.ID, fc.Name, fc.Metric = t.Kind, id, s.name, t.Metric
+		result = append(result, fc)
+	}
+	return result
+}
+
+// ForecastSeries fits the values at the times, one each period, and finds when
+// it reaches the capacity within the horizon after now
+func (f *Forecaster) ForecastSeries(times []time.Time, values []float64, capacity float64, now time.Time) Forecast {
+	fc := Forecast{Method: f.Method, Samples: len(values), Capacity: capacity, DaysLeft: -1, Status: ForecastInsufficient}
+	if len(values) > 0 {
+		fc.Current = values[len(values)-1]
+	}
+	if len(values) < 3 {
+		return fc
+	}
+	day := float64(24 * time.Hour)
+	last := times[len(times)-1]
+	var exhaust time.Time
+	switch f.Method {
+	case ForecastLinear:
+		xs := make([]float64, len(times))
+		for i, t := range times {
+			xs[i] = float64(t.Sub(times[0])) / day
+		}
+		slope, intercept, ok := util.LinearFit(xs, values)
+		if !ok {
+			return fc
+		}
+		fc.SlopePerDay = slope
+		if capacity > 0 && slope > 0 {
+			x := (capacity - intercept) / slope
+			exhaust = times[0].Add(time.Duration(x * day))
+			if exhaust.Before(now) { // over the capacity already
+				exhaust = now
+			}
+		}
+	default:
+		steps := int(f.Horizon / f.Level.Period)
+		// the rollups of the periods cmonit was down are missing, filled to keep the season in step
+		forecasts, trend := util.HoltWinters(fillPeriods(times, values, f.Level.Period, f.Season), f.Season, 0.5, 0.1, 0.1, steps)
+		fc.SlopePerDay = trend * day / float64(f.Level.Period)
+		if capacity > 0 {
+			if fc.Current >= capacity {
+				exhaust = now
+			}
+			for h, v := range forecasts {
+				if !exhaust.IsZero() {
+					break
+				}
+				if v >= capacity {
+					exhaust = last.Add(time.Duration(h+1) * f.Level.Period)
+				}
+			}
+		}
+	}
+
+	fc.Status = ForecastOK
+	if exhaust.IsZero() || exhaust.After(now.Add(f.Horizon)) {
+		return fc
+	}
+	if exhaust.Before(now) {
+		exhaust = now
+	}
+	exhaust = exhaust.UTC()
+	fc.ExhaustAt = &exhaust
+	fc.DaysLeft = math.Floor(float64(exhaust.Sub(now))/day*10) / 10
+	if fc.DaysLeft <= f.CriticalDays {
+		fc.Status = ForecastCritical
+	} else if fc.DaysLeft <= f.WarningDays {
+		fc.Status = ForecastWarning
+	}
+	return fc
+}
+
+// fillPeriods returns the values one each period, with a missing period taking
+// the value of one season before, or interpolated between the values around it
+func fillPeriods(times []time.Time, values []float64, period time.Duration, season int) []float64 {
+	if period <= 0 {
+		return values
+	}
+	filled := make([]float64, 0, len(values))
+	for i, v := range values {
+		if i > 0 {
+			prev := values[i-1]
+			n := int(math.Floor(float64(times[i].Sub(times[i-1]))/float64(period) + 0.5))
+			for k := 1; k < n; k++ {
+				if season > 1 && len(filled) >= season {
+					filled = append(filled, filled[len(filled)-season])
+				} else {
+					filled = append(filled, prev+(v-prev)*float64(k)/float64(n))
+				}
+			}
+		}
+		filled = append(filled, v)
+	}
+	return filled
+}
+
+// rollupAvg returns the avg of a rolled up field
+func rollupAvg(v interface{}) float64 {
+	if sub, ok := v.(bson.M); ok {
+		avg, _ := toFloat(sub["avg"])
+		return avg
+	}
+	n, _ := toFloat(v)
+	return n
+}
+
+// ForecastReport is the forecasts of a run
+type ForecastReport struct {
+	GeneratedAt time.Time  `json:"generated_at"`
+	Method      string     `json:"method"`
+	History     string     `json:"history"`
+	Horizon     string     `json:"horizon"`
+	Forecasts   []Forecast `json:"forecasts"`
+}
+
+// Markdown renders the report as a markdown table
+func (r *ForecastReport) Markdown() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Capacity forecast\n\nGenerated at %s with %s over %s of history, for the next %s.\n\n",
+		r.GeneratedAt.Format(time.RFC3339), r.Method, r.History, r.Horizon)
+	fmt.Fprintln(&b, "| Status | Kind | Name | Metric | Current | Capacity | Change per day | Exhausted at | Days left |")
+	fmt.Fprintln(&b, "|---|---|---|---|---:|---:|---:|---|---:|")
+	for _, fc := range r.Forecasts {
+		row := fc.row()
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s | %s | %s | %s |\n", row[0], row[1], row[2], row[3], row[4], row[5], row[6], row[7], row[8])
+	}
+	return b.String()
+}
+
+var forecastHTML = template.Must(template.New("forecast").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Capacity forecast</title>
+<style>
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+.critical { background: #f8d7da; }
+.warning { background: #fff3cd; }
+</style>
+</head>
+<body>
+<h1>Capacity forecast</h1>
+<p>Generated at {{.Report.GeneratedAt.Format "2006-01-02T15:04:05Z07:00"}} with {{.Report.Method}} over {{.Report.History}} of history, for the next {{.Report.Horizon}}.</p>
+<table>
+<tr><th>Status</th><th>Kind</th><th>Name</th><th>Metric</th><th>Current</th><th>Capacity</th><th>Change per day</th><th>Exhausted at</th><th>Days left</th></tr>
+{{range .Rows}}<tr class="{{index . 0}}">{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// HTML renders the report as a html page
+func (r *ForecastReport) HTML() (string, error) {
+	rows := make([][]string, len(r.Forecasts))
+	for i, fc := range r.Forecasts {
+		rows[i] = fc.row()
+	}
+	var b bytes.Buffer
+	if err := forecastHTML.Execute(&b, struct {
+		Report *ForecastReport
+		Rows   [][]string
+	}{r, rows}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// row returns the cells of the forecast in the reports
+func (fc Forecast) row() []string {
+	name := fc.Name
+	if name == "" {
+		name = fc.ID
+	}
+	exhaust, days := "-", "-"
+	if fc.ExhaustAt != nil {
+		exhaust = fc.ExhaustAt.Format("2006-01-02 15:04")
+		days = fmt.Sprintf("%.1f", fc.DaysLeft)
+	}
+	return []string{fc.Status, fc.Kind, name, fc.Metric, fmt.Sprintf("%.0f", fc.Current), fmt.Sprintf("%.0f", fc.Capacity),
+		fmt.Sprintf("%+.0f", fc.SlopePerDay), exhaust, days}
+}
+
+// forecastsByUrgency puts the ones exhausted sooner first
+type forecastsByUrgency []Forecast
+
+func (s forecastsByUrgency) Len() int      { return len(s) }
+func (s forecastsByUrgency) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s forecastsByUrgency) Less(i, j int) bool {
+	if (s[i].ExhaustAt == nil) != (s[j].ExhaustAt == nil) {
+		return s[i].ExhaustAt != nil
+	}
+	if s[i].ExhaustAt != nil && !s[i].ExhaustAt.Equal(*s[j].ExhaustAt) {
+		return s[i].ExhaustAt.Before(*s[j].ExhaustAt)
+	}
+	if s[i].Kind != s[j].Kind {
+		return s[i].Kind < s[j].Kind
+	}
+	return s[i].Name < s[j].Name
+}
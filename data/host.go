@@ -5,22 +5,35 @@ import (
 
 	"math"
 
+	"github.com/yeasy/cmonit/util"
 	"gopkg.in/mgo.v2/bson"
 )
 
+const (
+	// HostTypeSwarm is the type of hosts which are swarm managers
+	HostTypeSwarm = "swarm"
+	// HostTypeKubernetes is the type of hosts which are kubernetes nodes
+	HostTypeKubernetes = "kubernetes"
+)
+
 //Host is a document in the host collection
 type Host struct {
-	_ID       bson.ObjectId `bson:"_id,omitempty"`
-	ID        string        `bson:"id,omitempty"`
-	Name      string        `bson:"name,omitempty"`
-	DaemonURL string        `bson:"daemon_url,omitempty"`
-	Clusters  []string      `bson:"clusters,omitempty"`
-	Status    string        `bson:"status,omitempty"`
-	Capacity  uint64        `bson:"capacity,omitempty"`
-	Type      string        `bson:"type,omitempty"`
-	LogType   string        `bson:"log_type,omitempty"`
-	LogServer string        `bson:"log_server,omitempty"`
-	CreateTS  string        `bson:"create_ts,omitempty"`
+	_ID          bson.ObjectId `bson:"_id,omitempty"`
+	ID           string        `bson:"id,omitempty" json:"id,omitempty" yaml:"id,omitempty"`
+	Name         string        `bson:"name,omitempty" json:"name,omitempty" yaml:"name,omitempty"`
+	DaemonURL    string        `bson:"daemon_url,omitempty" json:"daemon_url,omitempty" yaml:"daemon_url,omitempty"`
+	Clusters     []string      `bson:"clusters,omitempty" json:"clusters,omitempty" yaml:"clusters,omitempty"`
+	Status       string        `bson:"status,omitempty" json:"status,omitempty" yaml:"status,omitempty"`
+	Capacity     uint64        `bson:"capacity,omitempty" json:"capacity,omitempty" yaml:"capacity,omitempty"`
+	Type         string        `bson:"type,omitempty" json:"type,omitempty" yaml:"type,omitempty"`
+	LogType      string        `bson:"log_type,omitempty" json:"log_type,omitempty" yaml:"log_type,omitempty"`
+	LogServer    string        `bson:"log_server,omitempty" json:"log_server,omitempty" yaml:"log_server,omitempty"`
+	DiskCapacity float64       `bson:"disk_capacity,omitempty" json:"disk_capacity,omitempty" yaml:"disk_capacity,omitempty"` // GB of the docker storage
+	CreateTS     string        `bson:"create_ts,omitempty" json:"create_ts,omitempty" yaml:"create_ts,omitempty"`
+	TLSMode      string        `bson:"tls_mode,omitempty" json:"tls_mode,omitempty" yaml:"tls_mode,omitempty"` // none, verify or insecure
+	TLSCA        string        `bson:"tls_ca,omitempty" json:"tls_ca,omitempty" yaml:"tls_ca,omitempty"`       // CA file to verify the daemon
+	TLSCert      string        `bson:"tls_cert,omitempty" json:"tls_cert,omitempty" yaml:"tls_cert,omitempty"` // client cert file
+	TLSKey       string        `bson:"tls_key,omitempty" json:"tls_key,omitempty" yaml:"tls_key,omitempty"`    // client key file
 }
 
 //HostStat is a document of stat info for a cluster
@@ -32,15 +45,24 @@ type HostStat struct {
 	Memory           float64       `bson:"memory_usage,omitempty"`
 	MemoryLimit      float64       `bson:"memory_limit,omitempty"`
 	MemoryPercentage float64       `bson:"memory_percentage,omitempty"`
+	MemoryWorkingSet float64       `bson:"memory_working_set,omitempty"`
+	MemoryRSS        float64       `bson:"memory_rss,omitempty"`
 	NetworkRx        float64       `bson:"network_rx,omitempty"`
 	NetworkTx        float64       `bson:"network_tx,omitempty"`
 	BlockRead        float64       `bson:"block_read,omitempty"`
 	BlockWrite       float64       `bson:"block_write,omitempty"`
 	PidsCurrent      uint64        `bson:"pid_current,omitempty"`
+	Throttled        uint64        `bson:"throttled_containers"` // containers hitting the cpu limit
 	AvgLatency       float64       `bson:"avg_latency,omitempty"`
 	MaxLatency       float64       `bson:"max_latency,omitempty"`
 	MinLatency       float64       `bson:"min_latency,omitempty"`
-	TimeStamp        time.Time     `bson:"timestamp,omitempty"`
+	// distributions over all the containers, and over the latencies of all clusters
+	CPUDistribution     util.Distribution `bson:"cpu_distribution,omitempty"`
+	MemoryDistribution  util.Distribution `bson:"memory_distribution,omitempty"` // of the memory percentage
+	LatencyDistribution util.Distribution `bson:"latency_distribution,omitempty"`
+	HostCapacity        `bson:",inline"`
+	HostDisk            `bson:",inline"`
+	TimeStamp           time.Time `bson:"timestamp,omitempty"`
 }
 
 // CalculateStat will get the stat result for a cluster
@@ -50,21 +72,33 @@ func (s *HostStat) CalculateStat(csList []*ClusterStat) {
 		logger.Warning("No cluster stats for host stat calculation")
 		return
 	}
+	s.ClustersUsed = uint64(number)
+	members := []*ContainerStat{}
+	latencies := []float64{}
 	for _, cs := range csList {
 		s.CPUPercentage += cs.CPUPercentage
 		s.Memory += cs.Memory
 		s.MemoryLimit += cs.MemoryLimit
-		s.MemoryPercentage += cs.MemoryPercentage
+		s.MemoryWorkingSet += cs.MemoryWorkingSet
+		s.MemoryRSS += cs.MemoryRSS
 		s.NetworkRx += cs.NetworkRx
 		s.NetworkTx += cs.NetworkTx
 		s.BlockRead += cs.BlockRead
 		s.BlockWrite += cs.BlockWrite
 		s.PidsCurrent += cs.PidsCurrent
+		s.Throttled += cs.Throttled
 		s.AvgLatency += cs.AvgLatency
 		s.MaxLatency = math.Max(s.MaxLatency, cs.MaxLatency)
 		if cs.MinLatency < s.MinLatency || s.MinLatency == 0.0 {
 			s.MinLatency = cs.MinLatency
 		}
+		members = append(members, cs.members...)
+		latencies = append(latencies, cs.Latencies...)
 	}
 	s.AvgLatency /= float64(number)
+	cpu, mem := containerPercentages(members)
+	s.CPUDistribution = util.Aggregate(cpu)
+	s.MemoryDistribution = util.Aggregate(mem)
+	s.LatencyDistribution = util.Aggregate(latencies)
+	s.MemoryPercentage = memoryPercentage(members)
 }
@@ -0,0 +1,190 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/yaml.v2"
+)
+
+// Inventory is the source telling which hosts and clusters to monitor.
+// DB (the pool manager's mongo) and FileInventory both implement it.
+type Inventory interface {
+	GetHosts() (*[]Host, error)
+	GetClusters(filter map[string]interface{}) (*[]Cluster, error)
+	ReDial() error
+	Ping() error // tells whether the source is reachable
+	Close()
+}
+
+// inventoryDoc is the content of an inventory file
+type inventoryDoc struct {
+	Hosts    []Host    `json:"hosts" yaml:"hosts"`
+	Clusters []Cluster `json:"clusters" yaml:"clusters"`
+}
+
+// FileInventory reads hosts and clusters from a static yaml/json file,
+// and reloads it whenever the file is changed.
+type FileInventory struct {
+	Path     string // path of the inventory file
+	mutex    sync.RWMutex
+	hosts    []Host
+	clusters []Cluster
+	watcher  *fsnotify.Watcher
+}
+
+// Init loads the inventory file and starts watching it for changes
+func (fi *FileInventory) Init(path string) error {
+	fi.Path = path
+	if fi.Path == "" {
+		logger.Error("Empty inventory file path is given")
+		return errors.New("Empty inventory file path")
+	}
+	if err := fi.load(); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Warningf("Cannot watch inventory file %s, hot reload disabled\n", fi.Path)
+		logger.Warning(err)
+		return nil
+	}
+	// watch the entire directory to pick up renames/atomic saves of editors
+	invFile := filepath.Clean(fi.Path)
+	invDir, _ := filepath.Split(invFile)
+	if invDir == "" {
+		invDir = "."
+	}
+	if err := watcher.Add(invDir); err != nil {
+		logger.Warningf("Cannot watch inventory dir %s, hot reload disabled\n", invDir)
+		logger.Warning(err)
+		watcher.Close()
+		return nil
+	}
+	fi.watcher = watcher
+	go fi.watch(watcher, invFile)
+	return nil
+}
+
+// watch reloads the inventory on each change of the file, until the watcher is closed
+func (fi *FileInventory) watch(watcher *fsnotify.Watcher, invFile string) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != invFile {
+				continue
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
+				logger.Infof("Inventory file changed: %s\n", event.Name)
+				fi.load()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warning(err)
+		}
+	}
+}
+
+// load parses the inventory file, keep the old content when failed
+func (fi *FileInventory) load() error {
+	content, err := ioutil.ReadFile(fi.Path)
+	if err != nil {
+		logger.Errorf("Failed to read inventory file %s\n", fi.Path)
+		logger.Error(err)
+		return err
+	}
+	// yaml is a superset of json, so both formats are handled here
+	var doc inventoryDoc
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		logger.Errorf("Failed to parse inventory file %s\n", fi.Path)
+		logger.Error(err)
+		return err
+	}
+	for i, h := range doc.Hosts {
+		if h.ID == "" || h.DaemonURL == "" {
+			return fmt.Errorf("Host #%d in %s has no id or daemon_url", i, fi.Path)
+		}
+	}
+	fi.mutex.Lock()
+	fi.hosts, fi.clusters = doc.Hosts, doc.Clusters
+	fi.mutex.Unlock()
+	logger.Infof("Loaded inventory file %s: %d hosts, %d clusters\n", fi.Path, len(doc.Hosts), len(doc.Clusters))
+	return nil
+}
+
+// ReDial will reload the inventory file
+func (fi *FileInventory) ReDial() error {
+	return fi.load()
+}
+
+// Ping checks the inventory file is still there
+func (fi *FileInventory) Ping() error {
+	_, err := os.Stat(fi.Path)
+	return err
+}
+
+// Close stops watching the inventory file
+func (fi *FileInventory) Close() {
+	if fi.watcher != nil {
+		fi.watcher.Close()
+	}
+	fi.watcher = nil
+}
+
+// GetHosts retrieve the hosts info from the file
+func (fi *FileInventory) GetHosts() (*[]Host, error) {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+	hosts := make([]Host, len(fi.hosts))
+	copy(hosts, fi.hosts)
+	return &hosts, nil
+}
+
+// GetClusters retrieve the clusters matching all the filter fields
+func (fi *FileInventory) GetClusters(filter map[string]interface{}) (*[]Cluster, error) {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+	clusters := []Cluster{}
+	for _, c := range fi.clusters {
+		if ok, err := matchFilter(c, filter); err != nil {
+			return &clusters, err
+		} else if ok {
+			clusters = append(clusters, c)
+		}
+	}
+	return &clusters, nil
+}
+
+// matchFilter checks a document against a simple equality filter,
+// the keys are bson field names just like the mongo query does
+func matchFilter(doc interface{}, filter map[string]interface{}) (bool, error) {
+	if len(filter) == 0 {
+		return true, nil
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	fields := bson.M{}
+	if err := bson.Unmarshal(raw, &fields); err != nil {
+		return false, err
+	}
+	for k, v := range filter {
+		if fmt.Sprint(fields[k]) != fmt.Sprint(v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
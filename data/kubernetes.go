@@ -0,0 +1,374 @@
+package data
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// in-cluster service account token, used when no token file is configured
+const kubeServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// KubeClient is a minimal client of the kubernetes API server
+type KubeClient struct {
+	URL        string // API server url, e.g., https://10.0.0.1:6443
+	token      string
+	httpClient *http.Client
+}
+
+// Init will set up the connection to the API server.
+// Empty url means using the in-cluster config.
+func (kc *KubeClient) Init(apiURL, tokenFile, caFile string, insecure bool) error {
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			logger.Error("Empty kubernetes url is given and not running in cluster")
+			return errors.New("Empty kubernetes url")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+	}
+	kc.URL = strings.TrimSuffix(apiURL, "/")
+
+	if tokenFile == "" {
+		if _, err := os.Stat(kubeServiceAccountToken); err == nil {
+			tokenFile = kubeServiceAccountToken
+		}
+	}
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			logger.Errorf("Cannot read kubernetes token file %s\n", tokenFile)
+			return err
+		}
+		kc.token = strings.TrimSpace(string(token))
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			logger.Errorf("Cannot read kubernetes ca file %s\n", caFile)
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("No valid certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	kc.httpClient = &http.Client{
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		Timeout: time.Duration(30) * time.Second,
+	}
+	return nil
+}
+
+// Get will request the path of the API server, and decode the json response into v
+func (kc *KubeClient) Get(path string, query url.Values, v interface{}) error {
+	if kc.httpClient == nil {
+		return errors.New("kubernetes client is not inited")
+	}
+	u := kc.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if kc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+kc.token)
+	}
+	resp, err := kc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("kubernetes api %s returns %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kubeNodeList is the response of listing nodes
+type kubeNodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name              string    `json:"name"`
+			UID               string    `json:"uid"`
+			CreationTimestamp time.Time `json:"creationTimestamp"`
+		} `json:"metadata"`
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// kubePodList is the response of listing pods
+type kubePodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName   string `json:"nodeName"`
+			Containers []struct {
+				Name string `json:"name"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// KubeInventory takes the kubernetes nodes as hosts, and groups the
+// selected pods into clusters by namespace or a label.
+type KubeInventory struct {
+	Client        *KubeClient
+	Namespace     string // empty means all namespaces
+	LabelSelector string // selects the pods to monitor
+	ClusterLabel  string // pods with the same value are in one cluster, empty to use namespace
+	UserLabel     string // label of the cluster user
+}
+
+// Init will prepare the API client
+func (ki *KubeInventory) Init(client *KubeClient, namespace, labelSelector, clusterLabel, userLabel string) error {
+	if client == nil {
+		return errors.New("kubernetes client is nil")
+	}
+	ki.Client = client
+	ki.Namespace, ki.LabelSelector = namespace, labelSelector
+	ki.ClusterLabel, ki.UserLabel = clusterLabel, userLabel
+	return nil
+}
+
+// ReDial does nothing as every call is a new request
+func (ki *KubeInventory) ReDial() error {
+	return nil
+}
+
+// Ping checks the API server is reachable
+func (ki *KubeInventory) Ping() error {
+	var v interface{}
+	return ki.Client.Get("/version", nil, &v)
+}
+
+// Close does nothing for the kubernetes inventory
+func (ki *KubeInventory) Close() {
+}
+
+// KubeContainerRef returns the value used in Cluster.Containers for a pod container
+func KubeContainerRef(namespace, pod, container string) string {
+	return namespace + "/" + pod + "/" + container
+}
+
+// GetHosts retrieve the nodes as hosts
+func (ki *KubeInventory) GetHosts() (*[]Host, error) {
+	var nodes kubeNodeList
+	if err := ki.Client.Get("/api/v1/nodes", nil, &nodes); err != nil {
+		logger.Error("Cannot list kubernetes nodes")
+		return nil, err
+	}
+	hosts := []Host{}
+	for _, n := range nodes.Items {
+		status := "inactive"
+		for _, c := range n.Status.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				status = "active"
+			}
+		}
+		hosts = append(hosts, Host{
+			ID:        n.Metadata.Name,
+			Name:      n.Metadata.Name,
+			DaemonURL: ki.kubeNodeURL(n.Metadata.Name),
+			Status:    status,
+			Type:      HostTypeKubernetes,
+			CreateTS:  n.Metadata.CreationTimestamp.Format(time.RFC3339),
+		})
+	}
+	return &hosts, nil
+}
+
+// kubeNodeURL is the daemon url of a node, the kubelet api proxied by the API server
+func (ki *KubeInventory) kubeNodeURL(node string) string {
+	return ki.Client.URL + "/api/v1/nodes/" + node + "/proxy"
+}
+
+// clusterID returns the cluster of the pod, empty when the pod is in none
+func (ki *KubeInventory) clusterID(labels map[string]string, namespace string) string {
+	if ki.ClusterLabel != "" {
+		return labels[ki.ClusterLabel]
+	}
+	return namespace
+}
+
+// listPods lists the running pods selected in the namespace, with the extra field and label selectors
+func (ki *KubeInventory) listPods(namespace, fieldSelector, labelSelector string) (*kubePodList, error) {
+	path := "/api/v1/pods"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + namespace + "/pods"
+	}
+	query := url.Values{}
+	selectors := []string{}
+	for _, sel := range []string{ki.LabelSelector, labelSelector} {
+		if sel != "" {
+			selectors = append(selectors, sel)
+		}
+	}
+	if len(selectors) > 0 {
+		query.Set("labelSelector", strings.Join(selectors, ","))
+	}
+	fields := "status.phase=Running"
+	if fieldSelector != "" {
+		fields += "," + fieldSelector
+	}
+	query.Set("fieldSelector", fields)
+	var pods kubePodList
+	if err := ki.Client.Get(path, query, &pods); err != nil {
+		logger.Error("Cannot list kubernetes pods")
+		return nil, err
+	}
+	return &pods, nil
+}
+
+// GetClusters retrieve the running pods grouped as clusters.
+// A cluster may span several nodes, it is taken by the first of its nodes by name,
+// and its containers on the other nodes are given in Nodes.
+// With a host_id filter, only the pods of the clusters on the node are listed.
+func (ki *KubeInventory) GetClusters(filter map[string]interface{}) (*[]Cluster, error) {
+	var podLists []*kubePodList
+	if node, ok := filter["host_id"].(string); ok && node != "" {
+		local, err := ki.listPods(ki.Namespace, "spec.nodeName="+node, "")
+		if err != nil {
+			return nil, err
+		}
+		ids := make(map[string]bool)
+		for _, p := range local.Items {
+			if id := ki.clusterID(p.Metadata.Labels, p.Metadata.Namespace); id != "" {
+				ids[id] = true
+			}
+		}
+		// the other pods of these clusters
+		names := make([]string, 0, len(ids))
+		for id := range ids {
+			names = append(names, id)
+		}
+		sort.Strings(names)
+		if ki.ClusterLabel == "" { // the clusters are the namespaces
+			for _, namespace := range names {
+				pods, err := ki.listPods(namespace, "", "")
+				if err != nil {
+					return nil, err
+				}
+				podLists = append(podLists, pods)
+			}
+		} else if len(names) > 0 {
+			pods, err := ki.listPods(ki.Namespace, "", ki.ClusterLabel+" in ("+strings.Join(names, ",")+")")
+			if err != nil {
+				return nil, err
+			}
+			podLists = append(podLists, pods)
+		}
+	} else {
+		pods, err := ki.listPods(ki.Namespace, "", "")
+		if err != nil {
+			return nil, err
+		}
+		podLists = append(podLists, pods)
+	}
+
+	clusters := []Cluster{}
+	index := make(map[string]int)               // cluster id -> position in clusters
+	nodes := make(map[string]map[string]string) // cluster id -> container name -> node
+	for _, pods := range podLists {
+		for _, p := range pods.Items {
+			clusterID := ki.clusterID(p.Metadata.Labels, p.Metadata.Namespace)
+			if clusterID == "" {
+				continue
+			}
+			i, ok := index[clusterID]
+			if !ok {
+				clusters = append(clusters, Cluster{
+					ID:         clusterID,
+					Name:       clusterID,
+					Containers: make(map[string]string),
+				})
+				i = len(clusters) - 1
+				index[clusterID] = i
+				nodes[clusterID] = make(map[string]string)
+			}
+			c := &clusters[i]
+			if user := p.Metadata.Labels[ki.UserLabel]; c.UserID == "" && user != "" {
+				c.UserID = user
+			}
+			if c.HostID == "" || p.Spec.NodeName < c.HostID {
+				c.HostID = p.Spec.NodeName
+			}
+			for _, ct := range p.Spec.Containers {
+				name := p.Metadata.Name + "/" + ct.Name
+				c.Containers[name] = KubeContainerRef(p.Metadata.Namespace, p.Metadata.Name, ct.Name)
+				nodes[clusterID][name] = p.Spec.NodeName
+			}
+			c.Size = uint64(len(c.Containers))
+		}
+	}
+	for i := range clusters {
+		c := &clusters[i]
+		c.DaemonURL = ki.kubeNodeURL(c.HostID)
+		for name, node := range nodes[c.ID] {
+			if node != c.HostID {
+				if c.Nodes == nil {
+					c.Nodes = make(map[string]string)
+				}
+				c.Nodes[name] = ki.kubeNodeURL(node)
+			}
+		}
+	}
+	sort.Sort(clustersByID(clusters))
+
+	result := []Cluster{}
+	for _, c := range clusters {
+		if ok, err := matchFilter(c, filter); err != nil {
+			return &result, err
+		} else if ok {
+			result = append(result, c)
+		}
+	}
+	return &result, nil
+}
+
+// clustersByID sorts the clusters by node and id to keep a stable order
+type clustersByID []Cluster
+
+func (s clustersByID) Len() int      { return len(s) }
+func (s clustersByID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s clustersByID) Less(i, j int) bool {
+	if s[i].HostID != s[j].HostID {
+		return s[i].HostID < s[j].HostID
+	}
+	return s[i].ID < s[j].ID
+}
@@ -0,0 +1,230 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotLeader is returned for the writes of an instance not holding the leader lease
+var ErrNotLeader = errors.New("Not the leader")
+
+// LeaseTokenField is the field of the lease token stamped on each document written by the leader
+const LeaseTokenField = "lease_token"
+
+// Lease is the leader lease document of the instances sharing a name.
+// The token is increased each time the lease changes hands, it fences the writes of the old leader.
+type Lease struct {
+	Name    string    `bson:"_id" json:"name"`
+	Holder  string    `bson:"holder" json:"holder"`
+	Token   int64     `bson:"token" json:"token"`
+	Renewed time.Time `bson:"renewed" json:"renewed"`
+	Expires time.Time `bson:"expires" json:"expires"`
+}
+
+// LeaseStore keeps the lease documents, mongo or a fake in the tests
+type LeaseStore interface {
+	// Renew extends the lease still held by the holder with the token, nil when it is not
+	Renew(name, holder string, token int64, now, expires time.Time) (*Lease, error)
+	// TakeOver gives the lease expired before now to the holder with the next token, nil when there is none
+	TakeOver(name, holder string, now, expires time.Time) (*Lease, error)
+	// Create inserts the first lease, or returns the one already there
+	Create(lease Lease) (*Lease, error)
+	// Check returns ErrNotLeader unless the lease is held by the holder with the token and not expired at now
+	Check(name, holder string, token int64, now time.Time) error
+}
+
+// LeaderLease elects one leader among the cmonit instances with a lease document in mongo.
+// The leader renews the lease before the TTL, a standby takes it over once expired.
+// There is no ttl index on the collection, as the token must outlive the expiry.
+type LeaderLease struct {
+	Name  string        // of the lease, e.g., cmonit
+	ID    string        // of the instance, e.g., hostname-pid
+	TTL   time.Duration // a lease not renewed within it can be taken over
+	Store LeaseStore    // nil to use the collection given to Init
+
+	mutex   sync.Mutex
+	lease   Lease     // the last one read
+	held    bool      // the last one read is held by the instance
+	validTo time.Time // end of the held lease, counted from before the renewal was sent
+	checked time.Time // last time the lease was read
+}
+
+// Init will set the collection of the lease, db can be nil to only track the lease
+func (l *LeaderLease) Init(db *DB, colKey string) error {
+	if l.Name == "" || l.ID == "" || l.TTL <= 0 {
+		return errors.New("Lease needs a name, an id and a positive ttl")
+	}
+	if l.Store != nil || db == nil {
+		return nil
+	}
+	if _, ok := db.cols[colKey]; !ok {
+		return errors.New("Cannot reach db collection " + colKey)
+	}
+	l.Store = &mongoLeaseStore{db: db, colKey: colKey}
+	return nil
+}
+
+// Acquire renews the lease when held, or takes it over when expired or missing,
+// and tells whether the instance is the leader. now should be taken before the call.
+func (l *LeaderLease) Acquire(now time.Time) (bool, error) {
+	if l.Store == nil {
+		return false, errors.New("db session is nil")
+	}
+	l.mutex.Lock()
+	held, token := l.held, l.lease.Token
+	l.mutex.Unlock()
+
+	var lease *Lease
+	var err error
+	expires := now.Add(l.TTL)
+	if held { // renew when nobody took it over
+		lease, err = l.Store.Renew(l.Name, l.ID, token, now, expires)
+	}
+	if err == nil && lease == nil { // take over the expired one with the next token
+		lease, err = l.Store.TakeOver(l.Name, l.ID, now, expires)
+	}
+	if err == nil && lease == nil { // the first one, or held by another instance
+		lease, err = l.Store.Create(Lease{Name: l.Name, Holder: l.ID, Token: 1, Renewed: now, Expires: expires})
+	}
+	if err != nil {
+		logger.Warningf("Failed to acquire the lease %s: %v\n", l.Name, err)
+		return l.IsLeader(time.Now()), err
+	}
+	return l.Observe(*lease, now), nil
+}
+
+// Observe records the lease read from the db, with now taken before the read,
+// and tells whether the instance is the leader
+func (l *LeaderLease) Observe(lease Lease, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if lease.Holder == l.ID && lease.Token != l.lease.Token {
+		logger.Infof("Became the leader of %s with token %d\n", l.Name, lease.Token)
+	} else if l.held && (lease.Holder != l.ID || lease.Token != l.lease.Token) {
+		logger.Warningf("Lost the leader lease of %s to %s with token %d\n", l.Name, lease.Holder, lease.Token)
+	}
+	l.lease, l.checked = lease, now
+	l.held = lease.Holder == l.ID
+	if l.held {
+		l.validTo = now.Add(l.TTL)
+	}
+	return l.held
+}
+
+// IsLeader tells whether the instance holds a lease not expired at now
+func (l *LeaderLease) IsLeader(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.held && now.Before(l.validTo)
+}
+
+// Fence returns the token to stamp on a write, checked in the store against the current lease,
+// so an old leader paused or cut off past its lease cannot write after the takeover.
+// It returns ErrNotLeader when the lease is expired by the clock or held with another token.
+func (l *LeaderLease) Fence() (int64, error) {
+	now := time.Now()
+	if !l.IsLeader(now) {
+		return 0, ErrNotLeader
+	}
+	l.mutex.Lock()
+	token := l.lease.Token
+	l.mutex.Unlock()
+	if l.Store == nil {
+		return 0, errors.New("db session is nil")
+	}
+	if err := l.Store.Check(l.Name, l.ID, token, now); err != nil {
+		if err == ErrNotLeader {
+			l.mutex.Lock()
+			if l.held && l.lease.Token == token {
+				logger.Warningf("Lost the leader lease of %s with token %d, found at a write\n", l.Name, token)
+				l.held = false
+			}
+			l.mutex.Unlock()
+		}
+		return 0, err
+	}
+	return token, nil
+}
+
+// Current returns the last lease read and when it was read
+func (l *LeaderLease) Current() (Lease, time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lease, l.checked
+}
+
+// mongoLeaseStore keeps the leases in a collection of the db
+type mongoLeaseStore struct {
+	db     *DB
+	colKey string
+}
+
+// col returns the collection of the leases
+func (s *mongoLeaseStore) col() (*mgo.Collection, error) {
+	if s.db.session == nil {
+		return nil, errors.New("db session is nil")
+	}
+	c, ok := s.db.cols[s.colKey]
+	if !ok {
+		return nil, errors.New("db collection is not opened")
+	}
+	return c, nil
+}
+
+// apply updates the lease matching the query and returns the new one, nil when none matches
+func (s *mongoLeaseStore) apply(query, update bson.M) (*Lease, error) {
+	c, err := s.col()
+	if err != nil {
+		return nil, err
+	}
+	var lease Lease
+	if _, err = c.Find(query).Apply(mgo.Change{Update: update, ReturnNew: true}, &lease); err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (s *mongoLeaseStore) Renew(name, holder string, token int64, now, expires time.Time) (*Lease, error) {
+	return s.apply(bson.M{"_id": name, "holder": holder, "token": token},
+		bson.M{"$set": bson.M{"renewed": now, "expires": expires}})
+}
+
+func (s *mongoLeaseStore) TakeOver(name, holder string, now, expires time.Time) (*Lease, error) {
+	return s.apply(bson.M{"_id": name, "expires": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"holder": holder, "renewed": now, "expires": expires}, "$inc": bson.M{"token": 1}})
+}
+
+func (s *mongoLeaseStore) Check(name, holder string, token int64, now time.Time) error {
+	c, err := s.col()
+	if err != nil {
+		return err
+	}
+	n, err := c.Find(bson.M{"_id": name, "holder": holder, "token": token, "expires": bson.M{"$gt": now}}).Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+func (s *mongoLeaseStore) Create(lease Lease) (*Lease, error) {
+	c, err := s.col()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Insert(lease); mgo.IsDup(err) { // inserted by another instance
+		err = c.FindId(lease.Name).One(&lease)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
@@ -0,0 +1,30 @@
+package data
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Process is a process in a container from the top
+type Process struct {
+	PID           string  `bson:"pid" json:"pid"`
+	PPID          string  `bson:"ppid,omitempty" json:"ppid,omitempty"`
+	User          string  `bson:"user,omitempty" json:"user,omitempty"`
+	CPUPercentage float64 `bson:"cpu_percentage" json:"cpu_percentage"` // of one cpu since the last sample, or over the process lifetime at the first one
+	CPUTime       float64 `bson:"cpu_time" json:"cpu_time"`             // seconds of cpu used since the process started
+	RSS           float64 `bson:"rss" json:"rss"`                       // bytes
+	Elapsed       string  `bson:"elapsed,omitempty" json:"elapsed,omitempty"`
+	Command       string  `bson:"command" json:"command"`
+}
+
+// ProcessStat is a document of the top processes of a container
+type ProcessStat struct {
+	_ID           bson.ObjectId `bson:"_id,omitempty"`
+	ContainerID   string        `bson:"container_id,omitempty"`
+	ContainerName string        `bson:"container_name,omitempty"`
+	Total         int           `bson:"total"` // processes in the container
+	SortBy        string        `bson:"sort_by"`
+	Processes     []Process     `bson:"processes"`
+	TimeStamp     time.Time     `bson:"timestamp,omitempty"`
+}
@@ -0,0 +1,259 @@
+package data
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/yeasy/cmonit/util"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// most periods to roll up for a level in one run, to limit the catch-up work
+const rollupMaxPeriods = 120
+
+// RollupLevel is a granularity of the rollup
+type RollupLevel struct {
+	Name      string        // suffix of the collection, e.g., 1m for container_1m
+	Period    time.Duration // length of each rollup document
+	Retention int           // days to keep the documents, <= 0 means never expire
+}
+
+// Rollup aggregates the stat documents of a collection into coarser ones,
+// each level from the one before it, with min/max/avg/p95 of every number field.
+// The p95 above the first level is taken over the p95 values of the lower level.
+type Rollup struct {
+	db      *DB
+	colKey  string // key of the raw collection, e.g., container
+	idField string // e.g., container_id
+	levels  []RollupLevel
+	next    map[string]time.Time // level collection -> start of the next period to roll up
+}
+
+// Init will set up the rollup collections of the raw collection colKey (named colName),
+// with the ttl and index on them
+func (r *Rollup) Init(db *DB, colKey, colName, idField string, levels []RollupLevel) error {
+	if db == nil || db.session == nil {
+		return errors.New("db session is nil")
+	}
+	if _, ok := db.cols[colKey]; !ok {
+		return errors.New("Cannot reach db collection " + colKey)
+	}
+	r.db, r.colKey, r.idField = db, colKey, idField
+	r.levels = levels
+	r.next = make(map[string]time.Time)
+	// the raw documents are read by time range
+	if err := db.SetCompoundIndex(colKey, "timestamp"); err != nil {
+		return err
+	}
+	for _, l := range levels {
+		key := colKey + "_" + l.Name
+		db.SetCol(key, colName+"_"+l.Name)
+		if err := db.cols[key].EnsureIndex(mgo.Index{Key: []string{idField, "start"}, Background: true}); err != nil {
+			logger.Warningf("Failed to set index on collection %s\n", key)
+			return err
+		}
+		if l.Retention > 0 {
+			if err := db.SetIndex(key, "start", l.Retention); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run rolls up the periods finished before now. Raw documents are taken delay
+// after the period ends, to wait for the late ones.
+func (r *Rollup) Run(now time.Time, delay time.Duration) error {
+	// the time before which the source level is complete
+	sourceDone := now.Add(-delay)
+	sourceKey, timeField := r.colKey, "timestamp"
+	for _, l := range r.levels {
+		key := r.colKey + "_" + l.Name
+		next, ok := r.next[key]
+		if !ok {
+			var err error
+			if next, err = r.nextStart(key, l.Period, sourceDone); err != nil {
+				return err
+			}
+		}
+		n := 0
+		var err error
+		for ; !next.Add(l.Period).After(sourceDone) && n < rollupMaxPeriods; n++ {
+			if err = r.rollupPeriod(sourceKey, timeField, key, next, next.Add(l.Period)); err != nil {
+				break
+			}
+			next = next.Add(l.Period)
+		}
+		// only the periods written are skipped in the next run, the others are rolled up again
+		if ferr := r.db.flushCol(key); ferr != nil {
+			return ferr
+		}
+		r.next[key] = next
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			logger.Debugf("Rolled up %d periods into %s till %s\n", n, key, next.Format(time.RFC3339))
+		}
+		sourceDone, sourceKey, timeField = next, key, "start"
+	}
+	return nil
+}
+
+// nextStart returns the start of the next period to roll up at startup, that is
+// the end of the latest document, or the last finished period when there is none yet
+func (r *Rollup) nextStart(key string, period time.Duration, sourceDone time.Time) (time.Time, error) {
+	var last struct {
+		End time.Time `bson:"end"`
+	}
+	err := r.db.cols[key].Find(nil).Sort("-start").Select(bson.M{"end": 1}).One(&last)
+	if err == mgo.ErrNotFound {
+		return sourceDone.Truncate(period).Add(-period).UTC(), nil
+	}
+	if err != nil {
+		logger.Warningf("Cannot get the latest document in %s\n", key)
+		return time.Time{}, err
+	}
+	return last.End.UTC(), nil
+}
+
+// rollupPeriod aggregates the source documents in [start, end) into the target collection.
+// The documents of the period written by a failed run before are replaced.
+func (r *Rollup) rollupPeriod(sourceKey, timeField, targetKey string, start, end time.Time) error {
+	var docs []bson.M
+	query := bson.M{timeField: bson.M{"$gte": start, "$lt": end}}
+	if err := r.db.cols[sourceKey].Find(query).All(&docs); err != nil {
+		logger.Warningf("Cannot read %s for rollup\n", sourceKey)
+		return err
+	}
+	rollups := RollupDocs(docs, r.idField, start, end)
+	ids := make([]string, len(rollups))
+	for i, doc := range rollups {
+		ids[i] = doc[r.idField].(string)
+	}
+	if _, err := r.db.fenced(); err != nil {
+		return err
+	}
+	if _, err := r.db.cols[targetKey].RemoveAll(bson.M{r.idField: bson.M{"$in": ids}, "start": start}); err != nil {
+		logger.Warningf("Cannot clean %s before rollup\n", targetKey)
+		return err
+	}
+	for _, doc := range rollups {
+		if err := r.db.SaveData(doc, targetKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RollupDocs groups the documents by idField, and aggregates them into one
+// document of each id for [start, end). The documents are either the raw stats,
+// or the rollup documents of a finer level.
+func RollupDocs(docs []bson.M, idField string, start, end time.Time) []bson.M {
+	groups := make(map[string][]bson.M)
+	ids := []string{}
+	for _, doc := range docs {
+		id, ok := doc[idField].(string)
+		if !ok || id == "" {
+			continue
+		}
+		if _, ok := groups[id]; !ok {
+			ids = append(ids, id)
+		}
+		groups[id] = append(groups[id], doc)
+	}
+	sort.Strings(ids)
+
+	result := make([]bson.M, 0, len(ids))
+	for _, id := range ids {
+		group := groups[id]
+		out := bson.M{idField: id, "start": start, "end": end}
+		count := 0
+		numbers := make(map[string]bool) // number fields, missing in a raw document means 0
+		rollups := make(map[string]bool) // fields already rolled up
+		for _, doc := range group {
+			if c, ok := toFloat(doc["count"]); ok && doc["start"] != nil {
+				count += int(c)
+			} else {
+				count++
+			}
+			for k, v := range doc {
+				switch k {
+				case "_id", idField, "timestamp", "start", "end", "count":
+					continue
+				}
+				switch v := v.(type) {
+				case string:
+					out[k] = v // keep the names
+				case bson.M:
+					if _, ok := v["avg"]; ok { // not the labels
+						rollups[k] = true
+					}
+				default:
+					if _, ok := toFloat(v); ok {
+						numbers[k] = true
+					}
+				}
+			}
+		}
+		out["count"] = count
+
+		for k := range numbers {
+			values := make([]float64, len(group))
+			for i, doc := range group {
+				values[i], _ = toFloat(doc[k])
+			}
+			d := util.Aggregate(values)
+			out[k] = bson.M{"min": d.Min, "max": d.Max, "avg": d.Avg, "p95": d.P95}
+		}
+		for k := range rollups {
+			var mins, maxs, p95s []float64
+			var sum, weight float64
+			for _, doc := range group {
+				sub, ok := doc[k].(bson.M)
+				if !ok {
+					continue
+				}
+				w, ok := toFloat(doc["count"])
+				if !ok || w <= 0 {
+					w = 1
+				}
+				min, _ := toFloat(sub["min"])
+				max, _ := toFloat(sub["max"])
+				avg, _ := toFloat(sub["avg"])
+				p95, _ := toFloat(sub["p95"])
+				mins, maxs, p95s = append(mins, min), append(maxs, max), append(p95s, p95)
+				sum += avg * w
+				weight += w
+			}
+			if weight == 0 {
+				continue
+			}
+			out[k] = bson.M{
+				"min": util.Aggregate(mins).Min,
+				"max": util.Aggregate(maxs).Max,
+				"avg": sum / weight,
+				"p95": util.Percentile(p95s, 95),
+			}
+		}
+		result = append(result, out)
+	}
+	return result
+}
+
+// toFloat converts the number values decoded from bson
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -15,8 +15,6 @@
 package main
 
 import (
-	"net/http"
-	_ "net/http/pprof"
 	_ "runtime"
 
 	"github.com/op/go-logging"
@@ -27,10 +25,7 @@ func main() {
 
 	//runtime.GOMAXPROCS(1024)
 
-	/* This is only for profiling*/
-	go func() {
-		http.ListenAndServe(":6060", nil)
-	}()
+	// profiling is served on the admin listener with admin.pprof
 
 	level, _ := logging.LogLevel("INFO")
 	logging.SetLevel(level, "cmd")
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+)
+
+func TestAccountantObserve(t *testing.T) {
+	a := &data.Accountant{Interval: 30 * time.Second, MaxGap: 90 * time.Second}
+	if err := a.Init(nil, "usage"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2016, 11, 30, 23, 59, 0, 0, time.UTC)
+	stat := func(id, user string, ts time.Time, rx float64) *data.ClusterStat {
+		return &data.ClusterStat{ClusterID: id, UserID: user, Memory: 2 * (1 << 30), NetworkRx: rx, NetworkTx: rx / 2,
+			CPUDistribution: util.Distribution{Sum: 200}, TimeStamp: ts}
+	}
+	a.Observe(stat("c1", "u1", start, 1000))                     // first sample counts the interval, but no network
+	a.Observe(stat("c1", "u1", start.Add(30*time.Second), 3000)) // 30s later
+	a.Observe(stat("c1", "u1", start.Add(30*time.Second), 3000)) // duplicated
+	a.Observe(stat("c1", "u1", start.Add(10*time.Minute), 500))  // counter restarted, gap capped to 90s
+	a.Observe(stat("c2", "", start.Add(30*time.Second), 0))      // no user
+	records := a.Pending()
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %+v", records)
+	}
+	if records[0].UserID != "u1" || records[0].Day != "2016-11-30" || records[1].Day != "2016-12-01" || records[2].UserID != data.UsageUnassigned {
+		t.Fatalf("Wrong records %+v", records)
+	}
+	u1 := records[0]
+	// 60s of 2 cpus and 2GB
+	if u1.CPUSeconds != 120 || math.Abs(u1.MemoryGBHours-2.0/60) > 1e-9 || math.Abs(u1.ClusterHours-1.0/60) > 1e-9 {
+		t.Errorf("Wrong usage %+v", u1)
+	}
+	if u1.NetworkRxBytes != 2000 || u1.NetworkTxBytes != 1000 {
+		t.Errorf("Wrong network usage %+v", u1)
+	}
+	next := records[1]
+	if next.CPUSeconds != 180 || next.NetworkRxBytes != 500 {
+		t.Errorf("Wrong usage of the next day %+v", next)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Pending()) != 0 {
+		t.Error("Pending usage should be cleared after flush")
+	}
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+)
+
+func TestAggregate(t *testing.T) {
+	if d := util.Aggregate(nil); d != (util.Distribution{}) {
+		t.Errorf("Expect zero distribution for empty values, got %+v", d)
+	}
+	d := util.Aggregate([]float64{4, 2, 8, 6})
+	if d.Count != 4 || d.Sum != 20 || d.Min != 2 || d.Max != 8 || d.Avg != 5 || d.P50 != 5 {
+		t.Errorf("Wrong distribution %+v", d)
+	}
+	if math.Abs(d.P95-7.7) > 1e-9 || math.Abs(d.StdDev-math.Sqrt(5)) > 1e-9 {
+		t.Errorf("Wrong p95 or stddev %+v", d)
+	}
+}
+
+func TestCalculateStat(t *testing.T) {
+	c1 := data.ClusterStat{ClusterID: "c1"}
+	c1.CalculateStat([]*data.ContainerStat{
+		{CPUPercentage: 10, Memory: 300, MemoryLimit: 1000, MemoryPercentage: 30},
+		{CPUPercentage: 30, Memory: 900, MemoryLimit: 1000, MemoryPercentage: 90},
+		{CPUPercentage: 20, Memory: 500}, // no limit
+	})
+	c1.SetLatencies([]float64{1, 3})
+	if c1.CPUPercentage != 20 || c1.CPUDistribution.Max != 30 || c1.Memory != 1700 {
+		t.Errorf("Wrong cluster stat %+v", c1)
+	}
+	if c1.MemoryPercentage != 60 || c1.MemoryDistribution.Count != 2 {
+		t.Errorf("Memory percentage should be total usage over total limit, got %+v", c1)
+	}
+	if c1.AvgLatency != 2 || c1.MaxLatency != 3 || c1.MinLatency != 1 {
+		t.Errorf("Wrong latency of cluster %+v", c1)
+	}
+
+	c2 := data.ClusterStat{ClusterID: "c2"}
+	c2.CalculateStat([]*data.ContainerStat{
+		{CPUPercentage: 70, Memory: 1800, MemoryLimit: 2000, MemoryPercentage: 90},
+	})
+	c2.SetLatencies([]float64{5})
+
+	hs := data.HostStat{HostID: "h1"}
+	hs.CalculateStat([]*data.ClusterStat{&c1, &c2})
+	// the sum of cluster averages would be 150%
+	if hs.MemoryPercentage != 75 {
+		t.Errorf("Wrong host memory percentage %f", hs.MemoryPercentage)
+	}
+	if hs.CPUDistribution.Count != 4 || hs.CPUDistribution.Max != 70 || hs.CPUDistribution.P50 != 25 {
+		t.Errorf("Wrong host cpu distribution %+v", hs.CPUDistribution)
+	}
+	if hs.LatencyDistribution.Count != 3 || hs.LatencyDistribution.Max != 5 || hs.MaxLatency != 5 {
+		t.Errorf("Wrong host latency %+v", hs)
+	}
+
+	empty := data.HostStat{}
+	empty.CalculateStat(nil)
+	if empty.CPUDistribution.Count != 0 {
+		t.Errorf("Expect empty host stat, got %+v", empty)
+	}
+}
+
+func TestCalculateMemoryDetail(t *testing.T) {
+	c1 := data.ClusterStat{}
+	c1.CalculateStat([]*data.ContainerStat{
+		{Memory: 300, MemoryDetail: data.MemoryDetail{WorkingSet: 300, RSS: 200}},
+		{Memory: 500, MemoryDetail: data.MemoryDetail{WorkingSet: 500, RSS: 100}},
+	})
+	c2 := data.ClusterStat{}
+	c2.CalculateStat([]*data.ContainerStat{{Memory: 50, MemoryDetail: data.MemoryDetail{WorkingSet: 50, RSS: 40}}})
+	if c1.MemoryWorkingSet != 800 || c1.MemoryRSS != 300 {
+		t.Errorf("Wrong memory sums of cluster %+v", c1)
+	}
+	h := data.HostStat{}
+	h.CalculateStat([]*data.ClusterStat{&c1, &c2})
+	if h.MemoryWorkingSet != 850 || h.MemoryRSS != 340 {
+		t.Errorf("Wrong memory sums of host %+v", h)
+	}
+}
+
+func TestCalculateThrottled(t *testing.T) {
+	c1 := data.ClusterStat{}
+	c1.CalculateStat([]*data.ContainerStat{
+		{CPUDetail: data.CPUDetail{ThrottleRatio: 0.5}},
+		{CPUDetail: data.CPUDetail{ThrottleRatio: 0}},
+		{CPUDetail: data.CPUDetail{ThrottleRatio: 0.01}},
+	})
+	c2 := data.ClusterStat{}
+	c2.CalculateStat([]*data.ContainerStat{{CPUDetail: data.CPUDetail{ThrottleRatio: 1}}})
+	h := data.HostStat{}
+	h.CalculateStat([]*data.ClusterStat{&c1, &c2})
+	if c1.Throttled != 2 || c2.Throttled != 1 || h.Throttled != 3 {
+		t.Errorf("Wrong throttled containers %d %d %d", c1.Throttled, c2.Throttled, h.Throttled)
+	}
+}
@@ -0,0 +1,51 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/data"
+)
+
+func TestDetector(t *testing.T) {
+	d := &data.Detector{Alpha: 0.1, Sigmas: 3, ShiftSigmas: 1.5, ShiftRounds: 5, Warmup: 10, MinRelativeStdDev: 0.05}
+	ts := time.Now().UTC()
+	observe := func(v float64) *data.Anomaly {
+		return d.Observe("container", "c1", "vp0", "cpu_percentage", v, ts)
+	}
+
+	// learn a noisy baseline around 20
+	for i := 0; i < 50; i++ {
+		if a := observe(20 + float64(i%3) - 1); a != nil {
+			t.Fatalf("Unexpected anomaly in normal samples %+v", *a)
+		}
+	}
+	a := observe(60)
+	if a == nil || a.Reason != data.AnomalySpike || a.Score < 3 {
+		t.Fatalf("Expect a spike, got %+v", a)
+	}
+
+	// a sustained moderate increase is a shift before the baseline catches up
+	d2 := &data.Detector{Alpha: 0.01, Sigmas: 10, ShiftSigmas: 1.5, ShiftRounds: 5, Warmup: 10}
+	for i := 0; i < 50; i++ {
+		d2.Observe("cluster", "n1", "n1", "cpu_percentage", 20+float64(i%3)-1, ts)
+	}
+	var shift *data.Anomaly
+	for i := 0; i < 5 && shift == nil; i++ {
+		shift = d2.Observe("cluster", "n1", "n1", "cpu_percentage", 23, ts)
+		if shift != nil && i != 4 {
+			t.Errorf("Shift reported after %d rounds, expect 5", i+1)
+		}
+	}
+	if shift == nil || shift.Reason != data.AnomalyShift {
+		t.Errorf("Expect a shift, got %+v", shift)
+	}
+
+	// a new metric is not reported in warmup
+	if a := d.Observe("container", "c2", "vp1", "cpu_percentage", 0, ts); a != nil {
+		t.Errorf("Unexpected anomaly in warmup %+v", *a)
+	}
+	if a := d.Observe("container", "c2", "vp1", "cpu_percentage", 100, ts); a != nil {
+		t.Errorf("Unexpected anomaly in warmup %+v", *a)
+	}
+}
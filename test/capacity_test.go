@@ -0,0 +1,64 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/yeasy/cmonit/data"
+)
+
+func TestCalculateCapacity(t *testing.T) {
+	host := &data.Host{ID: "h1", Name: "h1", Status: "active", Capacity: 3}
+	cs := data.ClusterStat{}
+	cs.CalculateStat([]*data.ContainerStat{
+		{CPUPercentage: 150, Memory: 4e9},
+		{CPUPercentage: 50, Memory: 2e9},
+	})
+	hs := data.HostStat{}
+	hs.CalculateStat([]*data.ClusterStat{&cs, &cs})
+
+	// 4 cpus and 8G memory, 400% - 2*200% used
+	c := data.CalculateCapacity(host, &hs, 2, 4, 16e9, 10, 10)
+	if c.ClustersUsed != 2 || c.FreeSlots != 1 || c.CPUCapacity != 400 || c.CPUHeadroom != 0 || c.MemoryHeadroom != 4e9 {
+		t.Errorf("Wrong capacity %+v", c)
+	}
+	if c.Accepting {
+		t.Error("Host without cpu headroom should not accept new clusters")
+	}
+	c = data.CalculateCapacity(host, &hs, 2, 8, 16e9, 10, 10)
+	if !c.Accepting {
+		t.Errorf("Host should accept new clusters %+v", c)
+	}
+
+	// no cluster and no limit
+	empty := data.CalculateCapacity(&data.Host{Name: "h2", Status: "active"}, nil, 0, 0, 0, 10, 10)
+	if empty.FreeSlots != -1 || !empty.Accepting || empty.ClustersUsed != 0 {
+		t.Errorf("Wrong capacity of empty host %+v", empty)
+	}
+	full := data.CalculateCapacity(&data.Host{Name: "h3", Status: "active", Capacity: 2}, &hs, 2, 0, 0, 10, 10)
+	if full.FreeSlots != 0 || full.Accepting {
+		t.Errorf("Full host should not accept new clusters %+v", full)
+	}
+
+	// one of the 3 clusters failed, the host is still counted with all of them
+	partial := data.CalculateCapacity(host, nil, 3, 8, 16e9, 10, 10)
+	if partial.ClustersUsed != 3 || partial.FreeSlots != 0 || partial.Accepting {
+		t.Errorf("Wrong capacity of host with a failed cluster %+v", partial)
+	}
+	partial = data.CalculateCapacity(&data.Host{Name: "h5", Status: "active"}, nil, 1, 8, 16e9, 10, 10)
+	if partial.ClustersUsed != 1 || partial.FreeSlots != -1 || partial.Accepting {
+		t.Errorf("Host with unknown usage should not accept new clusters %+v", partial)
+	}
+
+	fleet := data.CalculateFleet([]data.FleetHost{
+		{HostID: "h3", HostName: "h3", Status: "active", HostCapacity: full},
+		{HostID: "h1", HostName: "h1", Status: "active", HostCapacity: c},
+		{HostID: "h4", HostName: "h4", Status: "unreachable"},
+		{HostID: "h2", HostName: "h2", Status: "active", HostCapacity: empty},
+	})
+	if fleet.Hosts != 4 || fleet.ActiveHosts != 3 || fleet.AcceptingHosts != 2 || fleet.ClustersUsed != 4 || fleet.Capacity != 5 || fleet.FreeSlots != 1 {
+		t.Errorf("Wrong fleet %+v", fleet)
+	}
+	if fleet.Members[0].HostID != "h1" || fleet.Members[1].HostID != "h2" {
+		t.Errorf("Accepting hosts with more memory should be first, got %+v", fleet.Members)
+	}
+}
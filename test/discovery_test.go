@@ -0,0 +1,132 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/agent"
+	"github.com/yeasy/cmonit/data"
+)
+
+// fakeDaemon serves the docker api paths, without the version prefix, with the handlers
+func fakeDaemon(t *testing.T, handlers map[string]http.HandlerFunc) (*httptest.Server, *client.Client) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/v1.") {
+			path = path[strings.Index(path[1:], "/")+1:]
+		}
+		h, ok := handlers[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		h(w, r)
+	}))
+	cli, err := client.NewClient("tcp://"+strings.TrimPrefix(server.URL, "http://"), "v1.22", nil, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, cli
+}
+
+// hasLabels tells whether the labels match all the label filters, as key or key=value
+func hasLabels(labels map[string]string, label []string) bool {
+	for _, f := range label {
+		kv := strings.SplitN(f, "=", 2)
+		v, ok := labels[kv[0]]
+		if !ok || (len(kv) == 2 && v != kv[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDiscoverClusters(t *testing.T) {
+	containers := []types.Container{
+		{ID: "id0", Names: []string{"/vp0"}, Labels: map[string]string{"monitor": "true", "net": "n1", "owner": "alice", "title": "chain1"}},
+		{ID: "id1", Names: []string{"/vp1"}, Labels: map[string]string{"monitor": "true", "com.docker.compose.project": "n1"}},
+		{ID: "id2", Names: []string{"/vp2"}, Labels: map[string]string{"monitor": "true", "com.docker.compose.project": "n2"}},
+		{ID: "id3", Names: []string{"/other"}, Labels: map[string]string{"monitor": "true"}},                       // no cluster label
+		{ID: "id4", Names: []string{"/vp4"}, Labels: map[string]string{"net": "n1"}},                               // filtered out
+		{ID: "id5", Names: []string{"/vp5"}, Labels: map[string]string{"monitor": "false", "net": "n3", "x": "y"}}, // filtered out
+	}
+	server, cli := fakeDaemon(t, map[string]http.HandlerFunc{
+		"/containers/json": func(w http.ResponseWriter, r *http.Request) {
+			args, err := filters.FromParam(r.URL.Query().Get("filters"))
+			if err != nil {
+				t.Errorf("Invalid filters %s: %v", r.URL.Query().Get("filters"), err)
+			}
+			result := []types.Container{}
+			for _, c := range containers {
+				if hasLabels(c.Labels, args.Get("label")) {
+					result = append(result, c)
+				}
+			}
+			json.NewEncoder(w).Encode(result)
+		},
+	})
+	defer server.Close()
+
+	viper.Set("input.discovery.filter", "monitor=true")
+	viper.Set("input.discovery.cluster_labels", "net,com.docker.compose.project")
+	viper.Set("input.discovery.name_label", "title")
+	viper.Set("input.discovery.user_label", "owner")
+	defer func() {
+		for _, key := range []string{"filter", "cluster_labels", "name_label", "user_label"} {
+			viper.Set("input.discovery."+key, nil)
+		}
+	}()
+
+	host := &data.Host{ID: "host0", Name: "host0", DaemonURL: "tcp://10.0.0.1:2375"}
+	clusters, err := agent.DiscoverClusters(cli, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("Expect 2 clusters, got %+v", clusters)
+	}
+	n1, n2 := clusters[0], clusters[1]
+	if n1.ID != "host0/n1" || n1.Name != "chain1" || n1.UserID != "alice" || n1.Size != 2 ||
+		n1.Containers["vp0"] != "id0" || n1.Containers["vp1"] != "id1" {
+		t.Errorf("Wrong cluster n1 %+v", n1)
+	}
+	if n2.ID != "host0/n2" || n2.Name != "n2" || n2.UserID != "" || len(n2.Containers) != 1 {
+		t.Errorf("Wrong cluster n2 %+v", n2)
+	}
+	for _, c := range clusters {
+		if c.HostID != "host0" || c.DaemonURL != host.DaemonURL {
+			t.Errorf("Expect the cluster %s on host0, got %s %s", c.ID, c.HostID, c.DaemonURL)
+		}
+	}
+
+	// the same project on another host is another cluster
+	other := &data.Host{ID: "host1", Name: "host1", DaemonURL: "tcp://10.0.0.2:2375"}
+	otherClusters, err := agent.DiscoverClusters(cli, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(otherClusters) != 2 || otherClusters[0].ID != "host1/n1" || otherClusters[0].Name != "chain1" ||
+		otherClusters[1].ID != "host1/n2" || otherClusters[1].Name != "n2" {
+		t.Errorf("Expect the clusters scoped by host1, got %+v", otherClusters)
+	}
+	for i := range clusters {
+		if clusters[i].ID == otherClusters[i].ID {
+			t.Errorf("Expect the cluster %s apart on the two hosts", clusters[i].ID)
+		}
+	}
+
+	// the daemon is down
+	server.Close()
+	if _, err := agent.DiscoverClusters(cli, host); err == nil {
+		t.Error("Expect an error when the daemon is down")
+	}
+}
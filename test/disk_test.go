@@ -0,0 +1,63 @@
+package test
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yeasy/cmonit/agent"
+	"github.com/yeasy/cmonit/data"
+)
+
+func TestDecodeDiskUsage(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "system_df_v1.41.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hd, containers, err := agent.DecodeDiskUsage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hd.DiskImages != 1092588 || hd.DiskContainers != 4096+8192 || hd.DiskVolumes != 1048576 || hd.DiskBuildCache != 51 {
+		t.Errorf("Wrong host disk usage %+v", hd)
+	}
+	if hd.DiskUsage != 1092588+4096+8192+1048576+51 {
+		t.Errorf("Wrong total disk usage %f", hd.DiskUsage)
+	}
+
+	vp0, ok := containers["cluster0_vp0"]
+	if !ok {
+		t.Fatalf("No disk usage by name %+v", containers)
+	}
+	if byID := containers["e90e34656806f2c6d3f4ea3d0d8e8a1a6f5f2f4e2b1a0b5e0c1d2e3f4a5b6c7d"]; byID.SizeRw != vp0.SizeRw {
+		t.Errorf("Wrong disk usage by id %+v", byID)
+	}
+	if vp0.SizeRw != 4096 || vp0.SizeRootFs != 1096684 || vp0.VolumesSize != 1048576 || vp0.Volumes["cluster0_ledger"] != 1048576 {
+		t.Errorf("Wrong container disk usage %+v", vp0)
+	}
+	// the size of cache is not calculated
+	if vp1 := containers["cluster0_vp1"]; vp1.VolumesSize != 1048576 || len(vp1.Volumes) != 1 {
+		t.Errorf("Wrong container volumes %+v", vp1)
+	}
+
+	// a volume shared by the containers is counted once in the cluster
+	cs := data.ClusterStat{}
+	cs.CalculateStat([]*data.ContainerStat{{DiskUsage: vp0}, {DiskUsage: containers["cluster0_vp1"]}})
+	if cs.DiskSizeRw != 4096+8192 || cs.DiskVolumesSize != 1048576 || cs.DiskUsage != 4096+8192+1048576 {
+		t.Errorf("Wrong cluster disk usage %f %f %f", cs.DiskSizeRw, cs.DiskVolumesSize, cs.DiskUsage)
+	}
+}
+
+func TestDiskGrowth(t *testing.T) {
+	hd := data.HostDisk{DiskUsage: 60e9, DiskCapacity: 100e9}
+	hd.SetGrowth(50e9, 10)
+	if hd.DiskGrowthRate != 1e9 || math.Abs(hd.DiskFullDays-40.0/24) > 1e-9 {
+		t.Errorf("Wrong disk growth %+v", hd)
+	}
+	hd.SetGrowth(70e9, 10)
+	if hd.DiskGrowthRate != -1e9 || hd.DiskFullDays != 0 {
+		t.Errorf("Wrong disk shrink %+v", hd)
+	}
+}
@@ -0,0 +1,411 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/agent"
+	"github.com/yeasy/cmonit/data"
+)
+
+// testCert is a certificate written to files, signed by ca or self-signed
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+	pair     tls.Certificate
+}
+
+// newTestCert makes a certificate valid for 127.0.0.1 in the period, as a CA when ca is nil
+func newTestCert(t *testing.T, dir, name string, notBefore, notAfter time.Time, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca == nil,
+	}
+	parent, parentKey := template, key
+	if ca != nil {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{key: key, certFile: filepath.Join(dir, name+".pem"), keyFile: filepath.Join(dir, name+"-key.pem")}
+	if c.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(c.certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c.pair, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// daemonRecorder serves /version and /info of a daemon, and records the requests
+type daemonRecorder struct {
+	mutex       sync.Mutex
+	paths       []string
+	clientCerts []string // common name of the client cert of each request
+	failing     bool     // answer each request with an error
+}
+
+func (d *daemonRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mutex.Lock()
+	d.paths = append(d.paths, r.URL.Path)
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		d.clientCerts = append(d.clientCerts, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	failing := d.failing
+	d.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case failing:
+		http.Error(w, "daemon is starting", http.StatusInternalServerError)
+	case strings.HasSuffix(r.URL.Path, "/version"):
+		json.NewEncoder(w).Encode(types.Version{Version: "1.12.0", APIVersion: "1.24"})
+	case strings.HasSuffix(r.URL.Path, "/info"):
+		json.NewEncoder(w).Encode(types.Info{NCPU: 2, MemTotal: 1 << 30})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// requests returns the paths and client certs seen, and forgets them
+func (d *daemonRecorder) requests() ([]string, []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	paths, certs := d.paths, d.clientCerts
+	d.paths, d.clientCerts = nil, nil
+	return paths, certs
+}
+
+func TestDockerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	ca := newTestCert(t, dir, "ca", now.Add(-time.Hour), now.Add(time.Hour), nil)
+	server := newTestCert(t, dir, "daemon", now.Add(-time.Hour), now.Add(time.Hour), ca)
+	client := newTestCert(t, dir, "cmonit", now.Add(-time.Hour), now.Add(time.Hour), ca)
+	expired := newTestCert(t, dir, "expired", now.Add(-2*time.Hour), now.Add(-time.Hour), ca)
+	future := newTestCert(t, dir, "future", now.Add(time.Hour), now.Add(2*time.Hour), ca)
+	notCert := filepath.Join(dir, "not-cert.pem")
+	ioutil.WriteFile(notCert, []byte("not a certificate"), 0600)
+
+	// the daemon asks the client cert signed by the CA
+	recorder := &daemonRecorder{}
+	daemon := httptest.NewUnstartedServer(recorder)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	daemon.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	daemon.StartTLS()
+	defer daemon.Close()
+	daemonURL := "tcp://" + strings.TrimPrefix(daemon.URL, "https://")
+
+	for _, c := range []struct {
+		name string
+		host data.Host
+	}{
+		{"verify", data.Host{TLSMode: "verify", TLSCA: ca.certFile, TLSCert: client.certFile, TLSKey: client.keyFile}},
+		{"verify by default with a cert", data.Host{TLSCA: ca.certFile, TLSCert: client.certFile, TLSKey: client.keyFile}},
+		{"insecure", data.Host{TLSMode: "insecure", TLSCert: client.certFile, TLSKey: client.keyFile}},
+	} {
+		c.host.Name, c.host.DaemonURL = c.name, daemonURL
+		hm := new(agent.HostMonitor)
+		if err := hm.Init(&c.host, &hostsInventory{}, nil, ""); err != nil {
+			t.Errorf("%s: Expect the host inited, got %v", c.name, err)
+			continue
+		}
+		paths, certs := recorder.requests()
+		if len(paths) == 0 || len(certs) != len(paths) || certs[0] != "cmonit" {
+			t.Errorf("%s: Expect the requests with the client cert, got %v with %v", c.name, paths, certs)
+		}
+	}
+
+	// the client is inited again when the host is changed in the inventory
+	other := newTestCert(t, dir, "cmonit2", now.Add(-time.Hour), now.Add(time.Hour), ca)
+	host := data.Host{Name: "reload", DaemonURL: daemonURL, Status: "active", TLSCA: ca.certFile, TLSCert: client.certFile, TLSKey: client.keyFile}
+	hm := new(agent.HostMonitor)
+	if err := hm.Init(&host, &hostsInventory{}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	recorder.requests()
+	c := make(chan string, 1)
+	host.Name = "renamed"
+	hm.Monit(host, &hostsInventory{}, nil, c)
+	if name := <-c; name != "renamed" {
+		t.Errorf("Expect the renamed host reported, got %s", name)
+	}
+	if paths, _ := recorder.requests(); len(paths) != 0 {
+		t.Errorf("Expect no init again for the same settings, got %v", paths)
+	}
+	host.TLSCert, host.TLSKey = other.certFile, other.keyFile
+	hm.Monit(host, &hostsInventory{}, nil, c)
+	<-c
+	if paths, certs := recorder.requests(); len(paths) == 0 || certs[0] != "cmonit2" {
+		t.Errorf("Expect the requests with the new client cert, got %v with %v", paths, certs)
+	}
+	if capacity := hm.Capacity(); capacity.HostName != "renamed" || capacity.Status == "unreachable" {
+		t.Errorf("Wrong capacity after the init again %+v", capacity)
+	}
+
+	// the host settings take precedence over the global ones
+	viper.Set("docker.tls.mode", "verify")
+	viper.Set("docker.tls.ca_file", expired.certFile)
+	viper.Set("docker.tls.cert_file", client.certFile)
+	viper.Set("docker.tls.key_file", client.keyFile)
+	defer func() {
+		for _, key := range []string{"mode", "ca_file", "cert_file", "key_file"} {
+			viper.Set("docker.tls."+key, nil)
+		}
+	}()
+	hm = new(agent.HostMonitor)
+	if err := hm.Init(&data.Host{Name: "global", DaemonURL: daemonURL, TLSCA: ca.certFile}, &hostsInventory{}, nil, ""); err != nil {
+		t.Errorf("Expect the CA of the host used, got %v", err)
+	}
+	recorder.requests()
+
+	// the settings are checked before connecting
+	for _, c := range []struct {
+		host data.Host
+		err  string
+	}{
+		{data.Host{TLSMode: "verify", TLSCA: "", TLSCert: client.certFile, TLSKey: client.keyFile}, "expired"}, // global CA
+		{data.Host{TLSMode: "verify", TLSCA: filepath.Join(dir, "missing.pem")}, "not readable"},
+		{data.Host{TLSMode: "verify", TLSCA: notCert}, "No certificate found"},
+		{data.Host{TLSMode: "verify", TLSCA: future.certFile}, "not valid until"},
+		{data.Host{TLSMode: "insecure", TLSCert: expired.certFile, TLSKey: expired.keyFile}, "expired"},
+		{data.Host{TLSMode: "insecure", TLSCert: client.certFile, TLSKey: filepath.Join(dir, "missing-key.pem")}, "key file"},
+		{data.Host{TLSMode: "secure"}, "Unknown TLS mode"},
+	} {
+		c.host.Name, c.host.DaemonURL = "invalid", daemonURL
+		if c.host.TLSCert == "" {
+			c.host.TLSCert, c.host.TLSKey = client.certFile, client.keyFile
+		}
+		err := new(agent.HostMonitor).Init(&c.host, &hostsInventory{}, nil, "")
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Expect the error %q for %+v, got %v", c.err, c.host, err)
+		}
+	}
+	viper.Set("docker.tls.cert_file", nil)
+	err = new(agent.HostMonitor).Init(&data.Host{Name: "half", DaemonURL: daemonURL, TLSCA: ca.certFile, TLSKey: client.keyFile}, &hostsInventory{}, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "together") {
+		t.Errorf("Expect the error of a key without cert, got %v", err)
+	}
+	if paths, _ := recorder.requests(); len(paths) != 0 {
+		t.Errorf("Expect no request with invalid settings, got %v", paths)
+	}
+}
+
+func TestDockerNegotiation(t *testing.T) {
+	recorder := &daemonRecorder{failing: true}
+	daemon := httptest.NewServer(recorder)
+	defer daemon.Close()
+
+	// the host is inited while the daemon does not answer
+	host := &data.Host{ID: "host0", Name: "host0", DaemonURL: "tcp://" + strings.TrimPrefix(daemon.URL, "http://"), Status: "active"}
+	hm := new(agent.HostMonitor)
+	if err := hm.Init(host, &hostsInventory{}, nil, ""); err != nil {
+		t.Fatalf("Expect the host inited without the api version, got %v", err)
+	}
+	if paths, _ := recorder.requests(); len(paths) != 2 || paths[0] != "/version" || paths[1] != "/info" {
+		t.Errorf("Expect the unversioned requests, got %v", paths)
+	}
+
+	// the version and info are read again in the next round
+	recorder.mutex.Lock()
+	recorder.failing = false
+	recorder.mutex.Unlock()
+	hm.CollectData()
+	if paths, _ := recorder.requests(); len(paths) != 2 || paths[0] != "/version" || paths[1] != "/v1.24/info" {
+		t.Errorf("Expect the version negotiated again, got %v", paths)
+	}
+	hm.CollectData()
+	if paths, _ := recorder.requests(); len(paths) != 0 {
+		t.Errorf("Expect nothing asked again, got %v", paths)
+	}
+}
+
+// TestSSHHelperProcess is run as the ssh command by TestDockerSSH,
+// it forwards the -L local port to the socket as ssh does
+func TestSSHHelperProcess(t *testing.T) {
+	if os.Getenv("CMONIT_SSH_HELPER") == "" {
+		return
+	}
+	var spec string
+	for i, arg := range os.Args {
+		if arg == "-L" && i+1 < len(os.Args) {
+			spec = os.Args[i+1]
+		}
+	}
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 {
+		os.Exit(2)
+	}
+	l, err := net.Listen("tcp", parts[0]+":"+parts[1])
+	if err != nil {
+		os.Exit(2)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(2)
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := net.Dial("unix", parts[2])
+			if err != nil {
+				return
+			}
+			defer remote.Close()
+			go io.Copy(remote, conn)
+			io.Copy(conn, remote)
+		}()
+	}
+}
+
+func TestDockerSSH(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the daemon listens on a unix socket, reached with the fake ssh command
+	recorder := &daemonRecorder{}
+	daemon := httptest.NewUnstartedServer(recorder)
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.Listener.Close()
+	daemon.Listener = l
+	daemon.Start()
+	defer daemon.Close()
+
+	helper, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\n" +
+		"[ -n \"$CMONIT_SSH_FAIL\" ] && exit 255\n" +
+		"exec " + helper + " -test.run='^TestSSHHelperProcess$' -- \"$@\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("CMONIT_SSH_HELPER", "1")
+	viper.Set("docker.ssh.identity_file", filepath.Join(dir, "id_test"))
+	viper.Set("docker.ssh.timeout", 5)
+	defer func() {
+		viper.Set("docker.ssh.identity_file", nil)
+		viper.Set("docker.ssh.timeout", nil)
+		agent.CloseSSHTunnels()
+	}()
+
+	readArgs := func() []string {
+		content, _ := ioutil.ReadFile(argsFile)
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+
+	// the same tunnel is used by the hosts of the same url
+	host := &data.Host{Name: "remote", DaemonURL: "ssh://core@docker.example:2222" + socket}
+	for i := 0; i < 2; i++ {
+		if err := new(agent.HostMonitor).Init(host, &hostsInventory{}, nil, ""); err != nil {
+			t.Fatalf("Expect the host inited through the tunnel, got %v", err)
+		}
+	}
+	if paths, _ := recorder.requests(); len(paths) == 0 {
+		t.Error("Expect the daemon reached through the tunnel")
+	}
+	lines := readArgs()
+	if len(lines) != 1 {
+		t.Fatalf("Expect one ssh command, got %v", lines)
+	}
+	args := strings.Fields(lines[0])
+	joined := " " + lines[0] + " "
+	for _, want := range []string{" -N ", " -o BatchMode=yes ", " -p 2222 ", " -i " + filepath.Join(dir, "id_test") + " ", ":" + socket + " "} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Expect %q in the ssh args %q", want, lines[0])
+		}
+	}
+	if args[len(args)-1] != "core@docker.example" {
+		t.Errorf("Expect the target user@host last, got %q", lines[0])
+	}
+	var localAddr string
+	for i, arg := range args {
+		if arg == "-L" {
+			localAddr = strings.TrimSuffix(args[i+1], ":"+socket)
+		}
+	}
+
+	// the tunnels are closed before exit
+	agent.CloseSSHTunnels()
+	if conn, err := net.DialTimeout("tcp", localAddr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Expect the tunnel %s closed", localAddr)
+	}
+
+	// ssh fails, and the default socket is used without a path
+	t.Setenv("CMONIT_SSH_FAIL", "1")
+	err = new(agent.HostMonitor).Init(&data.Host{Name: "down", DaemonURL: "ssh://docker2.example"}, &hostsInventory{}, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("Expect the error of ssh exited, got %v", err)
+	}
+	lines = readArgs()
+	if last := lines[len(lines)-1]; !strings.HasSuffix(last, ":/var/run/docker.sock -i "+filepath.Join(dir, "id_test")+" docker2.example") || strings.Contains(last, " -p ") {
+		t.Errorf("Expect the default socket and port, got %q", last)
+	}
+}
@@ -0,0 +1,143 @@
+package test
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/data"
+	"github.com/yeasy/cmonit/util"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLinearFit(t *testing.T) {
+	slope, intercept, ok := util.LinearFit([]float64{0, 1, 2, 3}, []float64{1, 3, 5, 7})
+	if !ok || math.Abs(slope-2) > 1e-9 || math.Abs(intercept-1) > 1e-9 {
+		t.Errorf("Wrong fit %g %g %v", slope, intercept, ok)
+	}
+	if _, _, ok := util.LinearFit([]float64{1, 1}, []float64{1, 2}); ok {
+		t.Error("Fit on the same x should fail")
+	}
+}
+
+func TestHoltWinters(t *testing.T) {
+	// a daily wave of 4 periods on a rising trend
+	wave := []float64{0, 10, 0, -10}
+	ys := []float64{}
+	for i := 0; i < 12; i++ {
+		ys = append(ys, float64(i)+wave[i%4])
+	}
+	forecasts, trend := util.HoltWinters(ys, 4, 0.5, 0.1, 0.1, 4)
+	if len(forecasts) != 4 || math.Abs(trend-1) > 0.2 {
+		t.Fatalf("Wrong forecasts %v trend %g", forecasts, trend)
+	}
+	for h, v := range forecasts {
+		expected := float64(12+h) + wave[(12+h)%4]
+		if math.Abs(v-expected) > 2 {
+			t.Errorf("Forecast %d = %g, expected about %g", h, v, expected)
+		}
+	}
+	// holt without season
+	forecasts, trend = util.HoltWinters([]float64{1, 2, 3, 4}, 24, 0.5, 0.1, 0.1, 2)
+	if math.Abs(forecasts[1]-6) > 1e-9 || math.Abs(trend-1) > 1e-9 {
+		t.Errorf("Wrong holt forecasts %v trend %g", forecasts, trend)
+	}
+}
+
+func TestForecastDocs(t *testing.T) {
+	now := time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)
+	docs := []bson.M{}
+	// h1 grows 1G a day to 16G, h2 is flat
+	for i := 48; i > 0; i-- {
+		start := now.Add(-time.Duration(i) * time.Hour)
+		docs = append(docs,
+			bson.M{"host_id": "h1", "host_name": "host1", "start": start,
+				"memory_usage":    bson.M{"avg": 10e9 + float64(48-i)*1e9/24},
+				"memory_capacity": bson.M{"avg": 16e9}},
+			bson.M{"host_id": "h2", "host_name": "host2", "start": start,
+				"memory_usage":    bson.M{"avg": 4e9},
+				"memory_capacity": bson.M{"avg": 16e9}},
+		)
+	}
+	for _, method := range []string{data.ForecastLinear, data.ForecastHoltWinters} {
+		f := &data.Forecaster{Method: method, Level: data.RollupLevel{Name: "1h", Period: time.Hour}, Season: 24,
+			Horizon: 30 * 24 * time.Hour, WarningDays: 14, CriticalDays: 3}
+		forecasts := f.ForecastDocs(data.DefaultForecastTargets[0], docs, now)
+		if len(forecasts) != 2 {
+			t.Fatalf("Expected 2 forecasts, got %+v", forecasts)
+		}
+		h1, h2 := forecasts[0], forecasts[1]
+		// 11.96G now, 4 days more to 16G
+		if h1.Name != "host1" || h1.ExhaustAt == nil || math.Abs(h1.DaysLeft-4) > 0.5 || h1.Status != data.ForecastWarning {
+			t.Errorf("Wrong %s forecast of h1 %+v", method, h1)
+		}
+		if math.Abs(h1.SlopePerDay-1e9) > 1e8 {
+			t.Errorf("Wrong %s slope of h1 %g", method, h1.SlopePerDay)
+		}
+		if h2.ExhaustAt != nil || h2.DaysLeft != -1 || h2.Status != data.ForecastOK {
+			t.Errorf("Wrong %s forecast of h2 %+v", method, h2)
+		}
+
+		report := &data.ForecastReport{GeneratedAt: now, Method: method, Forecasts: forecasts}
+		if md := report.Markdown(); !strings.Contains(md, "| warning | host | host1 | memory |") {
+			t.Errorf("Wrong markdown report\n%s", md)
+		}
+		if html, err := report.HTML(); err != nil || !strings.Contains(html, `<tr class="warning">`) {
+			t.Errorf("Wrong html report %v\n%s", err, html)
+		}
+	}
+
+	// the chain storage of c1 grows 1G a day to its 10G quota
+	var storage *data.ForecastTarget
+	for i, target := range data.DefaultForecastTargets {
+		if target.Kind == "cluster" && target.Metric == "storage" {
+			storage = &data.DefaultForecastTargets[i]
+		}
+	}
+	if storage == nil {
+		t.Fatal("Expect a cluster storage target")
+	}
+	docs = []bson.M{}
+	for i := 48; i > 0; i-- {
+		docs = append(docs, bson.M{"cluster_id": "c1", "cluster_name": "chain1", "start": now.Add(-time.Duration(i) * time.Hour),
+			"disk_usage":    bson.M{"avg": 7e9 - float64(i)*1e9/24},
+			"disk_capacity": bson.M{"avg": 10e9}})
+	}
+	f := &data.Forecaster{Method: data.ForecastLinear, Level: data.RollupLevel{Name: "1h", Period: time.Hour},
+		Horizon: 30 * 24 * time.Hour, WarningDays: 14, CriticalDays: 3}
+	if fc := f.ForecastDocs(*storage, docs, now); len(fc) != 1 || fc[0].Kind != "cluster" || fc[0].Name != "chain1" ||
+		fc[0].Capacity != 10e9 || math.Abs(fc[0].DaysLeft-3) > 0.5 {
+		t.Errorf("Wrong storage forecast %+v", fc)
+	}
+
+	f = &data.Forecaster{Method: data.ForecastLinear, Level: data.RollupLevel{Period: time.Hour}, Horizon: time.Hour}
+	if fc := f.ForecastSeries([]time.Time{now}, []float64{1}, 2, now); fc.Status != data.ForecastInsufficient {
+		t.Errorf("Single sample should be insufficient %+v", fc)
+	}
+}
+
+func TestForecastSeriesGap(t *testing.T) {
+	now := time.Date(2016, 11, 4, 0, 0, 0, 0, time.UTC)
+	f := &data.Forecaster{Method: data.ForecastHoltWinters, Level: data.RollupLevel{Name: "1h", Period: time.Hour}, Season: 24,
+		Horizon: 2 * 24 * time.Hour, WarningDays: 1, CriticalDays: 0.5}
+	// 3 days of a daily cycle, peaking at 6 o'clock
+	times, values := []time.Time{}, []float64{}
+	gapTimes, gapValues := []time.Time{}, []float64{}
+	for i := 72; i > 0; i-- {
+		at := now.Add(-time.Duration(i) * time.Hour)
+		v := 50 + 20*math.Sin(2*math.Pi*float64(at.Hour())/24)
+		times, values = append(times, at), append(values, v)
+		if i <= 40 || i > 48 { // cmonit down for 8 hours on the second day
+			gapTimes, gapValues = append(gapTimes, at), append(gapValues, v)
+		}
+	}
+	full := f.ForecastSeries(times, values, 69, now)
+	if full.ExhaustAt == nil || full.ExhaustAt.Hour() < 4 || full.ExhaustAt.Hour() > 8 {
+		t.Fatalf("Expect the capacity reached at the daily peak, got %+v", full)
+	}
+	gap := f.ForecastSeries(gapTimes, gapValues, 69, now)
+	if gap.Samples != 64 || gap.ExhaustAt == nil || math.Abs(gap.ExhaustAt.Sub(*full.ExhaustAt).Hours()) > 1 {
+		t.Errorf("Expect the gap not to shift the season, got %+v, %v without the gap", gap, full.ExhaustAt)
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/data"
+)
+
+const inventoryYAML = `
+hosts:
+  - id: host0
+    name: host0
+    daemon_url: tcp://10.0.0.1:2375
+    status: active
+clusters:
+  - id: cluster0
+    host_id: host0
+    user_id: user0
+    containers:
+      vp0: id0
+  - id: cluster1
+    host_id: host1
+`
+
+func TestFileInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.yaml")
+	if err := ioutil.WriteFile(path, []byte(inventoryYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fi := new(data.FileInventory)
+	if err := fi.Init(path); err != nil {
+		t.Fatal(err)
+	}
+	defer fi.Close()
+	if err := fi.Ping(); err != nil {
+		t.Error(err)
+	}
+	hosts, _ := fi.GetHosts()
+	if len(*hosts) != 1 || (*hosts)[0].DaemonURL != "tcp://10.0.0.1:2375" {
+		t.Fatalf("Wrong hosts %+v", *hosts)
+	}
+	clusters, err := fi.GetClusters(map[string]interface{}{"host_id": "host0"})
+	if err != nil || len(*clusters) != 1 || (*clusters)[0].Containers["vp0"] != "id0" {
+		t.Fatalf("Wrong clusters of host0 %+v: %v", *clusters, err)
+	}
+	if clusters, _ := fi.GetClusters(map[string]interface{}{"host_id": "host0", "user_id": "user1"}); len(*clusters) != 0 {
+		t.Errorf("Expect all the filter fields to match, got %+v", *clusters)
+	}
+	if clusters, _ := fi.GetClusters(nil); len(*clusters) != 2 {
+		t.Errorf("Expect all the clusters without filter, got %+v", *clusters)
+	}
+
+	// an invalid file keeps the old content
+	if err := ioutil.WriteFile(path, []byte("hosts:\n  - name: no-id\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fi.ReDial(); err == nil {
+		t.Error("Expect an error for a host without id")
+	}
+	if hosts, _ := fi.GetHosts(); len(*hosts) != 1 {
+		t.Errorf("Expect the old hosts kept, got %+v", *hosts)
+	}
+
+	// hot reload on change
+	reloaded := inventoryYAML + `
+  - id: cluster2
+    host_id: host0
+`
+	if err := ioutil.WriteFile(path, []byte(reloaded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if clusters, _ := fi.GetClusters(map[string]interface{}{"host_id": "host0"}); len(*clusters) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Inventory not reloaded after the change")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,242 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/yeasy/cmonit/agent"
+	"github.com/yeasy/cmonit/data"
+)
+
+// fakeKubeAPI serves the few kubernetes api used by cmonit
+func fakeKubeAPI(t *testing.T) *httptest.Server {
+	responses := map[string]string{
+		"/api/v1/nodes": `{"items": [
+			{"metadata": {"name": "node1", "creationTimestamp": "2016-08-01T00:00:00Z"},
+			 "status": {"conditions": [{"type": "Ready", "status": "True"}]}},
+			{"metadata": {"name": "node2"},
+			 "status": {"conditions": [{"type": "Ready", "status": "False"}]}}]}`,
+		"/api/v1/nodes/node1/proxy/stats/summary": `{"node": {"nodeName": "node1"}, "pods": [
+			{"podRef": {"name": "vp0", "namespace": "fabric"},
+			 "containers": [
+				{"name": "peer", "cpu": {"time": "2016-08-01T00:00:05Z", "usageNanoCores": 500000000},
+				 "memory": {"usageBytes": 300, "workingSetBytes": 200, "availableBytes": 800}},
+				{"name": "ccenv", "cpu": {"time": "2016-08-01T00:00:05Z", "usageNanoCores": 100000000},
+				 "memory": {"usageBytes": 100, "workingSetBytes": 80}}],
+			 "network": {"rxBytes": 1000, "txBytes": 2000}},
+			{"podRef": {"name": "vp1", "namespace": "fabric"},
+			 "containers": [
+				{"name": "peer", "cpu": {"time": "2016-08-01T00:00:05Z", "usageNanoCores": 300000000},
+				 "memory": {"usageBytes": 500, "workingSetBytes": 500, "availableBytes": 500}}]}]}`,
+		"/api/v1/nodes/node2/proxy/stats/summary": `{"node": {"nodeName": "node2"}, "pods": [
+			{"podRef": {"name": "vp3", "namespace": "fabric"},
+			 "containers": [{"name": "peer", "memory": {"usageBytes": 700, "workingSetBytes": 600}}]}]}`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Unexpected authorization header %s", r.Header.Get("Authorization"))
+		}
+		if r.URL.Path == "/api/v1/namespaces/fabric/pods" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(selectPods(t, r.URL.Query()))
+			return
+		}
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+}
+
+// fakePods are the pods of the fake kubernetes api, n1 spans node1 and node2
+var fakePods = []map[string]interface{}{
+	fakePod("vp0", "node1", map[string]string{"monitor": "true", "net": "n1", "user_id": "alice"}, "peer", "ccenv"),
+	fakePod("vp1", "node1", map[string]string{"monitor": "true", "net": "n1"}, "peer"),
+	fakePod("vp2", "node2", map[string]string{"monitor": "true", "net": "n2"}, "peer"),
+	fakePod("vp3", "node2", map[string]string{"monitor": "true", "net": "n1"}, "peer"),
+	fakePod("other", "node2", map[string]string{"monitor": "false", "net": "n1"}, "peer"),
+}
+
+func fakePod(name, node string, labels map[string]string, containers ...string) map[string]interface{} {
+	list := []map[string]string{}
+	for _, c := range containers {
+		list = append(list, map[string]string{"name": c})
+	}
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name, "namespace": "fabric", "labels": labels},
+		"spec":     map[string]interface{}{"nodeName": node, "containers": list},
+	}
+}
+
+// selectPods applies the node field selector and the label selectors of k=v and k in (a,b)
+func selectPods(t *testing.T, query url.Values) map[string]interface{} {
+	fields, labels := query.Get("fieldSelector"), query.Get("labelSelector")
+	if !strings.HasPrefix(fields, "status.phase=Running") || !strings.HasPrefix(labels, "monitor=true") {
+		t.Errorf("Wrong selectors %s and %s", fields, labels)
+	}
+	node := ""
+	for _, f := range strings.Split(fields, ",") {
+		if strings.HasPrefix(f, "spec.nodeName=") {
+			node = strings.TrimPrefix(f, "spec.nodeName=")
+		}
+	}
+	selectors := regexp.MustCompile(`(\w+) in \(([^)]*)\)|(\w+)=(\w+)`).FindAllStringSubmatch(labels, -1)
+	items := []map[string]interface{}{}
+	for _, p := range fakePods {
+		podLabels := p["metadata"].(map[string]interface{})["labels"].(map[string]string)
+		if node != "" && p["spec"].(map[string]interface{})["nodeName"] != node {
+			continue
+		}
+		match := true
+		for _, sel := range selectors {
+			if sel[1] != "" {
+				match = match && strings.Contains(","+sel[2]+",", ","+podLabels[sel[1]]+",")
+			} else {
+				match = match && podLabels[sel[3]] == sel[4]
+			}
+		}
+		if match {
+			items = append(items, p)
+		}
+	}
+	return map[string]interface{}{"items": items}
+}
+
+func TestKubeInventory(t *testing.T) {
+	server := fakeKubeAPI(t)
+	defer server.Close()
+
+	kube := new(data.KubeClient)
+	if err := kube.Init(server.URL, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	inventory := new(data.KubeInventory)
+	if err := inventory.Init(kube, "fabric", "monitor=true", "net", "user_id"); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := inventory.GetHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*hosts) != 2 {
+		t.Fatalf("Expect 2 hosts, got %d", len(*hosts))
+	}
+	if h := (*hosts)[0]; h.ID != "node1" || h.Status != "active" || h.Type != data.HostTypeKubernetes {
+		t.Errorf("Wrong host %+v", h)
+	}
+	if h := (*hosts)[1]; h.Status != "inactive" {
+		t.Errorf("Host node2 should be inactive, got %s", h.Status)
+	}
+
+	clusters, err := inventory.GetClusters(map[string]interface{}{"host_id": "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*clusters) != 1 {
+		t.Fatalf("Expect 1 cluster on node1, got %d", len(*clusters))
+	}
+	c := (*clusters)[0]
+	if c.ID != "n1" || c.UserID != "alice" || len(c.Containers) != 4 || c.HostID != "node1" {
+		t.Errorf("Wrong cluster %+v", c)
+	}
+	if ref := c.Containers["vp0/peer"]; ref != data.KubeContainerRef("fabric", "vp0", "peer") {
+		t.Errorf("Wrong container ref %s", ref)
+	}
+	// the pod of n1 on node2 is in the same cluster
+	if len(c.Nodes) != 1 || c.Nodes["vp3/peer"] != server.URL+"/api/v1/nodes/node2/proxy" {
+		t.Errorf("Wrong nodes of the cluster %+v", c.Nodes)
+	}
+
+	// n1 is taken by node1, so node2 only has n2
+	clusters, err = inventory.GetClusters(map[string]interface{}{"host_id": "node2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*clusters) != 1 || (*clusters)[0].ID != "n2" || len((*clusters)[0].Nodes) != 0 {
+		t.Errorf("Expect only n2 on node2, got %+v", *clusters)
+	}
+	if clusters, err := inventory.GetClusters(map[string]interface{}{"host_id": "node3"}); err != nil || len(*clusters) != 0 {
+		t.Errorf("Expect no cluster on node3, got %+v, %v", *clusters, err)
+	}
+	if clusters, _ := inventory.GetClusters(nil); len(*clusters) != 2 {
+		t.Errorf("Expect 2 clusters in all, got %+v", *clusters)
+	}
+}
+
+func TestKubeletMonitor(t *testing.T) {
+	server := fakeKubeAPI(t)
+	defer server.Close()
+
+	kube := new(data.KubeClient)
+	if err := kube.Init(server.URL, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	km := new(agent.KubeletMonitor)
+	if err := km.Init(kube, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := km.CollectData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 {
+		t.Fatalf("Expect 3 container stats, got %d", len(stats))
+	}
+
+	peer := stats[data.KubeContainerRef("fabric", "vp0", "peer")]
+	if peer == nil {
+		t.Fatal("No stats for vp0/peer")
+	}
+	if peer.CPUPercentage != 50.0 || peer.Memory != 200 || peer.RawUsage != 300 || peer.MemoryLimit != 1000 || peer.MemoryPercentage != 20.0 {
+		t.Errorf("Wrong stats of vp0/peer %+v", *peer)
+	}
+	// pod network is only counted once, on the first container by name
+	ccenv := stats[data.KubeContainerRef("fabric", "vp0", "ccenv")]
+	if ccenv.NetworkRx != 1000 || ccenv.NetworkTx != 2000 || peer.NetworkRx != 0 {
+		t.Errorf("Wrong network stats, ccenv=%+v, peer=%+v", *ccenv, *peer)
+	}
+	if ccenv.MemoryLimit != 0 || ccenv.MemoryPercentage != 0 {
+		t.Errorf("Container without limit should have no memory limit, got %+v", *ccenv)
+	}
+
+	cluster := data.Cluster{ID: "n1", Name: "n1", Containers: map[string]string{
+		"vp0/peer":  data.KubeContainerRef("fabric", "vp0", "peer"),
+		"vp0/ccenv": data.KubeContainerRef("fabric", "vp0", "ccenv"),
+		"vp1/peer":  data.KubeContainerRef("fabric", "vp1", "peer"),
+	}}
+	cluster.Containers["vp3/peer"] = data.KubeContainerRef("fabric", "vp3", "peer")
+	cluster.Nodes = map[string]string{"vp3/peer": server.URL + "/api/v1/nodes/node2/proxy"}
+	if err := km.CollectNodes([]data.Cluster{cluster}, stats); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := km.ClusterData(cluster, stats, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Size != 4 || cs.Memory != 1380 || cs.NetworkRx != 1000 {
+		t.Errorf("Wrong cluster stat %+v", *cs)
+	}
+
+	// a pod not in the summary yet
+	cluster.Containers["vp9/peer"] = data.KubeContainerRef("fabric", "vp9", "peer")
+	if cs, err = km.ClusterData(cluster, stats, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cs.Size != 5 || cs.Missing != 1 || cs.Memory != 1380 {
+		t.Errorf("Expect the missing container counted, got %+v", *cs)
+	}
+
+	km.Init(kube, "node3")
+	if _, err := km.CollectData(); err == nil {
+		t.Error("Expect error for unknown node")
+	}
+}
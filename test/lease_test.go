@@ -0,0 +1,214 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/data"
+)
+
+func TestLeaderLease(t *testing.T) {
+	if err := (&data.LeaderLease{Name: "cmonit", ID: "a"}).Init(nil, "lease"); err == nil {
+		t.Error("Expect an error without the ttl")
+	}
+	l := &data.LeaderLease{Name: "cmonit", ID: "a", TTL: 15 * time.Second}
+	if err := l.Init(nil, "lease"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2016, 11, 1, 8, 0, 0, 0, time.UTC)
+	if _, err := l.Fence(); l.IsLeader(now) || err != data.ErrNotLeader {
+		t.Fatal("Expect no leader before the lease is read")
+	}
+	if _, err := l.Acquire(now); err == nil {
+		t.Error("Expect an error to acquire without db")
+	}
+
+	// held by another instance
+	if l.Observe(data.Lease{Name: "cmonit", Holder: "b", Token: 3, Expires: now.Add(15 * time.Second)}, now) {
+		t.Error("Expect a standby")
+	}
+	// taken over with the next token
+	if !l.Observe(data.Lease{Name: "cmonit", Holder: "a", Token: 4, Expires: now.Add(20 * time.Second)}, now.Add(5*time.Second)) {
+		t.Fatal("Expect the leader")
+	}
+	if !l.IsLeader(now.Add(19*time.Second)) || l.IsLeader(now.Add(20*time.Second)) {
+		t.Error("Expect the lease valid for the ttl since the read")
+	}
+	if current, checked := l.Current(); current.Token != 4 || current.Holder != "a" || !checked.Equal(now.Add(5*time.Second)) {
+		t.Errorf("Wrong current lease %+v at %s", current, checked)
+	}
+	// lost to another instance
+	if l.Observe(data.Lease{Name: "cmonit", Holder: "b", Token: 5, Expires: now.Add(40 * time.Second)}, now.Add(10*time.Second)) || l.IsLeader(now.Add(11*time.Second)) {
+		t.Error("Expect the lease lost")
+	}
+}
+
+// memLeaseStore keeps the leases in memory, as the lease collection does
+type memLeaseStore struct {
+	leases  map[string]data.Lease
+	failing bool
+	calls   []string
+}
+
+func (s *memLeaseStore) get(name string) (data.Lease, bool, error) {
+	if s.failing {
+		return data.Lease{}, false, errors.New("db down")
+	}
+	lease, ok := s.leases[name]
+	return lease, ok, nil
+}
+
+func (s *memLeaseStore) Renew(name, holder string, token int64, now, expires time.Time) (*data.Lease, error) {
+	s.calls = append(s.calls, "renew")
+	lease, ok, err := s.get(name)
+	if err != nil || !ok || lease.Holder != holder || lease.Token != token {
+		return nil, err
+	}
+	lease.Renewed, lease.Expires = now, expires
+	s.leases[name] = lease
+	return &lease, nil
+}
+
+func (s *memLeaseStore) TakeOver(name, holder string, now, expires time.Time) (*data.Lease, error) {
+	s.calls = append(s.calls, "takeover")
+	lease, ok, err := s.get(name)
+	if err != nil || !ok || !lease.Expires.Before(now) {
+		return nil, err
+	}
+	lease.Holder, lease.Renewed, lease.Expires = holder, now, expires
+	lease.Token++
+	s.leases[name] = lease
+	return &lease, nil
+}
+
+func (s *memLeaseStore) Create(lease data.Lease) (*data.Lease, error) {
+	s.calls = append(s.calls, "create")
+	existing, ok, err := s.get(lease.Name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &existing, nil
+	}
+	s.leases[lease.Name] = lease
+	return &lease, nil
+}
+
+func (s *memLeaseStore) Check(name, holder string, token int64, now time.Time) error {
+	s.calls = append(s.calls, "check")
+	lease, ok, err := s.get(name)
+	if err != nil {
+		return err
+	}
+	if !ok || lease.Holder != holder || lease.Token != token || !lease.Expires.After(now) {
+		return data.ErrNotLeader
+	}
+	return nil
+}
+
+// takeCalls returns the store calls since the last time
+func (s *memLeaseStore) takeCalls() string {
+	calls := strings.Join(s.calls, ",")
+	s.calls = nil
+	return calls
+}
+
+func TestLeaderLeaseAcquire(t *testing.T) {
+	store := &memLeaseStore{leases: make(map[string]data.Lease)}
+	a := &data.LeaderLease{Name: "cmonit", ID: "a", TTL: 15 * time.Second, Store: store}
+	b := &data.LeaderLease{Name: "cmonit", ID: "b", TTL: 15 * time.Second, Store: store}
+	for _, l := range []*data.LeaderLease{a, b} {
+		if err := l.Init(nil, "lease"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now() // the leader is checked on the clock too
+
+	// the first lease
+	if leader, err := a.Acquire(now); err != nil || !leader {
+		t.Fatalf("Expect a to lead with the first lease, got %t %v", leader, err)
+	}
+	if token, err := a.Fence(); err != nil || token != 1 {
+		t.Errorf("Expect the writes of a fenced with token 1, got %d %v", token, err)
+	}
+	if calls := store.takeCalls(); calls != "takeover,create,check" {
+		t.Errorf("Expect the lease created and the token checked, got %s", calls)
+	}
+	if current, _ := a.Current(); current.Token != 1 || current.Holder != "a" {
+		t.Errorf("Wrong first lease %+v", current)
+	}
+
+	// renewed by the holder
+	if leader, err := a.Acquire(now.Add(5 * time.Second)); err != nil || !leader {
+		t.Fatalf("Expect a to renew, got %t %v", leader, err)
+	}
+	if calls := store.takeCalls(); calls != "renew" {
+		t.Errorf("Expect the lease renewed, got %s", calls)
+	}
+	if lease := store.leases["cmonit"]; lease.Token != 1 || !lease.Expires.Equal(now.Add(20*time.Second)) {
+		t.Errorf("Wrong renewed lease %+v", lease)
+	}
+
+	// b finds the lease held when inserting its own
+	if leader, err := b.Acquire(now.Add(6 * time.Second)); err != nil || leader {
+		t.Fatalf("Expect b standby, got %t %v", leader, err)
+	}
+	if calls := store.takeCalls(); calls != "takeover,create" {
+		t.Errorf("Expect the lease found on the insert, got %s", calls)
+	}
+	if current, _ := b.Current(); current.Holder != "a" || current.Token != 1 {
+		t.Errorf("Expect b to see the lease of a, got %+v", current)
+	}
+
+	// a cannot reach the db, and keeps leading until its lease is over
+	store.failing = true
+	if leader, err := a.Acquire(now.Add(10 * time.Second)); err == nil || !leader {
+		t.Errorf("Expect a still leading on an error, got %t %v", leader, err)
+	}
+	if a.IsLeader(now.Add(20 * time.Second)) {
+		t.Error("Expect a to stop leading once the lease is over")
+	}
+	store.failing = false
+	store.takeCalls()
+
+	// b takes over the expired lease with the next token
+	if leader, err := b.Acquire(now.Add(21 * time.Second)); err != nil || !leader {
+		t.Fatalf("Expect b to take over, got %t %v", leader, err)
+	}
+	if calls := store.takeCalls(); calls != "takeover" {
+		t.Errorf("Expect the lease taken over, got %s", calls)
+	}
+	if lease := store.leases["cmonit"]; lease.Holder != "b" || lease.Token != 2 {
+		t.Errorf("Wrong lease taken over %+v", lease)
+	}
+
+	// a still leads by its clock, but the store rejects the writes of its old token
+	if !a.IsLeader(time.Now()) {
+		t.Fatal("Expect a to lead by its clock before the ttl")
+	}
+	if token, err := a.Fence(); err != data.ErrNotLeader || token != 0 {
+		t.Errorf("Expect the write of the stale leader rejected, got %d %v", token, err)
+	}
+	if a.IsLeader(time.Now()) {
+		t.Error("Expect a to stop leading once a write is rejected")
+	}
+	if token, err := b.Fence(); err != nil || token != 2 {
+		t.Errorf("Expect the writes of b fenced with token 2, got %d %v", token, err)
+	}
+	if calls := store.takeCalls(); calls != "check,check" {
+		t.Errorf("Expect the tokens checked in the store, got %s", calls)
+	}
+
+	// a finds b leading
+	if leader, err := a.Acquire(now.Add(22 * time.Second)); err != nil || leader {
+		t.Errorf("Expect a to lose the lease, got %t %v", leader, err)
+	}
+	if calls := store.takeCalls(); calls != "takeover,create" {
+		t.Errorf("Expect a to try the lease again, got %s", calls)
+	}
+	if current, _ := a.Current(); current.Holder != "b" || current.Token != 2 {
+		t.Errorf("Expect a to see the lease of b, got %+v", current)
+	}
+}
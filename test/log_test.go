@@ -0,0 +1,84 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/agent"
+)
+
+// muxLogs frames each line as the docker logs api does for a container without tty
+func muxLogs(stream byte, lines ...string) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		header := []byte{stream, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[4:], uint32(len(line)+1))
+		buf.Write(header)
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes()
+}
+
+func TestCountLogs(t *testing.T) {
+	since, _ := time.Parse(time.RFC3339Nano, "2016-08-01T08:00:00Z")
+	patterns := map[string]*regexp.Regexp{
+		"panic":             regexp.MustCompile("panic"),
+		"error":             regexp.MustCompile("ERRO"),
+		"consensus_timeout": regexp.MustCompile("consensus timeout"),
+	}
+	stream := append(muxLogs(1,
+		"2016-08-01T08:00:00Z 08:00:00.000 [peer] INFO : read before",
+		"2016-08-01T08:00:01.5Z 08:00:01.500 [consensus/pbft] WARN : consensus timeout",
+		"2016-08-01T08:00:02Z 08:00:02.000 [peer] INFO : started"),
+		muxLogs(2, "2016-08-01T08:00:03.25Z 08:00:03.250 [chaincode] ERRO : panic: runtime error")...)
+
+	count, err := agent.CountLogs(bytes.NewReader(stream), since, patterns, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Lines != 3 {
+		t.Errorf("Wrong lines %d", count.Lines)
+	}
+	if count.Hits["panic"] != 1 || count.Hits["error"] != 1 || count.Hits["consensus_timeout"] != 1 {
+		t.Errorf("Wrong hits %+v", count.Hits)
+	}
+	if count.Last.Format(time.RFC3339Nano) != "2016-08-01T08:00:03.25Z" {
+		t.Errorf("Wrong last timestamp %s", count.Last)
+	}
+	if len(count.Matched) != 3 || count.Matched[0].Pattern != "consensus_timeout" ||
+		count.Matched[2].Line != "08:00:03.250 [chaincode] ERRO : panic: runtime error" {
+		t.Errorf("Wrong matched lines %+v", count.Matched)
+	}
+
+	// a tty container, and only the first line matched
+	tty := strings.Join([]string{
+		"2016-08-01T08:00:01Z panic: one",
+		"2016-08-01T08:00:02Z panic: two",
+	}, "\n")
+	count, err = agent.CountLogs(strings.NewReader(tty), since, patterns, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Lines != 2 || count.Hits["panic"] != 1 || len(count.Matched) != 1 {
+		t.Errorf("Wrong tty logs %+v", count)
+	}
+
+	// a line over 1MB is cut, and the lines after it are read
+	long := "2016-08-01T08:00:04Z panic: " + strings.Repeat("x", 2*1024*1024)
+	stream = muxLogs(1, long, "2016-08-01T08:00:05Z ERRO after")
+	count, err = agent.CountLogs(bytes.NewReader(stream), since, patterns, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Lines != 2 || count.Hits["panic"] != 1 || count.Hits["error"] != 1 ||
+		count.Last.Format(time.RFC3339Nano) != "2016-08-01T08:00:05Z" {
+		t.Errorf("Wrong logs after a long line %+v %s", count.Hits, count.Last)
+	}
+	if len(count.Matched) != 2 || len(count.Matched[0].Line) != 1024*1024-len("2016-08-01T08:00:04Z ") {
+		t.Errorf("Expect the long line cut to 1MB, got %d matched", len(count.Matched))
+	}
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+	"github.com/yeasy/cmonit/util"
+)
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logging.SetBackend(logging.NewBackendFormatter(logging.NewLogBackend(&buf, "", 0), util.JSONFormatter{}))
+	defer logging.SetBackend(logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", 0), util.LogFormat))
+	defer util.SetLogRound("")
+	defer util.SetLogSampling(0, 0)
+
+	util.SetLogRound("20161101T080000")
+	log := util.NewLog("test").With(util.LogFields{"host": "host0", "cluster_id": "cluster0"})
+	log.With(util.LogFields{"duration": 1.5}).Infof("<<Host %s: End monit with %s\n", "host0", "1.5s")
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("Not a json line %q: %v", buf.String(), err)
+	}
+	for k, v := range map[string]interface{}{
+		"host":       "host0",
+		"cluster_id": "cluster0",
+		"round_id":   "20161101T080000",
+		"duration":   1.5,
+		"level":      "INFO",
+		"module":     "test",
+		"msg":        "<<Host host0: End monit with 1.5s",
+	} {
+		if doc[k] != v {
+			t.Errorf("Expect %s = %v, got %v", k, v, doc[k])
+		}
+	}
+	if caller, _ := doc["caller"].(string); !strings.HasPrefix(caller, "logging_test.go:") {
+		t.Errorf("Wrong caller %v", doc["caller"])
+	}
+
+	// the first 2, then one of each 3
+	buf.Reset()
+	util.SetLogSampling(2, 3)
+	util.SetLogRound("20161101T080005")
+	for i := 0; i < 8; i++ {
+		log.Debugf("Container %s: api call used %d ms", "vp0", i)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 4 {
+		t.Errorf("Expect 4 sampled lines, got %d: %s", n, buf.String())
+	}
+	for _, kept := range []string{"used 0 ms", "used 1 ms", "used 4 ms", "used 7 ms"} {
+		if !strings.Contains(buf.String(), kept) {
+			t.Errorf("Expect the line %q kept", kept)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/client"
+	"github.com/yeasy/cmonit/agent"
+	"github.com/yeasy/cmonit/util"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	name := util.MetricName("test_batch_size", "col", "container")
+	if name != `test_batch_size{col="container"}` {
+		t.Errorf("Wrong metric name %s", name)
+	}
+	util.Observe(name, 3)
+	util.Observe(name, 5)
+	util.Observe(name, 1)
+	util.AddCounter("test_docs_total", 2)
+	util.AddCounter("test_docs_total", 7)
+
+	metrics := util.MetricsSnapshot()
+	for k, v := range map[string]float64{
+		`test_batch_size_count{col="container"}`: 3,
+		`test_batch_size_sum{col="container"}`:   9,
+		`test_batch_size_max{col="container"}`:   5,
+		`test_batch_size_last{col="container"}`:  1,
+		"test_docs_total":                        9,
+	} {
+		if metrics[k] != v {
+			t.Errorf("Expect %s = %g, got %g", k, v, metrics[k])
+		}
+	}
+}
+
+func TestSelfMetricsHistogram(t *testing.T) {
+	name := util.MetricName("test_round_seconds", "host", "h0")
+	for _, v := range []float64{0.3, 1.5, 4, 400} {
+		util.ObserveHistogram(name, v, []float64{1, 5})
+	}
+	util.SetGauge("test_goroutines", 12)
+	util.SetGauge("test_goroutines", 10)
+
+	metrics := util.MetricsSnapshot()
+	for k, v := range map[string]float64{
+		`test_round_seconds_bucket{host="h0",le="1"}`:    1,
+		`test_round_seconds_bucket{host="h0",le="5"}`:    3,
+		`test_round_seconds_bucket{host="h0",le="+Inf"}`: 4,
+		`test_round_seconds_count{host="h0"}`:            4,
+		`test_round_seconds_sum{host="h0"}`:              405.8,
+		"test_goroutines":                                10,
+	} {
+		if math.Abs(metrics[k]-v) > 1e-9 {
+			t.Errorf("Expect %s = %g, got %g", k, v, metrics[k])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := util.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains("\n"+buf.String(), "\ntest_goroutines 10\n") {
+		t.Errorf("Wrong metrics text %s", buf.String())
+	}
+}
+
+func TestDockerErrorType(t *testing.T) {
+	for err, want := range map[error]string{
+		client.ErrConnectionFailed:                                       "connection",
+		errors.New("Error: No such container: cluster0_vp0"):             "not_found",
+		errors.New("dial tcp 10.0.0.1:2375: i/o timeout"):                "timeout",
+		errors.New("Error response from daemon: oci runtime error"):      "daemon",
+		errors.New("docker api /system/df returns 500: a prune running"): "daemon",
+		errors.New("unexpected EOF"):                                     "other",
+	} {
+		if got := agent.DockerErrorType(err); got != want {
+			t.Errorf("Expect %s for %v, got %s", want, err, got)
+		}
+	}
+}
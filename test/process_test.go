@@ -0,0 +1,102 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/yeasy/cmonit/agent"
+)
+
+func TestParseContainerTop(t *testing.T) {
+	list := types.ContainerProcessList{
+		Titles: []string{"PID", "PPID", "USER", "%CPU", "TIME", "RSS", "ELAPSED", "COMMAND"},
+		Processes: [][]string{
+			{"100", "1", "root", "0.5", "00:00:18", "2048", "01:00:00", "/bin/sh -c peer node start"},
+			{"101", "100", "root", "85.2", "1-00:51:07", "512000", "59:59", "peer node start --peer-defaultchain=false"},
+			{"102", "100", "root", "3.0", "00:01:47", "1024000", "59:58", "chaincode -peer.address=vp0:7051"},
+		},
+	}
+	processes, total := agent.ParseContainerTop(list, 2, "cpu")
+	if total != 3 || len(processes) != 2 {
+		t.Fatalf("Wrong processes %d %+v", total, processes)
+	}
+	if processes[0].PID != "101" || processes[0].CPUPercentage != 85.2 || processes[0].RSS != 512000*1024 ||
+		processes[0].PPID != "100" || processes[0].Command != "peer node start --peer-defaultchain=false" ||
+		processes[0].CPUTime != 24*3600+51*60+7 || processes[0].Elapsed != "59:59" {
+		t.Errorf("Wrong top process by cpu %+v", processes[0])
+	}
+	if processes[1].PID != "102" {
+		t.Errorf("Wrong second process by cpu %+v", processes[1])
+	}
+	processes, _ = agent.ParseContainerTop(list, 0, "rss")
+	if len(processes) != 3 || processes[0].PID != "102" || processes[2].PID != "100" {
+		t.Errorf("Wrong processes by rss %+v", processes)
+	}
+
+	// windows daemon
+	list = types.ContainerProcessList{
+		Titles:    []string{"Name", "PID", "CPU", "Private Working Set"},
+		Processes: [][]string{{"peer.exe", "1234", "00:00:01.250", "12.5MB"}},
+	}
+	processes, _ = agent.ParseContainerTop(list, 5, "rss")
+	if len(processes) != 1 || processes[0].Command != "peer.exe" || processes[0].RSS != 12.5*(1<<20) || processes[0].CPUTime != 1.25 {
+		t.Errorf("Wrong windows processes %+v", processes)
+	}
+}
+
+func TestProcessCPU(t *testing.T) {
+	list := types.ContainerProcessList{
+		Titles: []string{"PID", "%CPU", "TIME", "COMMAND"},
+		Processes: [][]string{
+			{"100", "90.0", "01:00:00", "peer node start"}, // busy at start, idle now
+			{"101", "5.0", "00:00:10", "chaincode"},
+		},
+	}
+	now := time.Now()
+	pc := new(agent.ProcessCPU)
+	processes, _ := agent.ParseContainerTop(list, 0, "cpu")
+	pc.Rate("c1", processes, now)
+	if processes = agent.TopProcesses(processes, 1, "cpu"); processes[0].PID != "100" || processes[0].CPUPercentage != 90 {
+		t.Errorf("Expect the ps percentage at the first sample, got %+v", processes)
+	}
+
+	// 101 used 30s of cpu in the 60s since, 100 nothing, and 102 is new
+	list.Processes = [][]string{
+		{"100", "89.0", "01:00:00", "peer node start"},
+		{"101", "6.0", "00:00:40", "chaincode"},
+		{"102", "2.0", "00:00:01", "sh"},
+	}
+	processes, _ = agent.ParseContainerTop(list, 0, "cpu")
+	pc.Rate("c1", processes, now.Add(time.Minute))
+	processes = agent.TopProcesses(processes, 0, "cpu")
+	if len(processes) != 3 || processes[0].PID != "101" || processes[0].CPUPercentage != 50 {
+		t.Fatalf("Expect chaincode at 50%% since the last sample, got %+v", processes)
+	}
+	if processes[1].PID != "102" || processes[1].CPUPercentage != 2 || processes[2].PID != "100" || processes[2].CPUPercentage != 0 {
+		t.Errorf("Wrong processes since the last sample %+v", processes)
+	}
+
+	// the pid 101 is reused by a process with less cpu time, and the other container is apart
+	list.Processes = [][]string{{"101", "1.0", "00:00:02", "sh"}}
+	processes, _ = agent.ParseContainerTop(list, 0, "cpu")
+	pc.Rate("c1", processes, now.Add(2*time.Minute))
+	if processes[0].CPUPercentage != 1 {
+		t.Errorf("Expect the ps percentage for a reused pid, got %+v", processes)
+	}
+	list.Processes = [][]string{{"100", "3.0", "01:00:30", "peer node start"}}
+	processes, _ = agent.ParseContainerTop(list, 0, "cpu")
+	pc.Rate("c2", processes, now.Add(2*time.Minute))
+	if processes[0].CPUPercentage != 3 {
+		t.Errorf("Expect the ps percentage in another container, got %+v", processes)
+	}
+
+	// forgotten containers start again from ps
+	pc.Forget(now.Add(3 * time.Minute))
+	list.Processes = [][]string{{"101", "1.0", "00:00:32", "sh"}}
+	processes, _ = agent.ParseContainerTop(list, 0, "cpu")
+	pc.Rate("c1", processes, now.Add(3*time.Minute))
+	if processes[0].CPUPercentage != 1 {
+		t.Errorf("Expect the ps percentage after forget, got %+v", processes)
+	}
+}
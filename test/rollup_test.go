@@ -0,0 +1,57 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/data"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRollupDocs(t *testing.T) {
+	start := time.Date(2016, 8, 1, 10, 0, 0, 0, time.UTC)
+	raw := []bson.M{}
+	for i := 1; i <= 20; i++ {
+		raw = append(raw, bson.M{
+			"container_id":   "c1",
+			"container_name": "vp0",
+			"cpu_percentage": float64(i),
+			"pid_current":    int64(10),
+			"timestamp":      start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	// zero values are omitted in the raw documents
+	raw = append(raw, bson.M{"container_id": "c2", "memory_usage": 100.0}, bson.M{"container_id": "c2"})
+	raw = append(raw, bson.M{"cpu_percentage": 1.0}) // no id
+
+	minute := data.RollupDocs(raw, "container_id", start, start.Add(time.Minute))
+	if len(minute) != 2 {
+		t.Fatalf("Expect 2 rollup documents, got %d", len(minute))
+	}
+	c1 := minute[0]
+	if c1["container_id"] != "c1" || c1["container_name"] != "vp0" || c1["count"] != 20 {
+		t.Errorf("Wrong rollup document %v", c1)
+	}
+	cpu := c1["cpu_percentage"].(bson.M)
+	if cpu["min"] != 1.0 || cpu["max"] != 20.0 || cpu["avg"] != 10.5 || cpu["p95"] != 19.05 {
+		t.Errorf("Wrong cpu rollup %v", cpu)
+	}
+	if pids := c1["pid_current"].(bson.M); pids["avg"] != 10.0 {
+		t.Errorf("Wrong pids rollup %v", pids)
+	}
+	if mem := minute[1]["memory_usage"].(bson.M); mem["min"] != 0.0 || mem["avg"] != 50.0 {
+		t.Errorf("Missing value should be taken as 0, got %v", mem)
+	}
+
+	// roll up the rollups, the average is weighted by the count
+	next := bson.M{"container_id": "c1", "start": start.Add(time.Minute), "count": 60,
+		"cpu_percentage": bson.M{"min": 30.0, "max": 40.0, "avg": 35.0, "p95": 39.0}}
+	hour := data.RollupDocs([]bson.M{c1, next}, "container_id", start, start.Add(time.Hour))
+	if len(hour) != 1 || hour[0]["count"] != 80 {
+		t.Fatalf("Wrong hour rollup %v", hour)
+	}
+	cpu = hour[0]["cpu_percentage"].(bson.M)
+	if cpu["min"] != 1.0 || cpu["max"] != 40.0 || cpu["avg"] != (10.5*20+35.0*60)/80 {
+		t.Errorf("Wrong hour cpu rollup %v", cpu)
+	}
+}
@@ -0,0 +1,225 @@
+package test
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yeasy/cmonit/agent"
+	"github.com/yeasy/cmonit/data"
+)
+
+func TestDecodeContainerStat(t *testing.T) {
+	tests := []struct {
+		fixture          string
+		cpuPercentage    float64
+		memory           float64
+		memoryLimit      float64
+		memoryPercentage float64
+		networkRx        float64
+		networkTx        float64
+		blockRead        float64
+		blockWrite       float64
+		pidsCurrent      uint64
+		timeStamp        string
+	}{
+		// cgroup v1, cpu count from percpu usage, total_inactive_file is not counted
+		{"stats_v1.22_cgroup1.json", 80.0, 94371840, 1073741824, 8.7890625, 1010, 2020, 4096, 8192, 12, "2016-08-01T08:00:05.123456789Z"},
+		// cgroup v2, no percpu usage but online cpus, inactive_file is not counted
+		{"stats_v1.41_cgroup2.json", 40.0, 31457280, 2147483648, 1.46484375, 5000, 6000, 1048576, 2097152, 5, "2021-06-01T08:00:05.123456789Z"},
+		// neither percpu usage nor online cpus, take as one cpu; cache larger than usage is ignored
+		{"stats_v1.41_cgroup2_no_online_cpus.json", 20.0, 1048576, 4194304, 25.0, 0, 0, 0, 0, 1, "2021-06-01T08:00:05Z"},
+		// windows, cpu by 100ns intervals, private working set as memory, no limit
+		{"stats_v1.41_windows.json", 25.0, 73400320, 0, 0, 700, 800, 300, 400, 0, "2021-06-01T08:00:01Z"},
+	}
+
+	for _, tt := range tests {
+		f, err := os.Open(filepath.Join("testdata", tt.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := agent.DecodeContainerStat(f, "id", "name")
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: decode error %v", tt.fixture, err)
+			continue
+		}
+		if s.ContainerID != "id" || s.ContainerName != "name" {
+			t.Errorf("%s: wrong container %s/%s", tt.fixture, s.ContainerID, s.ContainerName)
+		}
+		check := func(field string, got, expect float64) {
+			if math.Abs(got-expect) > 1e-6 {
+				t.Errorf("%s: %s = %v, expect %v", tt.fixture, field, got, expect)
+			}
+		}
+		check("cpu_percentage", s.CPUPercentage, tt.cpuPercentage)
+		check("memory_usage", s.Memory, tt.memory)
+		check("memory_limit", s.MemoryLimit, tt.memoryLimit)
+		check("memory_percentage", s.MemoryPercentage, tt.memoryPercentage)
+		check("network_rx", s.NetworkRx, tt.networkRx)
+		check("network_tx", s.NetworkTx, tt.networkTx)
+		check("block_read", s.BlockRead, tt.blockRead)
+		check("block_write", s.BlockWrite, tt.blockWrite)
+		if s.PidsCurrent != tt.pidsCurrent {
+			t.Errorf("%s: pid_current = %d, expect %d", tt.fixture, s.PidsCurrent, tt.pidsCurrent)
+		}
+		if ts, _ := time.Parse(time.RFC3339Nano, tt.timeStamp); !s.TimeStamp.Equal(ts) {
+			t.Errorf("%s: timestamp = %s, expect %s", tt.fixture, s.TimeStamp, ts)
+		}
+	}
+}
+
+func TestDecodeContainerStatError(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "stats_v1.22_cgroup1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// a truncated response
+	buf := make([]byte, 100)
+	n, _ := f.Read(buf)
+	if _, err := agent.DecodeContainerStat(bytes.NewReader(buf[:n]), "id", "name"); err == nil {
+		t.Error("Expect error for truncated stats")
+	}
+}
+
+func TestDecodeContainerInfo(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "inspect_v1.41.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := agent.DecodeContainerInfo(f, []string{"user_id", " com.docker.compose.project", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Image != "hyperledger/fabric-peer:2.2" || info.ImageID != "sha256:9a8b7c6d5e4f" || info.Status != "running" || info.Health != "healthy" {
+		t.Errorf("Wrong image or state %+v", info)
+	}
+	if !info.OOMKilled || info.ExitCode != 137 || info.RestartCount != 2 {
+		t.Errorf("Wrong exit state %+v", info)
+	}
+	if !info.StartedAt.Equal(time.Date(2021, 6, 1, 7, 30, 0, 5e8, time.UTC)) {
+		t.Errorf("Wrong start time %s", info.StartedAt)
+	}
+	if info.CPUShares != 512 || info.CPULimit != 1.5 || info.MemoryLimitConfig != 1<<30 || info.MemoryReservation != 1<<29 {
+		t.Errorf("Wrong limits %+v", info)
+	}
+	if len(info.Labels) != 2 || info.Labels["user_id"] != "u1" || info.Labels["com_docker_compose_project"] != "net1" {
+		t.Errorf("Wrong labels %v", info.Labels)
+	}
+
+	// cpu limit from the cfs quota on older daemons
+	info, err = agent.DecodeContainerInfo(bytes.NewBufferString(`{"HostConfig": {"CpuQuota": 50000, "CpuPeriod": 100000}, "State": {"StartedAt": "0001-01-01T00:00:00Z"}}`), nil)
+	if err != nil || info.CPULimit != 0.5 || !info.StartedAt.IsZero() || info.Health != "" {
+		t.Errorf("Wrong info %+v %v", info, err)
+	}
+}
+
+func TestDecodeMemoryDetail(t *testing.T) {
+	tests := []struct {
+		fixture string
+		detail  data.MemoryDetail
+	}{
+		// hierarchical total_* preferred, mapped_file falls back to the local value
+		{"stats_v1.22_cgroup1.json", data.MemoryDetail{RawUsage: 104857600, WorkingSet: 94371840, RSS: 73400320, Cache: 20971520,
+			MappedFile: 4194304, ActiveFile: 10485760, InactiveFile: 10485760, PgFault: 51234, PgMajFault: 12, MaxUsage: 125829120}},
+		// anon and file on cgroup v2
+		{"stats_v1.41_cgroup2.json", data.MemoryDetail{RawUsage: 52428800, WorkingSet: 31457280, RSS: 27262976, Cache: 25165824,
+			ActiveFile: 4194304, InactiveFile: 20971520, PgFault: 40000, PgMajFault: 3}},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(filepath.Join("testdata", tt.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := agent.DecodeContainerStat(f, "id", "name")
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.MemoryDetail != tt.detail {
+			t.Errorf("%s: memory detail = %+v, expect %+v", tt.fixture, s.MemoryDetail, tt.detail)
+		}
+	}
+}
+
+func TestDecodeNetworkAndBlockDevices(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "stats_v1.22_cgroup1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := agent.DecodeContainerStat(f, "id", "name")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Networks) != 2 || s.Networks["eth0"].TxPackets != 20 || s.Networks["eth1"].RxDropped != 1 {
+		t.Errorf("Wrong networks %+v", s.Networks)
+	}
+	expect := map[string]data.BlockDevice{
+		"8:0":  {Major: 8, Minor: 0, ReadBytes: 4096, WriteBytes: 8192, ReadOps: 1, WriteOps: 2, ServiceTime: 4000000, Queued: 3},
+		"8:16": {Major: 8, Minor: 16, ReadOps: 7},
+	}
+	if len(s.BlockDevices) != len(expect) {
+		t.Fatalf("Wrong block devices %+v", s.BlockDevices)
+	}
+	for key, d := range expect {
+		if s.BlockDevices[key] != d {
+			t.Errorf("Block device %s = %+v, expect %+v", key, s.BlockDevices[key], d)
+		}
+	}
+
+	// windows has no blkio stats
+	f, err = os.Open(filepath.Join("testdata", "stats_v1.41_windows.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = agent.DecodeContainerStat(f, "id", "name")
+	f.Close()
+	if err != nil || s.BlockDevices != nil || len(s.Networks) == 0 {
+		t.Errorf("Wrong windows stat %+v %v", s, err)
+	}
+}
+
+func TestDecodeCPUDetail(t *testing.T) {
+	tests := []struct {
+		fixture string
+		detail  data.CPUDetail
+	}{
+		// 4 cpus, no throttling
+		{"stats_v1.22_cgroup1.json", data.CPUDetail{UserPercentage: 60, KernelPercentage: 20, PerCPU: []float64{20, 20, 20, 20}}},
+		// 2 of the last 10 periods throttled, no percpu usage
+		{"stats_v1.41_cgroup2.json", data.CPUDetail{UserPercentage: 28, KernelPercentage: 12,
+			Periods: 100, ThrottledPeriods: 10, ThrottledTime: 500000000, ThrottleRatio: 0.2}},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(filepath.Join("testdata", tt.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := agent.DecodeContainerStat(f, "id", "name")
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := s.CPUDetail
+		if math.Abs(d.UserPercentage-tt.detail.UserPercentage) > 1e-6 || math.Abs(d.KernelPercentage-tt.detail.KernelPercentage) > 1e-6 ||
+			d.Periods != tt.detail.Periods || d.ThrottledPeriods != tt.detail.ThrottledPeriods || d.ThrottledTime != tt.detail.ThrottledTime ||
+			math.Abs(d.ThrottleRatio-tt.detail.ThrottleRatio) > 1e-9 || len(d.PerCPU) != len(tt.detail.PerCPU) {
+			t.Errorf("%s: cpu detail = %+v, expect %+v", tt.fixture, d, tt.detail)
+			continue
+		}
+		for i := range d.PerCPU {
+			if math.Abs(d.PerCPU[i]-tt.detail.PerCPU[i]) > 1e-6 {
+				t.Errorf("%s: percpu = %v, expect %v", tt.fixture, d.PerCPU, tt.detail.PerCPU)
+			}
+		}
+		if d.Throttled() != (tt.detail.ThrottleRatio > 0) {
+			t.Errorf("%s: wrong throttled", tt.fixture)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/spf13/viper"
+	"github.com/yeasy/cmonit/agent"
+	"github.com/yeasy/cmonit/data"
+)
+
+// hostsInventory is an inventory of the given hosts only
+type hostsInventory struct {
+	hosts []data.Host
+}
+
+func (i *hostsInventory) GetHosts() (*[]data.Host, error) { return &i.hosts, nil }
+func (i *hostsInventory) GetClusters(filter map[string]interface{}) (*[]data.Cluster, error) {
+	return &[]data.Cluster{}, nil
+}
+func (i *hostsInventory) ReDial() error { return nil }
+func (i *hostsInventory) Ping() error   { return nil }
+func (i *hostsInventory) Close()        {}
+
+// swarmTaskDoc builds a task as returned by the swarm manager
+func swarmTaskDoc(id, service string, slot int, node, state, container string) map[string]interface{} {
+	return map[string]interface{}{
+		"ID":           id,
+		"ServiceID":    service,
+		"Slot":         slot,
+		"NodeID":       node,
+		"DesiredState": "running",
+		"Status": map[string]interface{}{
+			"State":           state,
+			"ContainerStatus": map[string]interface{}{"ContainerID": container},
+		},
+	}
+}
+
+// swarmNodeDoc builds a node as returned by the swarm manager
+func swarmNodeDoc(id, hostname, state, addr string) map[string]interface{} {
+	return map[string]interface{}{
+		"ID":          id,
+		"Description": map[string]interface{}{"Hostname": hostname},
+		"Status":      map[string]interface{}{"State": state, "Addr": addr},
+	}
+}
+
+// versionHandler answers the /version of a daemon
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(types.Version{Version: "1.12.0", APIVersion: "1.24"})
+}
+
+func TestSwarmClusters(t *testing.T) {
+	// nodes of the swarm, the manager node0 runs tasks too
+	node1, _ := fakeDaemon(t, map[string]http.HandlerFunc{"/version": versionHandler})
+	defer node1.Close()
+	node2, _ := fakeDaemon(t, map[string]http.HandlerFunc{"/version": versionHandler})
+	defer node2.Close()
+	_, node2Port, _ := net.SplitHostPort(strings.TrimPrefix(node2.URL, "http://"))
+
+	services := []map[string]interface{}{
+		{"ID": "s1", "Spec": map[string]interface{}{"Name": "chain_vp", "Labels": map[string]string{"com.docker.stack.namespace": "chain", "user_id": "alice"}}},
+		{"ID": "s2", "Spec": map[string]interface{}{"Name": "chain_ca", "Labels": map[string]string{"com.docker.stack.namespace": "chain"}}},
+		{"ID": "s3", "Spec": map[string]interface{}{"Name": "web", "Labels": map[string]string{}}},
+	}
+	nodes := []map[string]interface{}{
+		swarmNodeDoc("node0", "manager", "ready", "10.0.0.1"),
+		swarmNodeDoc("node1", "worker1", "ready", "10.0.0.2"),  // in the inventory
+		swarmNodeDoc("node2", "worker2", "ready", "127.0.0.1"), // reached by address
+		swarmNodeDoc("node3", "worker3", "down", "10.0.0.4"),   // not ready
+		swarmNodeDoc("node4", "worker4", "ready", ""),          // no address
+	}
+	var mutex sync.Mutex
+	tasks := []map[string]interface{}{
+		swarmTaskDoc("t1", "s1", 1, "node0", "running", "c1"),
+		swarmTaskDoc("t2", "s1", 2, "node1", "running", "c2"),
+		swarmTaskDoc("t3", "s2", 0, "node2", "running", "c3"),   // global service
+		swarmTaskDoc("t4", "s1", 3, "node1", "preparing", ""),   // not started yet
+		swarmTaskDoc("t5", "s3", 1, "node3", "running", "c5"),   // on a node down
+		swarmTaskDoc("t6", "s3", 2, "node4", "running", "c6"),   // on a node without address
+		swarmTaskDoc("t7", "gone", 1, "node0", "running", "c7"), // service removed
+		swarmTaskDoc("t8", "s3", 3, "node2", "running", "c8"),
+	}
+	manager, _ := fakeDaemon(t, map[string]http.HandlerFunc{
+		"/version": versionHandler,
+		"/services": func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(services)
+		},
+		"/nodes": func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(nodes)
+		},
+		"/tasks": func(w http.ResponseWriter, r *http.Request) {
+			args, err := filters.FromParam(r.URL.Query().Get("filters"))
+			if err != nil || !args.ExactMatch("desired-state", "running") {
+				t.Errorf("Expect the tasks desired running, got filters %s", r.URL.Query().Get("filters"))
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			json.NewEncoder(w).Encode(tasks)
+		},
+	})
+	defer manager.Close()
+
+	managerURL := "tcp://" + strings.TrimPrefix(manager.URL, "http://")
+	node1URL := "tcp://" + strings.TrimPrefix(node1.URL, "http://")
+	node2URL := "tcp://127.0.0.1:" + node2Port
+	host := &data.Host{ID: "host0", Name: "manager", DaemonURL: managerURL, Type: "swarm"}
+	inventory := &hostsInventory{hosts: []data.Host{
+		*host,
+		{ID: "host1", Name: "worker1", DaemonURL: node1URL},
+	}}
+
+	viper.Set("input.swarm.cluster_label", "com.docker.stack.namespace")
+	viper.Set("input.swarm.user_label", "user_id")
+	viper.Set("input.swarm.daemon_port", node2Port)
+	defer func() {
+		for _, key := range []string{"cluster_label", "user_label", "daemon_port"} {
+			viper.Set("input.swarm."+key, nil)
+		}
+	}()
+
+	sm := new(agent.SwarmMonitor)
+	if err := sm.Init(host, managerURL, inventory, http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	clusters, err := sm.Clusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("Expect 2 clusters, got %+v", clusters)
+	}
+	chain, web := clusters[0], clusters[1]
+	if chain.ID != "chain" || chain.UserID != "alice" || chain.Size != 3 {
+		t.Errorf("Wrong cluster chain %+v", chain)
+	}
+	for name, want := range map[string][2]string{
+		"chain_vp.1.t1":     {"c1", managerURL},
+		"chain_vp.2.t2":     {"c2", node1URL},
+		"chain_ca.node2.t3": {"c3", node2URL},
+	} {
+		if chain.Containers[name] != want[0] || chain.Nodes[name] != want[1] {
+			t.Errorf("Expect container %s as %s on %s, got %s on %s", name, want[0], want[1], chain.Containers[name], chain.Nodes[name])
+		}
+	}
+	// the service name is used without the cluster label
+	if web.ID != "web" || web.Size != 1 || web.Containers["web.3.t8"] != "c8" || web.Nodes["web.3.t8"] != node2URL {
+		t.Errorf("Wrong cluster web %+v", web)
+	}
+	for _, c := range clusters {
+		if c.HostID != "host0" || c.DaemonURL != managerURL {
+			t.Errorf("Expect the cluster %s on the manager, got %s %s", c.ID, c.HostID, c.DaemonURL)
+		}
+	}
+
+	// clients of the worker nodes only, the manager is collected by its own client
+	clients := sm.NodeClients(clusters)
+	if len(clients) != 2 || clients[node1URL] == nil || clients[node2URL] == nil {
+		t.Errorf("Expect clients of the two workers, got %v", clients)
+	}
+
+	// t2 is rescheduled from node1 to node2, and t4 started on node1
+	mutex.Lock()
+	tasks[1] = swarmTaskDoc("t9", "s1", 2, "node2", "running", "c9")
+	tasks[3] = swarmTaskDoc("t4", "s1", 3, "node1", "running", "c4")
+	mutex.Unlock()
+	if clusters, err = sm.Clusters(); err != nil {
+		t.Fatal(err)
+	}
+	chain = clusters[0]
+	if chain.Size != 4 || chain.Containers["chain_vp.2.t2"] != "" {
+		t.Errorf("Expect t2 replaced, got %+v", chain.Containers)
+	}
+	if chain.Containers["chain_vp.2.t9"] != "c9" || chain.Nodes["chain_vp.2.t9"] != node2URL ||
+		chain.Containers["chain_vp.3.t4"] != "c4" || chain.Nodes["chain_vp.3.t4"] != node1URL {
+		t.Errorf("Expect the moved and started tasks, got %+v on %+v", chain.Containers, chain.Nodes)
+	}
+	if clients = sm.NodeClients(clusters); len(clients) != 2 {
+		t.Errorf("Expect the clients kept, got %v", clients)
+	}
+
+	// the manager is down
+	manager.Close()
+	if _, err := sm.Clusters(); err == nil {
+		t.Error("Expect an error when the manager is down")
+	}
+}
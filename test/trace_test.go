@@ -0,0 +1,209 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yeasy/cmonit/util"
+)
+
+// spanRecorder keeps the exported spans
+type spanRecorder struct {
+	spans []*util.Span
+}
+
+func (r *spanRecorder) Export(spans []*util.Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+// otlpRequest is the part of the OTLP/JSON trace export request checked by the tests
+type otlpRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string
+				Value map[string]interface{}
+			}
+		}
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID           string `json:"traceId"`
+				SpanID            string `json:"spanId"`
+				ParentSpanID      string `json:"parentSpanId"`
+				Name              string
+				StartTimeUnixNano string
+				EndTimeUnixNano   string
+				Attributes        []struct {
+					Key   string
+					Value map[string]interface{}
+				}
+				Status struct {
+					Code    int
+					Message string
+				}
+			}
+		}
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	util.SetTracer(nil)
+	s := util.StartSpan(nil, "monit_round")
+	if s != nil {
+		t.Fatalf("Expect no span without a tracer, got %+v", s)
+	}
+	s.SetAttr("hosts", 1)
+	s.SetError(errors.New("ignored"))
+	s.Finish()
+	if err := util.FlushSpans(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTraceRound(t *testing.T) {
+	r := &spanRecorder{}
+	util.SetTracer(r)
+	defer util.SetTracer(nil)
+
+	round := util.StartSpan(nil, "monit_round", "round_id", "20161101T080000")
+	util.SetRoundSpan(round)
+	host := util.StartSpan(util.RoundSpan(), "host.collect", "host", "host0")
+	container := util.StartSpan(host, "container.collect", "container", "peer0")
+	container.SetError(errors.New("timeout"))
+	container.Finish()
+	host.Finish()
+	round.Finish()
+	util.SetRoundSpan(nil)
+	if err := util.FlushSpans(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.spans) != 3 {
+		t.Fatalf("Expect 3 spans, got %d", len(r.spans))
+	}
+	if len(round.TraceID) != 32 || len(round.SpanID) != 16 || round.ParentID != "" {
+		t.Errorf("Invalid root span ids %+v", round)
+	}
+	if host.TraceID != round.TraceID || host.ParentID != round.SpanID || container.ParentID != host.SpanID {
+		t.Errorf("Spans are not in the round: round=%+v host=%+v container=%+v", round, host, container)
+	}
+	if container.Err != "timeout" || host.Err != "" {
+		t.Errorf("Expect only the container failed, got %q and %q", container.Err, host.Err)
+	}
+	if round.End.Before(host.End) {
+		t.Error("Expect the round ends last")
+	}
+	if err := util.FlushSpans(); err != nil || len(r.spans) != 3 {
+		t.Errorf("Expect nothing more to export, got %d spans, err %v", len(r.spans), err)
+	}
+}
+
+func TestOTLPJSON(t *testing.T) {
+	r := &spanRecorder{}
+	util.SetTracer(r)
+	defer util.SetTracer(nil)
+	round := util.StartSpan(nil, "monit_round", "hosts", 2, "round_id", "20161101T080000")
+	write := util.StartSpan(round, "mongo.bulk_insert", "col", "container", "docs", 50)
+	write.SetError(errors.New("no reachable servers"))
+	write.Finish()
+	round.Finish()
+
+	body, err := util.OTLPJSON([]*util.Span{round, write})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Expect one resource and scope, got %s", body)
+	}
+	if attrs := req.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value["stringValue"] != "cmonit" {
+		t.Errorf("Invalid resource %+v", attrs)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expect 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "monit_round" || spans[0].Status.Code != 1 || spans[0].ParentSpanID != "" {
+		t.Errorf("Invalid round span %+v", spans[0])
+	}
+	if a := spans[0].Attributes; len(a) != 2 || a[0].Key != "hosts" || a[0].Value["intValue"] != "2" || a[1].Value["stringValue"] != "20161101T080000" {
+		t.Errorf("Invalid round attributes %+v", a)
+	}
+	if spans[1].TraceID != round.TraceID || spans[1].ParentSpanID != round.SpanID || spans[1].SpanID != write.SpanID {
+		t.Errorf("Invalid ids of the write span %+v", spans[1])
+	}
+	if spans[1].Status.Code != 2 || spans[1].Status.Message != "no reachable servers" {
+		t.Errorf("Expect the error status, got %+v", spans[1].Status)
+	}
+	if spans[1].StartTimeUnixNano == "" || spans[1].EndTimeUnixNano < spans[1].StartTimeUnixNano {
+		t.Errorf("Invalid times %s - %s", spans[1].StartTimeUnixNano, spans[1].EndTimeUnixNano)
+	}
+}
+
+func TestTraceExporters(t *testing.T) {
+	var posted otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&posted)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "traces.json")
+
+	r := &spanRecorder{}
+	util.SetTracer(r)
+	defer util.SetTracer(nil)
+	s := util.StartSpan(nil, "monit_round")
+	s.Finish()
+
+	if err := (&util.OTLPExporter{Endpoint: server.URL + "/v1/traces"}).Export([]*util.Span{s}); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted.ResourceSpans) != 1 || posted.ResourceSpans[0].ScopeSpans[0].Spans[0].SpanID != s.SpanID {
+		t.Errorf("Invalid posted request %+v", posted)
+	}
+	if err := (&util.OTLPExporter{Endpoint: server.URL + "/traces"}).Export([]*util.Span{s}); err == nil {
+		t.Error("Expect an error from the wrong endpoint")
+	}
+
+	exporter := &util.FileExporter{Path: file}
+	for i := 0; i < 2; i++ {
+		if err := exporter.Export([]*util.Span{s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var req otlpRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Errorf("Not a json line %q: %v", line, err)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("Expect 2 lines, got %d", lines)
+	}
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// GetStringList returns a list config, which can be given as a yaml list
+// or as a comma separated string (e.g., from the command line flag)
+func GetStringList(key string) []string {
+	result := []string{}
+	switch v := viper.Get(key).(type) {
+	case nil:
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				result = append(result, s)
+			}
+		}
+	default:
+		for _, s := range cast.ToStringSlice(v) {
+			if s = strings.TrimSpace(s); s != "" {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package util
+
+//LinearFit returns the least squares line y = slope*x + intercept,
+//ok is false with less than 2 distinct x
+func LinearFit(xs, ys []float64) (slope, intercept float64, ok bool) {
+	n := len(xs)
+	if n < 2 || len(ys) != n {
+		return 0, 0, false
+	}
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX, meanY := sumX/float64(n), sumY/float64(n)
+	var sxx, sxy float64
+	for i := range xs {
+		sxx += (xs[i] - meanX) * (xs[i] - meanX)
+		sxy += (xs[i] - meanX) * (ys[i] - meanY)
+	}
+	if sxx == 0 {
+		return 0, 0, false
+	}
+	slope = sxy / sxx
+	return slope, meanY - slope*meanX, true
+}
+
+//HoltWinters returns the forecasts of the next horizon steps of evenly spaced values,
+//with the additive seasonal method of the season length, or the Holt linear trend
+//method when season <= 1 or less than 2 seasons of values given.
+//The trend is the last smoothed change per step. Nil for less than 2 values.
+func HoltWinters(ys []float64, season int, alpha, beta, gamma float64, horizon int) (forecasts []float64, trend float64) {
+	n := len(ys)
+	if n < 2 || horizon <= 0 {
+		return nil, 0
+	}
+	forecasts = make([]float64, horizon)
+	if season <= 1 || n < 2*season {
+		level := ys[0]
+		trend = ys[1] - ys[0]
+		for _, y := range ys[1:] {
+			last := level
+			level = alpha*y + (1-alpha)*(level+trend)
+			trend = beta*(level-last) + (1-beta)*trend
+		}
+		for h := range forecasts {
+			forecasts[h] = level + float64(h+1)*trend
+		}
+		return forecasts, trend
+	}
+
+	var first, second float64
+	for i := 0; i < season; i++ {
+		first += ys[i]
+		second += ys[season+i]
+	}
+	first, second = first/float64(season), second/float64(season)
+	// the first season mean is at its middle, start the level one step before it
+	trend = (second - first) / float64(season)
+	middle := float64(season-1) / 2
+	level := first - (middle+1)*trend
+	seasonal := make([]float64, season)
+	for i := range seasonal {
+		seasonal[i] = ys[i] - (first + (float64(i)-middle)*trend)
+	}
+	for t, y := range ys {
+		s := seasonal[t%season]
+		last := level
+		level = alpha*(y-s) + (1-alpha)*(level+trend)
+		trend = beta*(level-last) + (1-beta)*trend
+		seasonal[t%season] = gamma*(y-level) + (1-gamma)*s
+	}
+	for h := range forecasts {
+		forecasts[h] = level + float64(h+1)*trend + seasonal[(n+h)%season]
+	}
+	return forecasts, trend
+}
@@ -0,0 +1,208 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// LogFields are the context of a log record, e.g., host, cluster_id, container, round_id and duration
+type LogFields map[string]interface{}
+
+// LogEntry is a log message with its context. It is given as the only argument of a
+// go-logging record, so the json formatter can find the fields, while the text format
+// only prints the message.
+type LogEntry struct {
+	Message string
+	Fields  LogFields
+}
+
+func (e LogEntry) String() string {
+	return e.Message
+}
+
+// logRound is the round of the monitor task and the debug sampling in the round
+var logRound = struct {
+	sync.Mutex
+	id         string
+	first      int // debug lines of the same format logged in a round, 0 to log all
+	thereafter int // then log one of each thereafter, 0 to drop the rest
+	seen       map[string]int
+}{seen: make(map[string]int)}
+
+// SetLogRound sets the round_id of the agent records, and restarts the debug sampling
+func SetLogRound(id string) {
+	logRound.Lock()
+	logRound.id = id
+	logRound.seen = make(map[string]int)
+	logRound.Unlock()
+}
+
+// SetLogSampling keeps the first debug lines of each format in a round, and one of each thereafter after them
+func SetLogSampling(first, thereafter int) {
+	logRound.Lock()
+	logRound.first, logRound.thereafter = first, thereafter
+	logRound.Unlock()
+}
+
+// sampled tells whether to log the debug line of the format
+func sampled(format string) bool {
+	logRound.Lock()
+	defer logRound.Unlock()
+	if logRound.first <= 0 {
+		return true
+	}
+	n := logRound.seen[format]
+	logRound.seen[format] = n + 1
+	if n < logRound.first {
+		return true
+	}
+	return logRound.thereafter > 0 && (n-logRound.first+1)%logRound.thereafter == 0
+}
+
+// Log is a go-logging logger adding the context fields and the round to each record
+type Log struct {
+	logger *logging.Logger
+	fields LogFields
+}
+
+// NewLog returns the log of the module
+func NewLog(module string) *Log {
+	l := logging.MustGetLogger(module)
+	l.ExtraCalldepth = 2 // the Log method and log
+	return &Log{logger: l}
+}
+
+// With returns the log with more fields
+func (lg *Log) With(fields LogFields) *Log {
+	merged := make(LogFields, len(lg.fields)+len(fields))
+	for k, v := range lg.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Log{logger: lg.logger, fields: merged}
+}
+
+// entry adds the fields and the round to the message
+func (lg *Log) entry(msg string) LogEntry {
+	fields := make(LogFields, len(lg.fields)+1)
+	for k, v := range lg.fields {
+		fields[k] = v
+	}
+	logRound.Lock()
+	if logRound.id != "" {
+		fields["round_id"] = logRound.id
+	}
+	logRound.Unlock()
+	return LogEntry{Message: msg, Fields: fields}
+}
+
+func (lg *Log) log(level logging.Level, msg string) {
+	if !lg.logger.IsEnabledFor(level) {
+		return
+	}
+	e := lg.entry(msg)
+	switch level {
+	case logging.CRITICAL:
+		lg.logger.Critical(e)
+	case logging.ERROR:
+		lg.logger.Error(e)
+	case logging.WARNING:
+		lg.logger.Warning(e)
+	case logging.NOTICE:
+		lg.logger.Notice(e)
+	case logging.INFO:
+		lg.logger.Info(e)
+	default:
+		lg.logger.Debug(e)
+	}
+}
+
+// sprint joins the args as go-logging does
+func sprint(args []interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
+
+// IsEnabledFor tells whether the level is logged
+func (lg *Log) IsEnabledFor(level logging.Level) bool {
+	return lg.logger.IsEnabledFor(level)
+}
+
+// Debug logs a debug message, not sampled
+func (lg *Log) Debug(args ...interface{}) {
+	lg.log(logging.DEBUG, sprint(args))
+}
+
+// Debugf logs a debug message, sampled by the format in each round
+func (lg *Log) Debugf(format string, args ...interface{}) {
+	if lg.logger.IsEnabledFor(logging.DEBUG) && sampled(format) {
+		lg.log(logging.DEBUG, fmt.Sprintf(format, args...))
+	}
+}
+
+// Info logs an info message
+func (lg *Log) Info(args ...interface{}) {
+	lg.log(logging.INFO, sprint(args))
+}
+
+// Infof logs an info message
+func (lg *Log) Infof(format string, args ...interface{}) {
+	lg.log(logging.INFO, fmt.Sprintf(format, args...))
+}
+
+// Warning logs a warning message
+func (lg *Log) Warning(args ...interface{}) {
+	lg.log(logging.WARNING, sprint(args))
+}
+
+// Warningf logs a warning message
+func (lg *Log) Warningf(format string, args ...interface{}) {
+	lg.log(logging.WARNING, fmt.Sprintf(format, args...))
+}
+
+// Error logs an error message
+func (lg *Log) Error(args ...interface{}) {
+	lg.log(logging.ERROR, sprint(args))
+}
+
+// Errorf logs an error message
+func (lg *Log) Errorf(format string, args ...interface{}) {
+	lg.log(logging.ERROR, fmt.Sprintf(format, args...))
+}
+
+// JSONFormatter formats a record as a json line with time, level, module, caller, msg
+// and the fields of the LogEntry
+type JSONFormatter struct{}
+
+// Format writes the record as one json line
+func (JSONFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	doc := make(map[string]interface{})
+	if len(r.Args) == 1 {
+		if e, ok := r.Args[0].(LogEntry); ok {
+			for k, v := range e.Fields {
+				doc[k] = v
+			}
+		}
+	}
+	doc["time"] = r.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	doc["level"] = r.Level.String()
+	doc["module"] = r.Module
+	doc["msg"] = strings.TrimSpace(r.Message())
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		doc["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
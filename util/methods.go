@@ -1,38 +1,68 @@
 package util
 
+import (
+	"math"
+	"sort"
+)
+
 /*It's pity for go having no such useful methods.*/
 
-//Avg return the minimum element of a float64 array
-func Avg(a []float64) float64 {
-	return Sum(a) / float64(len(a))
+//Distribution is the summary of a float64 array
+type Distribution struct {
+	Count  int     `bson:"count" json:"count"`
+	Sum    float64 `bson:"sum" json:"sum"`
+	Min    float64 `bson:"min" json:"min"`
+	Max    float64 `bson:"max" json:"max"`
+	Avg    float64 `bson:"avg" json:"avg"`
+	P50    float64 `bson:"p50" json:"p50"`
+	P95    float64 `bson:"p95" json:"p95"`
+	StdDev float64 `bson:"stddev" json:"stddev"`
 }
 
-//Min return the minimum element of a float64 array
-func Min(a []float64) (min float64) {
-	min = a[0]
-	for _, v := range a {
-		if min > v {
-			min = v
-		}
+//Aggregate return the distribution of a float64 array, all zero for empty array
+func Aggregate(a []float64) Distribution {
+	d := Distribution{Count: len(a)}
+	if len(a) == 0 {
+		return d
+	}
+	sorted := make([]float64, len(a))
+	copy(sorted, a)
+	sort.Float64s(sorted)
+	for _, v := range sorted {
+		d.Sum += v
 	}
-	return
+	d.Min, d.Max = sorted[0], sorted[len(sorted)-1]
+	d.Avg = d.Sum / float64(len(sorted))
+	d.P50 = percentileOfSorted(sorted, 50)
+	d.P95 = percentileOfSorted(sorted, 95)
+	var variance float64
+	for _, v := range sorted {
+		variance += (v - d.Avg) * (v - d.Avg)
+	}
+	d.StdDev = math.Sqrt(variance / float64(len(sorted)))
+	return d
 }
 
-//Max return the maximum element of a float64 array
-func Max(a []float64) (max float64) {
-	max = a[0]
-	for _, v := range a {
-		if max < v {
-			max = v
-		}
+//Percentile return the p-th (0-100) percentile of a float64 array, interpolated
+//between the closest ranks, 0 for empty array
+func Percentile(a []float64, p float64) float64 {
+	if len(a) == 0 {
+		return 0
 	}
-	return
+	sorted := make([]float64, len(a))
+	copy(sorted, a)
+	sort.Float64s(sorted)
+	return percentileOfSorted(sorted, p)
 }
 
-//Sum return the sum result of a float64 array
-func Sum(a []float64) (sum float64) {
-	for _, v := range a {
-		sum += v
+func percentileOfSorted(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	if rank <= 0 {
+		return sorted[0]
+	}
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
 	}
-	return
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
 }
@@ -0,0 +1,178 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// summary keeps the count, sum, max and last value of observations
+type summary struct {
+	count uint64
+	sum   float64
+	max   float64
+	last  float64
+}
+
+// histogram keeps the count of observations not above each bucket
+type histogram struct {
+	buckets []float64 // upper bounds in order
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// DefaultBuckets are the histogram buckets in seconds
+var DefaultBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300}
+
+// selfMetrics are the metrics of cmonit itself, keyed by name with labels,
+// e.g., mongo_batch_size{col="container"}
+var selfMetrics = struct {
+	sync.Mutex
+	counters   map[string]float64
+	gauges     map[string]float64
+	summaries  map[string]*summary
+	histograms map[string]*histogram
+}{
+	counters:   make(map[string]float64),
+	gauges:     make(map[string]float64),
+	summaries:  make(map[string]*summary),
+	histograms: make(map[string]*histogram),
+}
+
+// MetricName returns the metric name with the labels given in pairs
+func MetricName(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	name += "{"
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			name += ","
+		}
+		name += labels[i] + "=" + strconv.Quote(labels[i+1])
+	}
+	return name + "}"
+}
+
+// AddCounter increases the counter by delta
+func AddCounter(name string, delta float64) {
+	selfMetrics.Lock()
+	selfMetrics.counters[name] += delta
+	selfMetrics.Unlock()
+}
+
+// Observe records a value of the summary
+func Observe(name string, value float64) {
+	selfMetrics.Lock()
+	s, ok := selfMetrics.summaries[name]
+	if !ok {
+		s = new(summary)
+		selfMetrics.summaries[name] = s
+	}
+	s.count++
+	s.sum += value
+	if s.count == 1 || value > s.max {
+		s.max = value
+	}
+	s.last = value
+	selfMetrics.Unlock()
+}
+
+// SetGauge sets the current value of the gauge
+func SetGauge(name string, value float64) {
+	selfMetrics.Lock()
+	selfMetrics.gauges[name] = value
+	selfMetrics.Unlock()
+}
+
+// ObserveHistogram records a value of the histogram, the buckets are only used at the first observation
+func ObserveHistogram(name string, value float64, buckets []float64) {
+	selfMetrics.Lock()
+	h, ok := selfMetrics.histograms[name]
+	if !ok {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		selfMetrics.histograms[name] = h
+	}
+	for i, le := range h.buckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+	selfMetrics.Unlock()
+}
+
+// MetricsSnapshot returns the current values, a summary is flattened into
+// <name>_count, <name>_sum, <name>_max and <name>_last, and a histogram into
+// <name>_bucket{le="..."} (cumulative), <name>_count and <name>_sum
+func MetricsSnapshot() map[string]float64 {
+	selfMetrics.Lock()
+	defer selfMetrics.Unlock()
+	result := make(map[string]float64, len(selfMetrics.counters)+len(selfMetrics.gauges)+4*len(selfMetrics.summaries))
+	for k, v := range selfMetrics.counters {
+		result[k] = v
+	}
+	for k, v := range selfMetrics.gauges {
+		result[k] = v
+	}
+	for k, s := range selfMetrics.summaries {
+		result[suffixed(k, "_count")] = float64(s.count)
+		result[suffixed(k, "_sum")] = s.sum
+		result[suffixed(k, "_max")] = s.max
+		result[suffixed(k, "_last")] = s.last
+	}
+	for k, h := range selfMetrics.histograms {
+		bucket := suffixed(k, "_bucket")
+		for i, le := range h.buckets {
+			result[withLabel(bucket, "le", strconv.FormatFloat(le, 'g', -1, 64))] = float64(h.counts[i])
+		}
+		result[withLabel(bucket, "le", "+Inf")] = float64(h.count)
+		result[suffixed(k, "_count")] = float64(h.count)
+		result[suffixed(k, "_sum")] = h.sum
+	}
+	return result
+}
+
+// WriteMetrics writes the snapshot in order, one "name value" per line as the prometheus text format
+func WriteMetrics(w io.Writer) error {
+	metrics := MetricsSnapshot()
+	for _, name := range SortedMetricNames(metrics) {
+		if _, err := fmt.Fprintf(w, "%s %g\n", name, metrics[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SortedMetricNames returns the names of the snapshot in order
+func SortedMetricNames(snapshot map[string]float64) []string {
+	names := make([]string, 0, len(snapshot))
+	for k := range snapshot {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withLabel adds one more label to the name
+func withLabel(name, key, value string) string {
+	label := key + "=" + strconv.Quote(value)
+	if n := len(name); n > 0 && name[n-1] == '}' {
+		return name[:n-1] + "," + label + "}"
+	}
+	return name + "{" + label + "}"
+}
+
+// suffixed adds the suffix to the name before the labels
+func suffixed(name, suffix string) string {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '{' {
+			return name[:i] + suffix + name[i:]
+		}
+	}
+	return name + suffix
+}
@@ -0,0 +1,286 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPendingSpans bounds the spans kept between two flushes
+const maxPendingSpans = 100000
+
+// Span is a timed operation of a trace, as the span of OpenTelemetry.
+// A nil span is valid and records nothing, which is what StartSpan returns without a tracer.
+type Span struct {
+	TraceID    string // 32 hex digits
+	SpanID     string // 16 hex digits
+	ParentID   string // empty for a root span
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        string // empty when ok
+}
+
+// SpanExporter sends the ended spans somewhere
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+// tracer keeps the exporter and the ended spans not exported yet
+var tracer = struct {
+	sync.Mutex
+	exporter SpanExporter
+	pending  []*Span
+	round    *Span // the span of the current monitor round
+}{}
+
+// SetTracer starts recording spans for the exporter, nil to stop
+func SetTracer(exporter SpanExporter) {
+	tracer.Lock()
+	tracer.exporter = exporter
+	tracer.pending = nil
+	tracer.Unlock()
+}
+
+// SetRoundSpan sets the span of the current monitor round, the parent of the spans without another one
+func SetRoundSpan(s *Span) {
+	tracer.Lock()
+	tracer.round = s
+	tracer.Unlock()
+}
+
+// RoundSpan returns the span of the current monitor round, nil when none
+func RoundSpan() *Span {
+	tracer.Lock()
+	defer tracer.Unlock()
+	return tracer.round
+}
+
+// StartSpan starts a span under the parent, or a new trace when parent is nil.
+// The attributes are given in key, value pairs.
+func StartSpan(parent *Span, name string, attrs ...interface{}) *Span {
+	tracer.Lock()
+	enabled := tracer.exporter != nil
+	tracer.Unlock()
+	if !enabled {
+		return nil
+	}
+	s := &Span{SpanID: randomHex(8), Name: name, Start: time.Now(), Attributes: make(map[string]interface{})}
+	if parent != nil {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if key, ok := attrs[i].(string); ok {
+			s.Attributes[key] = attrs[i+1]
+		}
+	}
+	return s
+}
+
+// SetAttr sets an attribute of the span
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.Attributes[key] = value
+	}
+}
+
+// SetError marks the span failed with the error, a nil error does nothing
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil {
+		s.Err = err.Error()
+	}
+}
+
+// Finish ends the span and queues it for the export
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	tracer.Lock()
+	if tracer.exporter != nil && len(tracer.pending) < maxPendingSpans {
+		tracer.pending = append(tracer.pending, s)
+	}
+	tracer.Unlock()
+}
+
+// FlushSpans exports the ended spans, it is called at the end of each round
+func FlushSpans() error {
+	tracer.Lock()
+	exporter, spans := tracer.exporter, tracer.pending
+	tracer.pending = nil
+	tracer.Unlock()
+	if exporter == nil || len(spans) == 0 {
+		return nil
+	}
+	return exporter.Export(spans)
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// otlp* are the OTLP/JSON encoding of the trace export request
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is a string in the json mapping
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"` // 1 internal
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// otlpAttribute encodes a value as an OTLP attribute value
+func otlpAttribute(key string, v interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := v.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+// OTLPJSON encodes the spans as an OTLP/JSON trace export request of the service cmonit
+func OTLPJSON(spans []*Span) ([]byte, error) {
+	list := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			o.Attributes = append(o.Attributes, otlpAttribute(k, s.Attributes[k]))
+		}
+		if s.Err != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.Err}
+		}
+		list = append(list, o)
+	}
+	service := RootName
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue{StringValue: &service}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": RootName, "version": VersionNumber},
+				"spans": list,
+			}},
+		}},
+	}
+	return json.Marshal(request)
+}
+
+// OTLPExporter posts the spans to an OTLP/HTTP collector, e.g., http://localhost:4318/v1/traces
+type OTLPExporter struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+// Export posts the spans in one request
+func (e *OTLPExporter) Export(spans []*Span) error {
+	body, err := OTLPJSON(spans)
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("otlp endpoint %s returns %d: %s", e.Endpoint, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// FileExporter appends the spans of each export as one OTLP/JSON line to the file
+type FileExporter struct {
+	Path string
+}
+
+// Export appends the spans to the file
+func (e *FileExporter) Export(spans []*Span) error {
+	if e.Path == "" {
+		return errors.New("Empty trace file path")
+	}
+	body, err := OTLPJSON(spans)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(e.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(body, '\n'))
+	return err
+}